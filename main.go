@@ -5,9 +5,14 @@ This code is proprietary. Do not share the code.
 package main
 
 import (
+	"context"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
@@ -33,15 +38,113 @@ func main() {
 		grpc.MaxRecvMsgSize(MESSAGE_LIMIT),
 		grpc.MaxSendMsgSize(MESSAGE_LIMIT),
 	}
-	grpcServer := grpc.NewServer(
-		append(opts, grpc.UnaryInterceptor(tango.TokenInterceptor))...,
+	if err := tango.LoadSecretProvider(); err != nil {
+		log.Fatalf("failed to load secret provider: %v", err)
+	}
+	if err := tango.LoadJWKS(); err != nil {
+		log.Fatalf("failed to load JWKS: %v", err)
+	}
+	if err := tango.LoadSigningKey(); err != nil {
+		log.Fatalf("failed to load token signing key: %v", err)
+	}
+	if err := tango.LoadJWTSecret(); err != nil {
+		log.Fatalf("failed to load JWT secret: %v", err)
+	}
+	if err := tango.LoadRevocations(); err != nil {
+		log.Fatalf("failed to load token revocations: %v", err)
+	}
+
+	security := "without TLS"
+	creds, err := tango.NewTLSCredentials()
+	if err != nil {
+		log.Fatalf("failed to load TLS credentials: %v", err)
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+		security = "with TLS"
+		if tango.AppConfig.TLS.ClientCA != "" {
+			security = "with mutual TLS"
+		}
+	}
+	tangoServer, err := tango.NewServer()
+	if err != nil {
+		log.Fatalf("failed to initialize server: %v", err)
+	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(
+			tango.AuthenticatePeers,
+			tango.LoggingInterceptor,
+			tango.MetricsInterceptor,
+			tango.TokenInterceptor,
+			tango.AuthorizeInterceptor,
+			tangoServer.VerifyClientIdentity,
+			tangoServer.ForwardToLeader,
+			tangoServer.RouteToOwner,
+		),
+		grpc.ChainStreamInterceptor(tango.StreamInterceptors()...),
 	)
-	tangoServer := tango.NewServer()
+	grpcServer := grpc.NewServer(opts...)
 	pb.RegisterTangoServiceServer(grpcServer, tangoServer)
 	reflection.Register(grpcServer)
 
-	log.Printf("Tango server is running on %s without TLS", listenAddress)
+	if addr := tango.AppConfig.Server.MetricsAddress; addr != "" {
+		go func() {
+			// The tango package publishes its metrics with expvar, which serves them on /debug/vars.
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				log.Printf("Metrics endpoint on %s stopped: %v", addr, err)
+			}
+		}()
+	}
+
+	stopped := make(chan struct{})
+	go shutdownOnSignal(grpcServer, tangoServer, stopped)
+
+	log.Printf("Tango server is running on %s %s", listenAddress, security)
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
+	<-stopped
+}
+
+// drainableServer is the part of the Tango server used to shut it down gracefully.
+type drainableServer interface {
+	Drain()
+	WaitForDrain(context.Context) error
+	Close() error
+}
+
+// shutdownOnSignal waits for SIGTERM or SIGINT, then drains the server: no new shards or jobs are accepted,
+// and results of leased shards are awaited for up to the configured drain timeout. It then stops the gRPC server,
+// giving in-flight calls up to the same timeout to finish, closes the Tango server to flush its records and
+// persisted state, and closes stopped.
+func shutdownOnSignal(grpcServer *grpc.Server, tangoServer drainableServer, stopped chan<- struct{}) {
+	defer close(stopped)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Printf("Received %s, draining", sig)
+
+	timeout := time.Duration(tango.AppConfig.Server.DrainTimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tangoServer.Drain()
+	if err := tangoServer.WaitForDrain(ctx); err != nil {
+		log.Printf("Drain timed out with leased shards outstanding: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Forcing shutdown with RPCs still in flight")
+		grpcServer.Stop()
+	}
+	if err := tangoServer.Close(); err != nil {
+		log.Printf("Failed to close server cleanly: %v", err)
+	}
+	log.Printf("Tango server stopped")
 }
@@ -0,0 +1,347 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	pb "tango/tango/src/protobuff"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Billing periods selectable under billing.period, and the layouts periods are named with.
+const (
+	billingPeriodDay   = "day"   // Periods are UTC days, named like "2006-01-02".
+	billingPeriodMonth = "month" // Periods are UTC months, named like "2006-01".
+)
+
+// Formats billing reports can be exported in.
+const (
+	billingFormatCSV  = "csv"
+	billingFormatJSON = "json"
+)
+
+// amountPrecision is the number of decimal places amounts are rounded to.
+const amountPrecision = 6
+
+// priceTable prices the shards of the billing ledger for consumers, and splits the charges with devices.
+type priceTable struct {
+	currency    string
+	base        float64            // Price per GFLOP of operations without an override.
+	operations  map[string]float64 // Price per GFLOP overrides, keyed by operation.
+	tiers       []PriorityTier     // Priority tiers, highest minimum priority first.
+	deviceShare float64            // Fraction of each charge paid out to the device.
+	layout      string             // Layout periods are named with.
+}
+
+// newPriceTable returns the price table described by the configuration, checking that prices and multipliers
+// are not negative and that the device share is a fraction. Charges are aggregated per month unless set otherwise.
+func newPriceTable(cfg BillingConfig) (*priceTable, error) {
+	pt := &priceTable{
+		currency:    cfg.Currency,
+		base:        cfg.PricePerGFLOP,
+		operations:  make(map[string]float64),
+		tiers:       append([]PriorityTier(nil), cfg.PriorityTiers...),
+		deviceShare: cfg.DeviceShare,
+	}
+	switch cfg.Period {
+	case "", billingPeriodMonth:
+		pt.layout = "2006-01"
+	case billingPeriodDay:
+		pt.layout = "2006-01-02"
+	default:
+		return nil, fmt.Errorf("unknown billing period %q", cfg.Period)
+	}
+	if pt.base < 0 {
+		return nil, fmt.Errorf("billing.price_per_gflop must not be negative")
+	}
+	if pt.deviceShare < 0 || pt.deviceShare > 1 {
+		return nil, fmt.Errorf("billing.device_share must be between 0 and 1")
+	}
+	for _, op := range cfg.Operations {
+		if op.PricePerGFLOP < 0 {
+			return nil, fmt.Errorf("price per GFLOP of operation %s must not be negative", op.Operation)
+		}
+		pt.operations[op.Operation] = op.PricePerGFLOP
+	}
+	for _, tier := range pt.tiers {
+		if tier.Multiplier < 0 {
+			return nil, fmt.Errorf("multiplier of priority tier %d must not be negative", tier.MinPriority)
+		}
+	}
+	sort.Slice(pt.tiers, func(i, j int) bool { return pt.tiers[i].MinPriority > pt.tiers[j].MinPriority })
+	return pt, nil
+}
+
+// price returns the price per GFLOP of a shard of the operation at the given priority, before the tier multiplier,
+// along with the minimum priority and the multiplier of the tier it falls in. Priorities below every tier are charged the plain price.
+func (pt *priceTable) price(operation string, priority int32) (float64, int32, float64) {
+	price, ok := pt.operations[operation]
+	if !ok {
+		price = pt.base
+	}
+	for _, tier := range pt.tiers {
+		if priority >= tier.MinPriority {
+			return price, tier.MinPriority, tier.Multiplier
+		}
+	}
+	return price, 0, 1
+}
+
+// priceEntry records in the shard entry the prices it is billed at, so later changes to the price table
+// do not reprice shards already computed.
+func (pt *priceTable) priceEntry(e *LedgerEntry) {
+	e.PricePerGFLOP, e.PriorityTier, e.TierMultiplier = pt.price(e.Operation, e.Priority)
+	e.DeviceShare = pt.deviceShare
+	e.Priced = true
+}
+
+// period returns the name of the billing period the time falls in.
+func (pt *priceTable) period(t time.Time) string {
+	return t.UTC().Format(pt.layout)
+}
+
+// invoiceLine aggregates the shards of an invoice computed for the same operation in the same priority tier at the same price.
+type invoiceLine struct {
+	Operation     string  `json:"operation"`
+	PriorityTier  int32   `json:"priority_tier"` // Minimum priority of the tier.
+	Shards        int64   `json:"shards"`
+	Flops         int64   `json:"flops"`
+	PricePerGFLOP float64 `json:"price_per_gflop"`
+	Amount        float64 `json:"amount"`
+}
+
+// invoice holds the charges of a consumer over a billing period.
+type invoice struct {
+	ConsumerID string        `json:"consumer_id"`
+	Lines      []invoiceLine `json:"lines"`
+	Flops      int64         `json:"flops"`
+	Total      float64       `json:"total"`
+}
+
+// payout holds the earnings of a device over a billing period.
+type payout struct {
+	DeviceID       string  `json:"device_id"`
+	Shards         int64   `json:"shards"`
+	Flops          int64   `json:"flops"`
+	FlopsAnomalies int64   `json:"flops_anomalies"` // Shards whose reported FLOPs were anomalous, for review before paying out.
+	Amount         float64 `json:"amount"`
+}
+
+// roundAmount rounds an amount to amountPrecision decimal places.
+func roundAmount(amount float64) float64 {
+	scale := math.Pow10(amountPrecision)
+	return math.Round(amount*scale) / scale
+}
+
+// bill aggregates the shard entries into an invoice per consumer and a payout per device, both sorted by ID,
+// at the prices recorded in each entry. Entries recorded without prices are priced with the table.
+// Invoice lines are priced on their total FLOPs; payouts are the device's share of the charges.
+func (pt *priceTable) bill(entries []LedgerEntry) ([]invoice, []payout) {
+	type lineKey struct {
+		operation string
+		tier      int32
+		price     float64
+	}
+	lines := make(map[string]map[lineKey]*invoiceLine)
+	payouts := make(map[string]*payout)
+	earnings := make(map[string]float64)
+	for _, e := range entries {
+		if !e.Priced {
+			pt.priceEntry(&e)
+		}
+		price := e.PricePerGFLOP * e.TierMultiplier
+		if lines[e.ConsumerID] == nil {
+			lines[e.ConsumerID] = make(map[lineKey]*invoiceLine)
+		}
+		key := lineKey{e.Operation, e.PriorityTier, price}
+		line := lines[e.ConsumerID][key]
+		if line == nil {
+			line = &invoiceLine{Operation: e.Operation, PriorityTier: e.PriorityTier, PricePerGFLOP: price}
+			lines[e.ConsumerID][key] = line
+		}
+		line.Shards++
+		line.Flops += e.Flops
+
+		p := payouts[e.DeviceID]
+		if p == nil {
+			p = &payout{DeviceID: e.DeviceID}
+			payouts[e.DeviceID] = p
+		}
+		p.Shards++
+		p.Flops += e.Flops
+		if e.FlopsAnomaly {
+			p.FlopsAnomalies++
+		}
+		earnings[e.DeviceID] += float64(e.Flops) / 1e9 * price * e.DeviceShare
+	}
+
+	invoices := make([]invoice, 0, len(lines))
+	for consumerID, byKey := range lines {
+		inv := invoice{ConsumerID: consumerID}
+		for _, line := range byKey {
+			line.Amount = roundAmount(float64(line.Flops) / 1e9 * line.PricePerGFLOP)
+			inv.Lines = append(inv.Lines, *line)
+			inv.Flops += line.Flops
+			inv.Total += line.Amount
+		}
+		inv.Total = roundAmount(inv.Total)
+		sort.Slice(inv.Lines, func(i, j int) bool {
+			if inv.Lines[i].Operation != inv.Lines[j].Operation {
+				return inv.Lines[i].Operation < inv.Lines[j].Operation
+			}
+			if inv.Lines[i].PriorityTier != inv.Lines[j].PriorityTier {
+				return inv.Lines[i].PriorityTier < inv.Lines[j].PriorityTier
+			}
+			return inv.Lines[i].PricePerGFLOP < inv.Lines[j].PricePerGFLOP
+		})
+		invoices = append(invoices, inv)
+	}
+	sort.Slice(invoices, func(i, j int) bool { return invoices[i].ConsumerID < invoices[j].ConsumerID })
+
+	result := make([]payout, 0, len(payouts))
+	for deviceID, p := range payouts {
+		p.Amount = roundAmount(earnings[deviceID])
+		result = append(result, *p)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DeviceID < result[j].DeviceID })
+	return invoices, result
+}
+
+// formatAmount formats an amount with amountPrecision decimal places.
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', amountPrecision, 64)
+}
+
+// exportInvoices renders the invoices of the period in the given format: a CSV row per invoice line, or a JSON document.
+func exportInvoices(format, period, currency string, invoices []invoice) ([]byte, error) {
+	if format == billingFormatJSON {
+		return json.MarshalIndent(struct {
+			Period   string    `json:"period"`
+			Currency string    `json:"currency"`
+			Invoices []invoice `json:"invoices"`
+		}{period, currency, invoices}, "", "  ")
+	}
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"period", "consumer_id", "operation", "priority_tier", "shards", "flops", "price_per_gflop", "amount", "currency"})
+	for _, inv := range invoices {
+		for _, line := range inv.Lines {
+			cw.Write([]string{
+				period,
+				inv.ConsumerID,
+				line.Operation,
+				strconv.FormatInt(int64(line.PriorityTier), 10),
+				strconv.FormatInt(line.Shards, 10),
+				strconv.FormatInt(line.Flops, 10),
+				strconv.FormatFloat(line.PricePerGFLOP, 'f', -1, 64),
+				formatAmount(line.Amount),
+				currency,
+			})
+		}
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// exportPayouts renders the payouts of the period in the given format: a CSV row per device, or a JSON document.
+func exportPayouts(format, period, currency string, payouts []payout) ([]byte, error) {
+	if format == billingFormatJSON {
+		return json.MarshalIndent(struct {
+			Period   string   `json:"period"`
+			Currency string   `json:"currency"`
+			Payouts  []payout `json:"payouts"`
+		}{period, currency, payouts}, "", "  ")
+	}
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"period", "device_id", "shards", "flops", "flops_anomalies", "amount", "currency"})
+	for _, p := range payouts {
+		cw.Write([]string{
+			period,
+			p.DeviceID,
+			strconv.FormatInt(p.Shards, 10),
+			strconv.FormatInt(p.Flops, 10),
+			strconv.FormatInt(p.FlopsAnomalies, 10),
+			formatAmount(p.Amount),
+			currency,
+		})
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// GetBillingReport prices the shards recorded in this coordinator's billing ledger over a billing period
+// (the current one unless named), and reports the invoice of every consumer and the payout of every device,
+// optionally narrowed to a single consumer or device. When a format is requested, the invoices and payouts
+// are also exported as CSV or JSON. Since each coordinator only holds the results it received, reports are refused
+// in cluster and federation mode, where they would silently miss those received by the other coordinators.
+func (s *server) GetBillingReport(ctx context.Context, req *pb.BillingReportRequest) (*pb.BillingReport, error) {
+	if s.prices == nil {
+		return nil, status.Error(codes.FailedPrecondition, "billing is not configured on this coordinator")
+	}
+	if s.cluster != nil || s.federation != nil {
+		return nil, status.Error(codes.FailedPrecondition, "billing reports only cover a single coordinator's ledger, bill from the shipped records in cluster and federation mode")
+	}
+	if req.Format != "" && req.Format != billingFormatCSV && req.Format != billingFormatJSON {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown export format %q, expected %q or %q", req.Format, billingFormatCSV, billingFormatJSON)
+	}
+	period := req.Period
+	if period == "" {
+		period = s.prices.period(time.Now())
+	} else if _, err := time.Parse(s.prices.layout, period); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "period %q is not formatted like %s", period, s.prices.layout)
+	}
+
+	entries, err := s.ledger.entries(func(e *LedgerEntry) bool {
+		return e.Kind == ledgerShard &&
+			(req.ConsumerId == "" || e.ConsumerID == req.ConsumerId) &&
+			(req.DeviceId == "" || e.DeviceID == req.DeviceId) &&
+			s.prices.period(time.Unix(0, e.ReportedAt)) == period
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read the billing ledger: %v", err)
+	}
+	invoices, payouts := s.prices.bill(entries)
+
+	reply := &pb.BillingReport{Period: period, Currency: s.prices.currency}
+	for _, inv := range invoices {
+		pbInvoice := &pb.Invoice{ConsumerId: inv.ConsumerID, Flops: inv.Flops, Total: inv.Total}
+		for _, line := range inv.Lines {
+			pbInvoice.Lines = append(pbInvoice.Lines, &pb.InvoiceLine{
+				Operation:     line.Operation,
+				PriorityTier:  line.PriorityTier,
+				Shards:        line.Shards,
+				Flops:         line.Flops,
+				PricePerGflop: line.PricePerGFLOP,
+				Amount:        line.Amount,
+			})
+		}
+		reply.Invoices = append(reply.Invoices, pbInvoice)
+	}
+	for _, p := range payouts {
+		reply.Payouts = append(reply.Payouts, &pb.Payout{
+			DeviceId:       p.DeviceID,
+			Shards:         p.Shards,
+			Flops:          p.Flops,
+			FlopsAnomalies: p.FlopsAnomalies,
+			Amount:         p.Amount,
+		})
+	}
+	if req.Format != "" {
+		if reply.InvoicesExport, err = exportInvoices(req.Format, period, s.prices.currency, invoices); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to export invoices: %v", err)
+		}
+		if reply.PayoutsExport, err = exportPayouts(req.Format, period, s.prices.currency, payouts); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to export payouts: %v", err)
+		}
+	}
+	return reply, nil
+}
@@ -0,0 +1,138 @@
+package tango
+
+import (
+	"context"
+	"reflect"
+	pb "tango/tango/src/protobuff"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestBillUsesRecordedPrices checks that shards are billed at the prices recorded in their entries,
+// not those of the current price table, and that entries recorded without prices fall back to the table.
+func TestBillUsesRecordedPrices(t *testing.T) {
+	old, err := newPriceTable(BillingConfig{PricePerGFLOP: 1, DeviceShare: 0.5, PriorityTiers: []PriorityTier{{MinPriority: 5, Multiplier: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := LedgerEntry{ConsumerID: "consumer", DeviceID: "device", Operation: "matmul", Priority: 5, Flops: 1e9}
+	old.priceEntry(&recorded)
+
+	current, err := newPriceTable(BillingConfig{PricePerGFLOP: 3, DeviceShare: 0.1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpriced := LedgerEntry{ConsumerID: "consumer", DeviceID: "device", Operation: "matmul", Priority: 5, Flops: 1e9}
+	invoices, payouts := current.bill([]LedgerEntry{recorded, unpriced})
+
+	if len(invoices) != 1 || len(invoices[0].Lines) != 2 {
+		t.Fatalf("invoices = %+v, want one invoice with two lines", invoices)
+	}
+	lines := invoices[0].Lines
+	if lines[0].PriorityTier != 0 || lines[0].PricePerGFLOP != 3 || lines[0].Amount != 3 {
+		t.Errorf("line priced with the current table = %+v, want tier 0 at 3 per GFLOP", lines[0])
+	}
+	if lines[1].PriorityTier != 5 || lines[1].PricePerGFLOP != 2 || lines[1].Amount != 2 {
+		t.Errorf("line priced when recorded = %+v, want tier 5 at 2 per GFLOP", lines[1])
+	}
+	if invoices[0].Total != 5 {
+		t.Errorf("total = %v, want 5", invoices[0].Total)
+	}
+	if len(payouts) != 1 || payouts[0].Amount != 1.3 {
+		t.Errorf("payouts = %+v, want 1.3 (half of 2 plus a tenth of 3)", payouts)
+	}
+}
+
+// TestGetBillingReportRefusedInFederation checks that billing reports, which only cover the receiving coordinator's
+// ledger, are refused when other coordinators record results too.
+func TestGetBillingReportRefusedInFederation(t *testing.T) {
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	s.prices, _ = newPriceTable(BillingConfig{PricePerGFLOP: 1})
+	s.federation = &federation{}
+	_, err := s.GetBillingReport(context.Background(), &pb.BillingReportRequest{})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("GetBillingReport in federation mode: %v, want FailedPrecondition", err)
+	}
+}
+
+// TestBill checks how shard entries are priced and aggregated into invoice lines and payouts.
+func TestBill(t *testing.T) {
+	cfg := BillingConfig{
+		PricePerGFLOP: 2,
+		Operations:    []OperationPrice{{Operation: "scaled_matmul", PricePerGFLOP: 4}},
+		PriorityTiers: []PriorityTier{{MinPriority: 5, Multiplier: 1.5}, {MinPriority: 10, Multiplier: 3}},
+		DeviceShare:   0.25,
+	}
+	shard := func(consumerID, deviceID, operation string, priority int32, flops int64) LedgerEntry {
+		return LedgerEntry{ConsumerID: consumerID, DeviceID: deviceID, Operation: operation, Priority: priority, Flops: flops}
+	}
+	tests := []struct {
+		name     string
+		entries  []LedgerEntry
+		lines    []invoiceLine // Lines of the first invoice.
+		invoices int
+		payouts  []payout
+	}{
+		{
+			name:     "empty ledger",
+			invoices: 0,
+		},
+		{
+			name:     "base price below every tier",
+			entries:  []LedgerEntry{shard("c", "d", "matmul", 0, 1e9), shard("c", "d", "matmul", 4, 5e8)},
+			lines:    []invoiceLine{{Operation: "matmul", Shards: 2, Flops: 15e8, PricePerGFLOP: 2, Amount: 3}},
+			invoices: 1,
+			payouts:  []payout{{DeviceID: "d", Shards: 2, Flops: 15e8, Amount: 0.75}},
+		},
+		{
+			name:     "operation override and highest tier reached",
+			entries:  []LedgerEntry{shard("c", "d", "scaled_matmul", 12, 1e9), shard("c", "d", "matmul", 7, 1e9)},
+			lines:    []invoiceLine{{Operation: "matmul", PriorityTier: 5, Shards: 1, Flops: 1e9, PricePerGFLOP: 3, Amount: 3}, {Operation: "scaled_matmul", PriorityTier: 10, Shards: 1, Flops: 1e9, PricePerGFLOP: 12, Amount: 12}},
+			invoices: 1,
+			payouts:  []payout{{DeviceID: "d", Shards: 2, Flops: 2e9, Amount: 3.75}},
+		},
+		{
+			name:     "anomalies counted per device",
+			entries:  []LedgerEntry{shard("a", "d1", "matmul", 0, 1e9), shard("b", "d2", "matmul", 0, 1e9), {ConsumerID: "b", DeviceID: "d2", Operation: "matmul", Flops: 1e9, FlopsAnomaly: true}},
+			lines:    []invoiceLine{{Operation: "matmul", Shards: 1, Flops: 1e9, PricePerGFLOP: 2, Amount: 2}},
+			invoices: 2,
+			payouts:  []payout{{DeviceID: "d1", Shards: 1, Flops: 1e9, Amount: 0.5}, {DeviceID: "d2", Shards: 2, Flops: 2e9, FlopsAnomalies: 1, Amount: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt, err := newPriceTable(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			invoices, payouts := pt.bill(tt.entries)
+			if len(invoices) != tt.invoices {
+				t.Fatalf("%d invoices, want %d", len(invoices), tt.invoices)
+			}
+			if tt.invoices > 0 && !reflect.DeepEqual(invoices[0].Lines, tt.lines) {
+				t.Errorf("lines = %+v, want %+v", invoices[0].Lines, tt.lines)
+			}
+			if len(payouts) != len(tt.payouts) || (len(payouts) > 0 && !reflect.DeepEqual(payouts, tt.payouts)) {
+				t.Errorf("payouts = %+v, want %+v", payouts, tt.payouts)
+			}
+		})
+	}
+}
+
+// TestNewPriceTableRejectsInvalidPrices checks that invalid price tables are refused.
+func TestNewPriceTableRejectsInvalidPrices(t *testing.T) {
+	for name, cfg := range map[string]BillingConfig{
+		"negative price":      {PricePerGFLOP: -1},
+		"negative override":   {Operations: []OperationPrice{{Operation: "matmul", PricePerGFLOP: -1}}},
+		"negative multiplier": {PriorityTiers: []PriorityTier{{MinPriority: 1, Multiplier: -1}}},
+		"share above one":     {DeviceShare: 1.5},
+		"unknown period":      {Period: "week"},
+	} {
+		if _, err := newPriceTable(cfg); err == nil {
+			t.Errorf("%s: newPriceTable succeeded, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package tango
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	pb "tango/tango/src/protobuff"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// forwardedHeader marks a request a follower has already forwarded to the leader.
+const forwardedHeader = "tango-forwarded-by"
+
+// raftStore is a JobStore replicated across the coordinators of a cluster with Raft.
+// Every change is proposed as a journal entry and applied by each node's state machine, the leader's included,
+// so a newly elected leader holds exactly the state its predecessor acknowledged.
+// Proposals are serialized, which keeps a planned change valid until it is applied at the cost of
+// one replication round trip per change.
+type raftStore struct {
+	*memoryStore
+	devices   deviceRegistry
+	node      ClusterPeer                   // This coordinator.
+	peers     map[raft.ServerID]ClusterPeer // All coordinators of the cluster, keyed by node ID.
+	timeout   time.Duration                 // How long a proposal may wait to be committed.
+	raft      *raft.Raft
+	logStore  *raftboltdb.BoltStore
+	transport *raft.NetworkTransport
+	proposeMu sync.Mutex  // Serializes proposals.
+	ready     atomic.Bool // Set while this node is leader and has applied every committed entry.
+
+	promotedMu sync.Mutex
+	promoted   func() // Called whenever this node becomes the ready leader.
+
+	conns peerConns // Connections to other coordinators, for forwarding requests to the leader.
+}
+
+// openRaftStore joins this coordinator to the configured cluster and returns its replicated store.
+// On first start with bootstrap enabled, the cluster is formed from the configured peers; afterwards
+// the state is recovered from the local Raft log and snapshots and brought up to date by the leader.
+func openRaftStore(cfg ClusterConfig) (*raftStore, error) {
+	rs := &raftStore{
+		memoryStore: newMemoryStore(),
+		peers:       make(map[raft.ServerID]ClusterPeer),
+		timeout:     time.Duration(cfg.ApplyTimeoutMilliseconds) * time.Millisecond,
+	}
+	servers := make([]raft.Server, 0, len(cfg.Peers))
+	for _, peer := range cfg.Peers {
+		rs.peers[raft.ServerID(peer.NodeID)] = peer
+		servers = append(servers, raft.Server{ID: raft.ServerID(peer.NodeID), Address: raft.ServerAddress(peer.RaftAddress)})
+	}
+	node, found := rs.peers[raft.ServerID(cfg.NodeID)]
+	if !found {
+		return nil, fmt.Errorf("node %q is not among the configured cluster peers", cfg.NodeID)
+	}
+	rs.node = node
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	notify := make(chan bool, 8)
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(node.NodeID)
+	conf.NotifyCh = notify
+	conf.LogOutput = os.Stderr
+	conf.LogLevel = "WARN"
+
+	logStore, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+	rs.logStore = logStore
+	snapshots, err := raft.NewFileSnapshotStore(cfg.Dir, 2, os.Stderr)
+	if err != nil {
+		logStore.Close()
+		return nil, fmt.Errorf("failed to open raft snapshots: %w", err)
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", node.RaftAddress)
+	if err != nil {
+		logStore.Close()
+		return nil, fmt.Errorf("invalid raft address %q: %w", node.RaftAddress, err)
+	}
+	transport, err := raft.NewTCPTransport(node.RaftAddress, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		logStore.Close()
+		return nil, fmt.Errorf("failed to listen on raft address %q: %w", node.RaftAddress, err)
+	}
+	rs.transport = transport
+
+	if cfg.Bootstrap {
+		existing, err := raft.HasExistingState(logStore, logStore, snapshots)
+		if err != nil {
+			rs.closeTransport()
+			return nil, err
+		}
+		if !existing {
+			if err := raft.BootstrapCluster(conf, logStore, logStore, snapshots, transport, raft.Configuration{Servers: servers}); err != nil {
+				rs.closeTransport()
+				return nil, fmt.Errorf("failed to bootstrap cluster: %w", err)
+			}
+		}
+	}
+
+	r, err := raft.NewRaft(conf, rs, logStore, logStore, snapshots, transport)
+	if err != nil {
+		rs.closeTransport()
+		return nil, fmt.Errorf("failed to start raft: %w", err)
+	}
+	rs.raft = r
+	go rs.watchLeadership(notify)
+	log.Printf("Coordinator %s joined cluster of %d nodes on %s", node.NodeID, len(cfg.Peers), node.RaftAddress)
+	return rs, nil
+}
+
+// closeTransport releases the raft transport and log after a failed start.
+func (rs *raftStore) closeTransport() {
+	rs.transport.Close()
+	rs.logStore.Close()
+}
+
+// watchLeadership tracks whether this node may serve requests. A newly elected leader only becomes
+// ready once a barrier confirms it has applied every entry committed by previous leaders.
+func (rs *raftStore) watchLeadership(notify <-chan bool) {
+	for isLeader := range notify {
+		rs.ready.Store(false)
+		if !isLeader {
+			log.Printf("Coordinator %s is no longer the cluster leader", rs.node.NodeID)
+			continue
+		}
+		if err := rs.raft.Barrier(rs.timeout).Error(); err != nil {
+			log.Printf("Coordinator %s won the election but could not catch up: %v", rs.node.NodeID, err)
+			continue
+		}
+		rs.ready.Store(true)
+		log.Printf("Coordinator %s is now the cluster leader", rs.node.NodeID)
+		rs.promotedMu.Lock()
+		promoted := rs.promoted
+		rs.promotedMu.Unlock()
+		if promoted != nil {
+			promoted()
+		}
+	}
+}
+
+// onPromoted registers a function to call whenever this node becomes the ready leader.
+func (rs *raftStore) onPromoted(fn func()) {
+	rs.promotedMu.Lock()
+	defer rs.promotedMu.Unlock()
+	rs.promoted = fn
+}
+
+// isReady reports whether this node is the leader and may serve requests.
+func (rs *raftStore) isReady() bool {
+	return rs.ready.Load()
+}
+
+// leaderRPCAddress returns the RPC address of the current leader, or "" if no leader is known.
+func (rs *raftStore) leaderRPCAddress() string {
+	_, id := rs.raft.LeaderWithID()
+	return rs.peers[id].RPCAddress
+}
+
+// propose replicates an entry and waits until it has been applied on this node.
+func (rs *raftStore) propose(entry *journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return rs.raft.Apply(data, rs.timeout).Error()
+}
+
+// Create replicates the submission of a job. Once it returns, the job survives the loss of any minority
+// of coordinators. The store holds its own copy of the job, which Lookup returns.
+func (rs *raftStore) Create(job *Job) error {
+	rs.proposeMu.Lock()
+	defer rs.proposeMu.Unlock()
+	if _, exists := rs.Lookup(job.JobID); exists {
+		return ErrJobExists
+	}
+	if err := rs.propose(&journalEntry{Type: entrySubmit, Job: snapshotJob(job, job.AData, job.BData)}); err != nil {
+		return fmt.Errorf("failed to replicate job: %w", err)
+	}
+	return nil
+}
+
+// ReserveShard plans the next lease of the job and replicates it.
+// If the lease cannot be replicated, no shard is reserved.
+func (rs *raftStore) ReserveShard(job *Job, now int64, device *Device) (int, bool) {
+	rs.proposeMu.Lock()
+	defer rs.proposeMu.Unlock()
+	job.mu.Lock()
+	entry := planShard(job, now, device)
+	job.mu.Unlock()
+	if entry == nil {
+		return 0, false
+	}
+	if err := rs.propose(entry); err != nil {
+		log.Printf("Failed to replicate assignment of shard %d of job %s: %v", entry.Index, job.JobID, err)
+		return 0, false
+	}
+	return entry.Index, true
+}
+
+// UpdateShard replicates the result of a shard leased to the device and reports whether the job is now ready
+// to be reassembled. Proposals are serialized, so the lease cannot be consumed by another report in between
+// its check and the result being applied.
+func (rs *raftStore) UpdateShard(job *Job, index int, deviceID string, data []byte, record func(lease TimeDeadline) error) (bool, error) {
+	rs.proposeMu.Lock()
+	defer rs.proposeMu.Unlock()
+	job.mu.Lock()
+	err := job.checkLease(index, deviceID)
+	lease := job.PendingTasks[index]
+	wasComplete := job.isComplete()
+	job.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if record != nil {
+		if err := record(lease); err != nil {
+			return false, err
+		}
+	}
+	if err := rs.propose(&journalEntry{Type: entryResult, JobID: job.JobID, Index: index, Data: data}); err != nil {
+		return false, fmt.Errorf("failed to replicate result: %w", err)
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return !wasComplete && job.isComplete(), nil
+}
+
+// Complete replicates the job's final result.
+func (rs *raftStore) Complete(job *Job, finalResult []byte) error {
+	rs.proposeMu.Lock()
+	defer rs.proposeMu.Unlock()
+	job.mu.Lock()
+	completed := job.CompletedAt != 0
+	job.mu.Unlock()
+	if completed {
+		return nil
+	}
+	return rs.propose(&journalEntry{Type: entryComplete, JobID: job.JobID, Data: finalResult, Time: time.Now().UnixNano()})
+}
+
+// Delete replicates the removal of a job.
+func (rs *raftStore) Delete(jobID string) error {
+	rs.proposeMu.Lock()
+	defer rs.proposeMu.Unlock()
+	return rs.propose(&journalEntry{Type: entryDelete, JobID: jobID})
+}
+
+// SaveDevice replicates a device registration.
+func (rs *raftStore) SaveDevice(device *Device) error {
+	rs.proposeMu.Lock()
+	defer rs.proposeMu.Unlock()
+	return rs.propose(&journalEntry{Type: entryRegister, Device: device})
+}
+
+// revoke replicates the revocation of a token ID, subject or device, or the lifting of one when restore is set.
+func (rs *raftStore) revoke(r revocation, restore bool) error {
+	rs.proposeMu.Lock()
+	defer rs.proposeMu.Unlock()
+	return rs.propose(&journalEntry{Type: entryRevoke, Revocation: &r, Restore: restore})
+}
+
+// Devices returns the devices registered with the cluster.
+func (rs *raftStore) Devices() []*Device {
+	return rs.devices.list()
+}
+
+// Close leaves the cluster and releases the raft log and peer connections.
+// A leader first hands leadership to another coordinator, so the cluster does not wait for an election timeout.
+func (rs *raftStore) Close() error {
+	if rs.isReady() {
+		if err := rs.raft.LeadershipTransfer().Error(); err != nil {
+			log.Printf("Failed to transfer cluster leadership: %v", err)
+		}
+	}
+	err := rs.raft.Shutdown().Error()
+	rs.closeTransport()
+	rs.conns.close()
+	return err
+}
+
+// Apply applies a committed entry to this node's state. It implements raft.FSM.
+func (rs *raftStore) Apply(l *raft.Log) interface{} {
+	var entry journalEntry
+	if err := json.Unmarshal(l.Data, &entry); err != nil {
+		log.Printf("Discarding undecodable raft entry %d: %v", l.Index, err)
+		return nil
+	}
+	switch entry.Type {
+	case entryRegister:
+		if entry.Device != nil {
+			rs.devices.save(entry.Device)
+		}
+	case entryRevoke:
+		if entry.Revocation != nil {
+			if err := revocations.update(*entry.Revocation, entry.Restore); err != nil {
+				log.Printf("Failed to persist replicated revocation of %s %s: %v", entry.Revocation.Kind, entry.Revocation.Value, err)
+			}
+		}
+	default:
+		rs.apply(&entry)
+	}
+	return nil
+}
+
+// Snapshot captures the entries that recreate the current state, deny list included. It implements raft.FSM.
+func (rs *raftStore) Snapshot() (raft.FSMSnapshot, error) {
+	entries := stateEntries(rs.devices.list(), rs.List())
+	for _, r := range revocations.list() {
+		entries = append(entries, &journalEntry{Type: entryRevoke, Revocation: &r})
+	}
+	return &entrySnapshot{entries: entries}, nil
+}
+
+// Restore replaces this node's state, deny list included, with a snapshot. It implements raft.FSM.
+func (rs *raftStore) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	rs.memoryStore.mu.Lock()
+	rs.jobs = make(map[string]*Job)
+	rs.queue = make([]string, 0)
+	rs.memoryStore.mu.Unlock()
+	rs.devices.mu.Lock()
+	rs.devices.devices = make(map[string]*Device)
+	rs.devices.mu.Unlock()
+
+	var revoked []revocation
+	decoder := json.NewDecoder(bufio.NewReader(snapshot))
+	for {
+		var entry journalEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to decode snapshot: %w", err)
+		}
+		switch entry.Type {
+		case entryRegister:
+			if entry.Device != nil {
+				rs.devices.save(entry.Device)
+			}
+		case entryRevoke:
+			if entry.Revocation != nil {
+				revoked = append(revoked, *entry.Revocation)
+			}
+		default:
+			rs.apply(&entry)
+		}
+	}
+	if err := revocations.replace(revoked); err != nil {
+		return fmt.Errorf("failed to persist restored revocations: %w", err)
+	}
+	return nil
+}
+
+// entrySnapshot is a point-in-time snapshot of the replicated state, stored as journal entries.
+type entrySnapshot struct {
+	entries []*journalEntry
+}
+
+// Persist writes the snapshot as one JSON entry per line. It implements raft.FSMSnapshot.
+func (es *entrySnapshot) Persist(sink raft.SnapshotSink) error {
+	writer := bufio.NewWriter(sink)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range es.entries {
+		if err := encoder.Encode(entry); err != nil {
+			sink.Cancel()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release is a no-op, since the snapshot holds no resources. It implements raft.FSMSnapshot.
+func (es *entrySnapshot) Release() {}
+
+// ForwardToLeader is a gRPC unary interceptor that lets any coordinator of a cluster accept requests.
+// The leader serves TangoService requests itself; other nodes forward them, token included, to the leader
+// and relay its reply. RPCs concerning the receiving coordinator itself, such as its token sessions, are always
+// served locally. Requests that were already forwarded once are refused rather than forwarded again,
+// so nodes with a stale view of the leader cannot bounce requests between each other.
+// Outside of cluster mode, every request is served locally.
+func (s *server) ForwardToLeader(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.cluster == nil || s.cluster.isReady() || coordinatorLocal[info.FullMethod] || !strings.HasPrefix(info.FullMethod, "/"+pb.TangoService_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	if hasHeader(ctx, forwardedHeader) {
+		return nil, status.Error(codes.Unavailable, "coordinator is not the cluster leader, retry later")
+	}
+	addr := s.cluster.leaderRPCAddress()
+	if addr == "" {
+		return nil, status.Error(codes.Unavailable, "no cluster leader elected, retry later")
+	}
+	reply, err := s.cluster.conns.forwardCall(ctx, addr, info.FullMethod, req, forwardedHeader, s.cluster.node.NodeID)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Unavailable, "failed to reach cluster leader: %v", err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,129 @@
+package tango
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// bufferSink is a raft.SnapshotSink keeping the snapshot in memory.
+type bufferSink struct {
+	bytes.Buffer
+	cancelled bool
+}
+
+// ID returns a fixed snapshot ID.
+func (bs *bufferSink) ID() string { return "test" }
+
+// Cancel marks the snapshot as cancelled.
+func (bs *bufferSink) Cancel() error {
+	bs.cancelled = true
+	return nil
+}
+
+// Close is a no-op.
+func (bs *bufferSink) Close() error { return nil }
+
+// applyEntry applies a journal entry to the state machine of the cluster node, as if it had been committed.
+func applyEntry(t *testing.T, rs *raftStore, entry *journalEntry) {
+	t.Helper()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Apply(&raft.Log{Index: 1, Data: data})
+}
+
+// snapshotState persists a snapshot of the node's state machine and returns it.
+func snapshotState(t *testing.T, rs *raftStore) *bufferSink {
+	t.Helper()
+	snapshot, err := rs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &bufferSink{}
+	if err := snapshot.Persist(sink); err != nil || sink.cancelled {
+		t.Fatalf("failed to persist snapshot: %v", err)
+	}
+	return sink
+}
+
+// TestRaftStoreReplicatesRevocations checks that revocations applied through the cluster's state machine
+// reach the deny list, and that restoring a snapshot replaces the deny list with the snapshot's.
+func TestRaftStoreReplicatesRevocations(t *testing.T) {
+	defer revocations.replace(nil)
+	rs := &raftStore{memoryStore: newMemoryStore()}
+	applyEntry(t, rs, &journalEntry{Type: entryRevoke, Revocation: &revocation{Kind: revokeJTI, Value: "kept"}})
+	applyEntry(t, rs, &journalEntry{Type: entryRevoke, Revocation: &revocation{Kind: revokeDevice, Value: "lifted"}})
+	applyEntry(t, rs, &journalEntry{Type: entryRevoke, Revocation: &revocation{Kind: revokeDevice, Value: "lifted"}, Restore: true})
+	if !revocations.revoked(revokeJTI, "kept") || revocations.revoked(revokeDevice, "lifted") {
+		t.Fatalf("deny list after applying revocations = %+v, want only jti kept", revocations.list())
+	}
+
+	sink := snapshotState(t, rs)
+	if err := revocations.update(revocation{Kind: revokeSubject, Value: "stale"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if !revocations.revoked(revokeJTI, "kept") || revocations.revoked(revokeSubject, "stale") {
+		t.Fatalf("deny list after restoring = %+v, want only jti kept", revocations.list())
+	}
+}
+
+// TestRaftStoreSnapshotRestore checks that committed entries are applied to the node's jobs and devices,
+// and that a snapshot restored on another node recreates the same state.
+func TestRaftStoreSnapshotRestore(t *testing.T) {
+	leader := &raftStore{memoryStore: newMemoryStore()}
+	job := &jobSnapshot{JobID: "job", ConsumerID: "consumer", Operation: "matmul", SubmittedAt: 1, M: 2, N: 2, D: 2, RowSplits: 1, ColSplits: 2}
+	for _, entry := range []*journalEntry{
+		{Type: entryRegister, Device: &Device{DeviceID: "device"}},
+		{Type: entrySubmit, Job: job},
+		{Type: entrySubmit, Job: job},
+		{Type: entryAssign, JobID: "job", Index: 1, DeviceID: "device", Deadline: 100},
+		{Type: entryAssign, JobID: "job", Index: 2, DeviceID: "device", Deadline: 100},
+		{Type: entryResult, JobID: "job", Index: 1, Data: []byte("first")},
+		{Type: entryResult, JobID: "job", Index: 1, Data: []byte("again")},
+	} {
+		applyEntry(t, leader, entry)
+	}
+	check := func(rs *raftStore, state string) {
+		t.Helper()
+		if devices := rs.Devices(); len(devices) != 1 || devices[0].DeviceID != "device" {
+			t.Errorf("devices %s = %v, want the registered device", state, devices)
+		}
+		if queued := rs.Queued(); len(queued) != 1 {
+			t.Fatalf("%d jobs queued %s, want 1", len(queued), state)
+		}
+		stored, _ := rs.Lookup("job")
+		stored.mu.Lock()
+		defer stored.mu.Unlock()
+		if stored.ReceivedUpdates != 1 || string(stored.Results[1]) != "again" {
+			t.Errorf("results %s = %d %q, want shard 1's latest result counted once", state, stored.ReceivedUpdates, stored.Results[1])
+		}
+		if lease, leased := stored.PendingTasks[2]; !leased || lease.DeviceID != "device" || lease.Deadline != 100 {
+			t.Errorf("lease of shard 2 %s = %+v, want it leased to the device", state, lease)
+		}
+	}
+	check(leader, "after applying")
+
+	sink := snapshotState(t, leader)
+	follower := &raftStore{memoryStore: newMemoryStore()}
+	applyEntry(t, follower, &journalEntry{Type: entrySubmit, Job: &jobSnapshot{JobID: "stale", SubmittedAt: 1}})
+	if err := follower.Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := follower.Lookup("stale"); exists {
+		t.Error("restoring a snapshot kept a job missing from it")
+	}
+	check(follower, "after restoring")
+
+	applyEntry(t, follower, &journalEntry{Type: entryComplete, JobID: "job", Data: []byte("final"), Time: 200})
+	if queued := follower.Queued(); len(queued) != 0 {
+		t.Errorf("%d jobs queued after completion, want none", len(queued))
+	}
+}
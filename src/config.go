@@ -1,19 +1,62 @@
 package tango
 
 import (
+	"errors"
+	"os"
+
 	"github.com/spf13/viper"
 )
 
-// ServerConfig holds the configuration for the Tango server, including its name, host, and port.
+// ServerConfig holds the configuration for the Tango server, including its name, host, and port,
+// how long a shutdown waits for leased shards to be reported before stopping, and the address metrics are served on.
 type ServerConfig struct {
-	Name string `mapstructure:"name"`
-	Host string `mapstructure:"host"`
-	Port int    `mapstructure:"port"`
+	Name                string `mapstructure:"name"`
+	Host                string `mapstructure:"host"`
+	Port                int    `mapstructure:"port"`
+	DrainTimeoutSeconds int    `mapstructure:"drain_timeout_seconds"`
+	MetricsAddress      string `mapstructure:"metrics_address"`
 }
 
-// TokensConfig holds configuration details for JWT secrets used by the Tango service.
+// TokensConfig holds configuration for validating and issuing the JWTs used by the Tango service.
 type TokensConfig struct {
+	// JWTSecret is unused: the JWT secret is read through the secret provider.
 	JWTSecret string `mapstructure:"JWTSecret"`
+	// DefaultRoles are granted to tokens without a role claim; tokens are refused when it is empty.
+	DefaultRoles []string `mapstructure:"default_roles"`
+	// JWKS is a file path or an http(s) URL of the public keys of asymmetrically signed tokens,
+	// reloaded every JWKSRefreshSeconds when positive.
+	JWKS               string `mapstructure:"jwks"`
+	JWKSRefreshSeconds int    `mapstructure:"jwks_refresh_seconds"`
+	// Issuer and Audience are required in the iss and aud claims of tokens, unless empty.
+	Issuer   string `mapstructure:"issuer"`
+	Audience string `mapstructure:"audience"`
+	// ClockSkewSeconds is tolerated on the exp, nbf and iat claims.
+	ClockSkewSeconds int `mapstructure:"clock_skew_seconds"`
+	// MaxLifetimeSeconds caps the lifetime of accepted access tokens, unless 0.
+	MaxLifetimeSeconds int `mapstructure:"max_lifetime_seconds"`
+	// RevocationFile keeps the deny list of revoked tokens.
+	RevocationFile string `mapstructure:"revocation_file"`
+	// SigningKey is the PEM private key issued tokens are signed with, identified by SigningKeyID;
+	// when empty, they are signed with HS256 and the JWT secret.
+	SigningKey   string `mapstructure:"signing_key"`
+	SigningKeyID string `mapstructure:"signing_key_id"`
+	// AccessTTLSeconds and RefreshTTLSeconds are the lifetimes of issued access and refresh tokens.
+	AccessTTLSeconds  int `mapstructure:"access_ttl_seconds"`
+	RefreshTTLSeconds int `mapstructure:"refresh_ttl_seconds"`
+	// APIKeys are exchanged by IssueToken for access tokens.
+	APIKeys []APIKey `mapstructure:"api_keys"`
+}
+
+// APIKey is a long-lived credential that IssueToken exchanges for short-lived access tokens:
+// a consumer's API key, or a registration secret shared by devices. Only the hex SHA-256 digest
+// of the key is configured. Issued tokens take the key's name as subject, and carry its consumer ID,
+// roles and highest job priority.
+type APIKey struct {
+	Name        string   `mapstructure:"name"`
+	SHA256      string   `mapstructure:"sha256"`
+	ConsumerID  string   `mapstructure:"consumer_id"`
+	Roles       []string `mapstructure:"roles"`
+	MaxPriority *int32   `mapstructure:"max_priority"`
 }
 
 // TaskConfig holds configuration parameters for task processing, such as timeout and reaper interval.
@@ -22,6 +65,155 @@ type TaskConfig struct {
 	ReaperIntervalMilliseconds int `mapstructure:"reaper_interval_milliseconds"`
 }
 
+// ConsumerWeight assigns a fair-share weight to a single consumer.
+type ConsumerWeight struct {
+	ConsumerID string  `mapstructure:"consumer_id"`
+	Weight     float64 `mapstructure:"weight"`
+}
+
+// SchedulerConfig holds configuration for job scheduling, including fair-share weights across consumers,
+// the highest priority granted to tokens without a max_priority claim, and the priority aging interval.
+type SchedulerConfig struct {
+	DefaultWeight        float64          `mapstructure:"default_weight"`
+	ConsumerWeights      []ConsumerWeight `mapstructure:"consumer_weights"`
+	DefaultMaxPriority   int32            `mapstructure:"default_max_priority"`
+	AgingIntervalSeconds int              `mapstructure:"aging_interval_seconds"`
+}
+
+// QuotaLimits holds the admission limits applied to a consumer.
+// A zero value for any limit means the limit is not enforced.
+type QuotaLimits struct {
+	MaxConcurrentJobs int32 `mapstructure:"max_concurrent_jobs"`
+	MaxQueuedBytes    int64 `mapstructure:"max_queued_bytes"`
+	MaxFlopsPerDay    int64 `mapstructure:"max_flops_per_day"`
+}
+
+// ConsumerQuota overrides the default quota limits for a single consumer.
+type ConsumerQuota struct {
+	ConsumerID  string `mapstructure:"consumer_id"`
+	QuotaLimits `mapstructure:",squash"`
+}
+
+// QuotaConfig holds the default per-consumer quota limits and per-consumer overrides.
+type QuotaConfig struct {
+	Default   QuotaLimits     `mapstructure:"default"`
+	Consumers []ConsumerQuota `mapstructure:"consumers"`
+}
+
+// MemoryConfig holds the server-wide memory budget for job data, the fraction of the budget
+// above which cold data is spilled and submissions are refused, and the directory used for spilling.
+type MemoryConfig struct {
+	BudgetBytes   int64   `mapstructure:"budget_bytes"`
+	HighWatermark float64 `mapstructure:"high_watermark"`
+	SpillDir      string  `mapstructure:"spill_dir"`
+}
+
+// StoreConfig holds configuration for persisting job state to a write-ahead log on local disk,
+// including whether persistence is enabled, the log directory, and whether every entry is synced to disk.
+// It also sets how long completed jobs are kept, with their final results, before they are pruned (0 keeps them forever).
+type StoreConfig struct {
+	Enabled                   bool   `mapstructure:"enabled"`
+	Dir                       string `mapstructure:"dir"`
+	Fsync                     bool   `mapstructure:"fsync"`
+	CompletedRetentionSeconds int    `mapstructure:"completed_retention_seconds"`
+}
+
+// RecordsConfig holds configuration for the billing ledger of the shards computed by devices,
+// including the directory it is kept in and whether every entry is synced to disk.
+// It also selects the sink the ledger's records are shipped to: a local directory ("local"),
+// the GCS records bucket ("gcs") or a bucket of an S3-compatible object store ("s3").
+type RecordsConfig struct {
+	Dir       string   `mapstructure:"dir"`
+	Fsync     bool     `mapstructure:"fsync"`
+	Sink      string   `mapstructure:"sink"`
+	ExportDir string   `mapstructure:"export_dir"`
+	S3        S3Config `mapstructure:"s3"`
+}
+
+// S3Config holds the base URL of an S3-compatible object store, the bucket records are shipped to, and its region.
+// Credentials are read through the secret provider.
+type S3Config struct {
+	Endpoint string `mapstructure:"endpoint"`
+	Bucket   string `mapstructure:"bucket"`
+	Region   string `mapstructure:"region"`
+}
+
+// OperationPrice overrides the price per GFLOP of a single operation.
+type OperationPrice struct {
+	Operation     string  `mapstructure:"operation"`
+	PricePerGFLOP float64 `mapstructure:"price_per_gflop"`
+}
+
+// PriorityTier scales the price of the shards of jobs submitted with at least the given priority.
+type PriorityTier struct {
+	MinPriority int32   `mapstructure:"min_priority"`
+	Multiplier  float64 `mapstructure:"multiplier"`
+}
+
+// BillingConfig holds the price tables applied to the billing ledger, including the currency amounts are in,
+// the price per GFLOP of every operation and per-operation overrides, and price multipliers for priority tiers.
+// It also sets the share of each charge paid out to the device that computed the shard,
+// and whether charges are aggregated per "day" or per "month" (UTC).
+type BillingConfig struct {
+	Currency      string           `mapstructure:"currency"`
+	PricePerGFLOP float64          `mapstructure:"price_per_gflop"`
+	Operations    []OperationPrice `mapstructure:"operations"`
+	PriorityTiers []PriorityTier   `mapstructure:"priority_tiers"`
+	DeviceShare   float64          `mapstructure:"device_share"`
+	Period        string           `mapstructure:"period"`
+}
+
+// ClusterPeer describes one coordinator of a high-availability cluster:
+// its node ID, the address it replicates job state on, and the address it serves gRPC requests on.
+type ClusterPeer struct {
+	NodeID      string `mapstructure:"node_id"`
+	RaftAddress string `mapstructure:"raft_address"`
+	RPCAddress  string `mapstructure:"rpc_address"`
+}
+
+// ClusterConfig holds configuration for running several coordinators as a replicated cluster with an elected leader,
+// including this coordinator's node ID, the directory for its replication log, whether it may bootstrap
+// a new cluster, every coordinator of the cluster, and how long a change may wait to be replicated.
+// When enabled, the cluster replaces the write-ahead log of the store section.
+type ClusterConfig struct {
+	Enabled                  bool          `mapstructure:"enabled"`
+	NodeID                   string        `mapstructure:"node_id"`
+	Dir                      string        `mapstructure:"dir"`
+	Bootstrap                bool          `mapstructure:"bootstrap"`
+	Peers                    []ClusterPeer `mapstructure:"peers"`
+	ApplyTimeoutMilliseconds int           `mapstructure:"apply_timeout_milliseconds"`
+}
+
+// FederationNode describes one coordinator of a federation and the address it serves gRPC requests on.
+type FederationNode struct {
+	NodeID     string `mapstructure:"node_id"`
+	RPCAddress string `mapstructure:"rpc_address"`
+}
+
+// FederationConfig holds configuration for partitioning jobs across several coordinators,
+// including whether federation is enabled, this coordinator's node ID, and every member of the federation.
+type FederationConfig struct {
+	Enabled bool             `mapstructure:"enabled"`
+	NodeID  string           `mapstructure:"node_id"`
+	Nodes   []FederationNode `mapstructure:"nodes"`
+}
+
+// TLSConfig holds configuration for serving gRPC over TLS, including where the server certificate and key
+// are read from ("file" paths, "gcp" secret names, or "secrets" of the configured secret provider),
+// the CA that verifies client certificates for mutual TLS, the CA and certificate names of other coordinators,
+// and how often rotated certificates are reloaded.
+type TLSConfig struct {
+	Enabled               bool     `mapstructure:"enabled"`
+	Source                string   `mapstructure:"source"`
+	Cert                  string   `mapstructure:"cert"`
+	Key                   string   `mapstructure:"key"`
+	ClientCA              string   `mapstructure:"client_ca"`
+	RequireClientCert     bool     `mapstructure:"require_client_cert"`
+	PeerCA                string   `mapstructure:"peer_ca"`
+	PeerNames             []string `mapstructure:"peer_names"`
+	ReloadIntervalSeconds int      `mapstructure:"reload_interval_seconds"`
+}
+
 // LoggingConfig holds configuration details for logging, including log level and file path.
 type LoggingConfig struct {
 	Level string `mapstructure:"level"`
@@ -42,13 +234,34 @@ type GCPConfig struct {
 	ServerKey           string `mapstructure:"server_key"`
 }
 
+// SecretsConfig selects where secrets are read from: GCP Secret Manager ("gcp"), environment variables ("env"),
+// named after the secret with a prefix, or files in a directory ("file"), named after the secret.
+// It also sets how often secrets are refreshed, and how long a rotated JWT secret keeps validating tokens.
+type SecretsConfig struct {
+	Provider       string `mapstructure:"provider"`
+	EnvPrefix      string `mapstructure:"env_prefix"`
+	Dir            string `mapstructure:"dir"`
+	RefreshSeconds int    `mapstructure:"refresh_seconds"`
+	GraceSeconds   int    `mapstructure:"grace_seconds"`
+}
+
 // Config aggregates all configuration settings for the Tango application.
 type Config struct {
-	Server  ServerConfig  `mapstructure:"server"`
-	Tokens  TokensConfig  `mapstructure:"tokens"`
-	Task    TaskConfig    `mapstructure:"task"`
-	Logging LoggingConfig `mapstructure:"logging"`
-	GCP     GCPConfig     `mapstructure:"gcp"`
+	Server     ServerConfig     `mapstructure:"server"`
+	Tokens     TokensConfig     `mapstructure:"tokens"`
+	Task       TaskConfig       `mapstructure:"task"`
+	Scheduler  SchedulerConfig  `mapstructure:"scheduler"`
+	Quotas     QuotaConfig      `mapstructure:"quotas"`
+	Memory     MemoryConfig     `mapstructure:"memory"`
+	Store      StoreConfig      `mapstructure:"store"`
+	Records    RecordsConfig    `mapstructure:"records"`
+	Billing    BillingConfig    `mapstructure:"billing"`
+	Cluster    ClusterConfig    `mapstructure:"cluster"`
+	Federation FederationConfig `mapstructure:"federation"`
+	TLS        TLSConfig        `mapstructure:"tls"`
+	Logging    LoggingConfig    `mapstructure:"logging"`
+	GCP        GCPConfig        `mapstructure:"gcp"`
+	Secrets    SecretsConfig    `mapstructure:"secrets"`
 }
 
 // AppConfig is the global configuration for the Tango application.
@@ -73,9 +286,16 @@ func LoadConfig(path string) (*Config, error) {
 }
 
 // init is called automatically to load the application configuration from "./config.yaml"
-// and assigns it to the global variable AppConfig.
+// (or "../config.yaml" when there is none, as for tests), or from the file named by the TANGO_CONFIG environment variable, and assigns it to the global variable AppConfig.
 func init() {
-	conf, err := LoadConfig("./config.yaml")
+	path := os.Getenv("TANGO_CONFIG")
+	if path == "" {
+		path = "./config.yaml"
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			path = "../config.yaml" // Tests run from the package's directory.
+		}
+	}
+	conf, err := LoadConfig(path)
 	if err != nil {
 		panic(err)
 	}
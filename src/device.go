@@ -0,0 +1,175 @@
+package tango
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	pb "tango/tango/src/protobuff"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultDType is the element type of every matrix currently accepted by Tango.
+// Matrices are transported as JSON-encoded float32 values.
+const defaultDType = "float32"
+
+// Device represents a compute device registered with the server.
+// It records the capabilities the device advertised at registration time,
+// which are used to decide which shards the device may be handed.
+type Device struct {
+	DeviceID       string          // Server-issued identifier of the device.
+	Operations     map[string]bool // Operations the device can execute (e.g., "scaled_matmul").
+	DTypes         map[string]bool // Element types the device can process (e.g., "float32").
+	MemoryBytes    int64           // Memory available to the device for a single shard.
+	FlopsPerSecond float64         // Throughput measured by the device.
+	MaxShardBytes  int64           // Largest shard, in bytes, the device is willing to accept.
+	RegisteredAt   int64           // Unix timestamp (nanoseconds) of the registration.
+	CertIdentity   string          // Identity of the client certificate the device registered with, if any.
+}
+
+// newDeviceID generates a random, server-issued device identifier.
+func newDeviceID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "device_" + hex.EncodeToString(buf), nil
+}
+
+// validDeviceID reports whether the ID has the form of a server-issued device identifier.
+func validDeviceID(id string) bool {
+	hexPart, found := strings.CutPrefix(id, "device_")
+	if !found || len(hexPart) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(hexPart)
+	return err == nil
+}
+
+// toSet converts a list of strings into a set, ignoring empty entries.
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		if v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// RegisterDevice is invoked by a device to announce its capabilities.
+// It validates the advertised capabilities, issues a new device identity along with an access token
+// and a refresh token bound to it, which the device must use from then on, and persists the device
+// in the registry so FetchTask can match shards against it. Tokens are only ever bound to a device here.
+// Federation members mirror a device registered with another member by passing its existing ID;
+// other callers may not choose the ID, so they cannot take over a device registered elsewhere.
+// A device registering over mutual TLS is bound to the identity of its client certificate.
+func (s *server) RegisterDevice(ctx context.Context, req *pb.DeviceRegistration) (*pb.DeviceRegistrationReply, error) {
+	if len(req.Operations) == 0 {
+		return &pb.DeviceRegistrationReply{
+			Accepted: false,
+			Message:  "At least one supported operation is required.",
+		}, nil
+	}
+	if req.MemoryBytes <= 0 || req.FlopsPerSecond <= 0 {
+		return &pb.DeviceRegistrationReply{
+			Accepted: false,
+			Message:  "Memory and measured FLOP/s must be positive.",
+		}, nil
+	}
+
+	var deviceID string
+	if req.DeviceId != nil {
+		if s.federation == nil || !peerFromContext(ctx) || !hasHeader(ctx, routedHeader) || !validDeviceID(*req.DeviceId) {
+			return &pb.DeviceRegistrationReply{
+				Accepted: false,
+				Message:  "Device IDs are issued by the server.",
+			}, nil
+		}
+		deviceID = *req.DeviceId
+		if _, registered := s.lookupDevice(deviceID); registered {
+			return &pb.DeviceRegistrationReply{
+				Accepted: true,
+				DeviceId: deviceID,
+				Message:  "Device already registered.",
+			}, nil
+		}
+	} else {
+		id, err := newDeviceID()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate device id: %w", err)
+		}
+		deviceID = id
+	}
+	var tokens *pb.TokenReply
+	if req.DeviceId == nil {
+		var err error
+		if tokens, err = issueTokens(deviceClaims(ctx, deviceID)); err != nil {
+			return nil, err
+		}
+	}
+	dtypes := toSet(req.Dtypes)
+	if len(dtypes) == 0 {
+		dtypes[defaultDType] = true
+	}
+	device := &Device{
+		DeviceID:       deviceID,
+		Operations:     toSet(req.Operations),
+		DTypes:         dtypes,
+		MemoryBytes:    req.MemoryBytes,
+		FlopsPerSecond: req.FlopsPerSecond,
+		MaxShardBytes:  req.MaxShardBytes,
+		RegisteredAt:   time.Now().UnixNano(),
+	}
+	if identity, ok := requestCertIdentity(ctx); ok {
+		device.CertIdentity = identity
+	}
+
+	if err := s.store.SaveDevice(device); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to persist device registration: %v", err)
+	}
+	s.devicesMu.Lock()
+	s.devices[deviceID] = device
+	s.devicesMu.Unlock()
+
+	return &pb.DeviceRegistrationReply{
+		Accepted: true,
+		DeviceId: deviceID,
+		Message:  "Device registered successfully.",
+		Tokens:   tokens,
+	}, nil
+}
+
+// lookupDevice returns the registered device with the given ID, if any.
+func (s *server) lookupDevice(deviceID string) (*Device, bool) {
+	s.devicesMu.RLock()
+	defer s.devicesMu.RUnlock()
+	device, ok := s.devices[deviceID]
+	return device, ok
+}
+
+// canHandle reports whether the device is able to process shards of the given job.
+// The device must support the job's operation and dtype, and the shard it would have to hold
+// must fit within both the device's memory and its advertised maximum shard size.
+func (d *Device) canHandle(job *Job) bool {
+	if !d.Operations[job.Operation] || !d.DTypes[job.DType] {
+		return false
+	}
+	limit := d.shardLimit()
+	return limit <= 0 || job.requiredShardBytes() <= limit
+}
+
+// shardLimit returns the largest shard size in bytes the device can accept,
+// which is the smaller of its memory and its advertised maximum shard size.
+// A non-positive value means the device imposes no limit.
+func (d *Device) shardLimit() int64 {
+	limit := d.MemoryBytes
+	if d.MaxShardBytes > 0 && (limit <= 0 || d.MaxShardBytes < limit) {
+		limit = d.MaxShardBytes
+	}
+	return limit
+}
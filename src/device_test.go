@@ -0,0 +1,92 @@
+package tango
+
+import (
+	"context"
+	"testing"
+
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// TestRegisterDeviceWithID checks that only another federation member may register a device under an existing ID.
+func TestRegisterDeviceWithID(t *testing.T) {
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	s.federation = &federation{}
+	deviceID, err := newDeviceID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	routed := metadata.NewIncomingContext(testContext("mallory", ""), metadata.Pairs(routedHeader, "coordinator-b"))
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		accepted bool
+	}{
+		{"caller", testContext("mallory", ""), false},
+		{"routed header without peer authentication", routed, false},
+		{"federation member", context.WithValue(routed, "peer", true), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := s.RegisterDevice(tt.ctx, &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9, DeviceId: &deviceID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Accepted != tt.accepted {
+				t.Errorf("accepted = %v (%s), want %v", reply.Accepted, reply.Message, tt.accepted)
+			}
+		})
+	}
+}
+
+// TestRegisterDeviceCapabilities checks that registrations without operations, memory or throughput are refused,
+// and that a registered device is only matched with jobs whose operation and dtype it advertised,
+// float32 by default, and whose shards fit both its memory and its maximum shard size.
+func TestRegisterDeviceCapabilities(t *testing.T) {
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	// A 4×4 result over d = 4 in a 2×2 grid has shards of 4 * (2*4 + 4*2 + 2*2) = 80 bytes.
+	job := func(operation string) *Job {
+		return createJob(&pb.TaskRequest{JobId: "job", Operation: operation, M: 4, N: 4, D: 4, RowSplits: 2, ColSplits: 2})
+	}
+	tests := []struct {
+		name     string
+		reg      *pb.DeviceRegistration
+		job      *Job
+		accepted bool
+		handles  bool
+	}{
+		{"no operation", &pb.DeviceRegistration{MemoryBytes: 1 << 30, FlopsPerSecond: 1e9}, nil, false, false},
+		{"no memory", &pb.DeviceRegistration{Operations: []string{"matmul"}, FlopsPerSecond: 1e9}, nil, false, false},
+		{"no throughput", &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30}, nil, false, false},
+		{"operation", &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9}, job("matmul"), true, true},
+		{"other operation", &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9}, job("scaled_matmul"), true, false},
+		{"other dtype", &pb.DeviceRegistration{Operations: []string{"matmul"}, Dtypes: []string{"float16"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9}, job("matmul"), true, false},
+		{"memory fits", &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 80, FlopsPerSecond: 1e9}, job("matmul"), true, true},
+		{"memory too small", &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 79, FlopsPerSecond: 1e9}, job("matmul"), true, false},
+		{"max shard too small", &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, MaxShardBytes: 79, FlopsPerSecond: 1e9}, job("matmul"), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := s.RegisterDevice(testContext("owner", ""), tt.reg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Accepted != tt.accepted {
+				t.Fatalf("accepted = %v (%s), want %v", reply.Accepted, reply.Message, tt.accepted)
+			}
+			if !tt.accepted {
+				return
+			}
+			device, registered := s.lookupDevice(reply.DeviceId)
+			if !registered {
+				t.Fatal("accepted device not registered")
+			}
+			if handles := device.canHandle(tt.job); handles != tt.handles {
+				t.Errorf("canHandle = %v, want %v", handles, tt.handles)
+			}
+		})
+	}
+}
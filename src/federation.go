@@ -0,0 +1,194 @@
+package tango
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// routedHeader marks a request a federation member has already routed to another member.
+const routedHeader = "tango-routed-by"
+
+// federation partitions jobs across several coordinators by job ID.
+// Each job is owned by exactly one member, chosen by rendezvous hashing of the job ID, so every member
+// can compute the owner on its own and adding a member only moves the jobs it now owns.
+type federation struct {
+	self  FederationNode   // This coordinator.
+	nodes []FederationNode // All members, this coordinator included.
+	conns peerConns        // Connections to the other members.
+	next  atomic.Uint32    // Rotates the member FetchTask asks first, spreading devices across members.
+
+	mirroredMu sync.Mutex
+	mirrored   map[string]map[string]bool // Device IDs registered with each member, keyed by node ID.
+}
+
+// newFederation returns the federation described by the configuration, or nil when federation is disabled.
+func newFederation(cfg FederationConfig) (*federation, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	f := &federation{nodes: cfg.Nodes, mirrored: make(map[string]map[string]bool)}
+	for _, node := range cfg.Nodes {
+		if node.NodeID == cfg.NodeID {
+			f.self = node
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("node %q is not among the configured federation nodes", cfg.NodeID)
+}
+
+// owner returns the member that owns the given job: the one with the highest hash of its node ID and the job ID.
+func (f *federation) owner(jobID string) FederationNode {
+	var owner FederationNode
+	var best uint64
+	for i, node := range f.nodes {
+		h := fnv.New64a()
+		h.Write([]byte(node.NodeID))
+		h.Write([]byte{0})
+		h.Write([]byte(jobID))
+		if score := mix64(h.Sum64()); i == 0 || score > best {
+			owner, best = node, score
+		}
+	}
+	return owner
+}
+
+// mix64 scrambles the bits of a hash, so that scores of IDs differing in a single byte are uncorrelated.
+// It is the finalizer of the SplitMix64 generator.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// peers returns the other members, starting from a different one on every call.
+func (f *federation) peers() []FederationNode {
+	start := int(f.next.Add(1))
+	peers := make([]FederationNode, 0, len(f.nodes)-1)
+	for i := range f.nodes {
+		node := f.nodes[(start+i)%len(f.nodes)]
+		if node.NodeID != f.self.NodeID {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
+
+// mirrorDevice registers the device with a member under its existing device ID, unless already done,
+// so the member can match its shards against the device's capabilities.
+func (f *federation) mirrorDevice(ctx context.Context, node FederationNode, device *Device) error {
+	f.mirroredMu.Lock()
+	known := f.mirrored[node.NodeID][device.DeviceID]
+	f.mirroredMu.Unlock()
+	if known {
+		return nil
+	}
+	req := &pb.DeviceRegistration{
+		Operations:     setToSlice(device.Operations),
+		Dtypes:         setToSlice(device.DTypes),
+		MemoryBytes:    device.MemoryBytes,
+		FlopsPerSecond: device.FlopsPerSecond,
+		MaxShardBytes:  device.MaxShardBytes,
+		DeviceId:       &device.DeviceID,
+	}
+	reply, err := f.conns.forwardCall(ctx, node.RPCAddress, pb.TangoService_RegisterDevice_FullMethodName, req, routedHeader, f.self.NodeID)
+	if err != nil {
+		return err
+	}
+	if r := reply.(*pb.DeviceRegistrationReply); !r.Accepted {
+		return fmt.Errorf("registration refused: %s", r.Message)
+	}
+	f.mirroredMu.Lock()
+	if f.mirrored[node.NodeID] == nil {
+		f.mirrored[node.NodeID] = make(map[string]bool)
+	}
+	f.mirrored[node.NodeID][device.DeviceID] = true
+	f.mirroredMu.Unlock()
+	return nil
+}
+
+// fetchFromPeers asks the other members for a task for the device, one at a time,
+// and returns the first assignment offered.
+func (f *federation) fetchFromPeers(ctx context.Context, device *Device) (*pb.TaskAssignment, error) {
+	req := &pb.DeviceRequest{DeviceId: device.DeviceID}
+	for _, node := range f.peers() {
+		if err := f.mirrorDevice(ctx, node, device); err != nil {
+			log.Printf("Failed to register device %s with federation member %s: %v", device.DeviceID, node.NodeID, err)
+			continue
+		}
+		reply, err := f.conns.forwardCall(ctx, node.RPCAddress, pb.TangoService_FetchTask_FullMethodName, req, routedHeader, f.self.NodeID)
+		if err != nil {
+			continue
+		}
+		return reply.(*pb.TaskAssignment), nil
+	}
+	return nil, fmt.Errorf("no available tasks")
+}
+
+// revoke forwards the revocation to every other member, as each keeps its own deny list. Members that cannot be reached
+// or refuse it are named in an Unavailable error; sending the revocation again is harmless to the members that applied it.
+func (f *federation) revoke(ctx context.Context, req *pb.RevocationRequest) error {
+	var failed []string
+	for _, node := range f.peers() {
+		reply, err := f.conns.forwardCall(ctx, node.RPCAddress, pb.TangoService_RevokeToken_FullMethodName, req, routedHeader, f.self.NodeID)
+		if err == nil && !reply.(*pb.RevocationReply).Accepted {
+			err = fmt.Errorf("%s", reply.(*pb.RevocationReply).Message)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", node.NodeID, err))
+		}
+	}
+	if len(failed) > 0 {
+		return status.Errorf(codes.Unavailable, "revocation not applied by federation members %s, send it again", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// setToSlice returns the members of a set.
+func setToSlice(set map[string]bool) []string {
+	values := make([]string, 0, len(set))
+	for v := range set {
+		values = append(values, v)
+	}
+	return values
+}
+
+// jobScoped is implemented by requests that concern a single job.
+type jobScoped interface {
+	GetJobId() string
+}
+
+// RouteToOwner is a gRPC unary interceptor that lets any member of a federation accept requests for any job.
+// Requests naming a job (SubmitTask, ReportResult and GetJobStatus) are served by the member owning that job;
+// other members forward them, token included, and relay the owner's reply. Requests that were already routed
+// once are always served locally. Outside of federation mode, every request is served locally.
+func (s *server) RouteToOwner(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	scoped, ok := req.(jobScoped)
+	if s.federation == nil || !ok || hasHeader(ctx, routedHeader) || !strings.HasPrefix(info.FullMethod, "/"+pb.TangoService_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	owner := s.federation.owner(scoped.GetJobId())
+	if owner.NodeID == s.federation.self.NodeID {
+		return handler(ctx, req)
+	}
+	reply, err := s.federation.conns.forwardCall(ctx, owner.RPCAddress, info.FullMethod, req, routedHeader, s.federation.self.NodeID)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Unavailable, "failed to reach federation member %s: %v", owner.NodeID, err)
+	}
+	return reply, nil
+}
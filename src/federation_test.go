@@ -0,0 +1,111 @@
+package tango
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestFederationOwner checks that every member computes the same owner for a job, that jobs are spread
+// across members, and that adding a member only moves jobs to the new member.
+func TestFederationOwner(t *testing.T) {
+	nodes := []FederationNode{{NodeID: "a"}, {NodeID: "b"}, {NodeID: "c"}}
+	members := make([]*federation, len(nodes))
+	for i, node := range nodes {
+		members[i] = &federation{self: node, nodes: nodes}
+	}
+	grown := &federation{self: nodes[0], nodes: append(append([]FederationNode{}, nodes...), FederationNode{NodeID: "d"})}
+
+	const jobs = 3000
+	owned := make(map[string]int)
+	for i := range jobs {
+		jobID := fmt.Sprintf("job-%d", i)
+		owner := members[0].owner(jobID)
+		for _, member := range members[1:] {
+			if other := member.owner(jobID); other != owner {
+				t.Fatalf("%s owns %s according to %s, but %s according to %s", owner.NodeID, jobID, members[0].self.NodeID, other.NodeID, member.self.NodeID)
+			}
+		}
+		owned[owner.NodeID]++
+		if moved := grown.owner(jobID); moved != owner && moved.NodeID != "d" {
+			t.Errorf("adding d moved %s from %s to %s", jobID, owner.NodeID, moved.NodeID)
+		}
+	}
+	for _, node := range nodes {
+		if share := float64(owned[node.NodeID]) / jobs; share < 0.25 || share > 0.42 {
+			t.Errorf("%s owns %.0f%% of the jobs, want about a third", node.NodeID, 100*share)
+		}
+	}
+}
+
+// TestRouteToOwner checks that requests naming a job owned by another member are forwarded to it, signed
+// as coming from a coordinator, and that requests for local jobs, requests already routed once and requests
+// naming no job are served locally.
+func TestRouteToOwner(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		var req pb.TaskRequest
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		ctx := stripPeerHeaders(stream.Context(), method, &req)
+		if !peerFromContext(ctx) || !hasHeader(ctx, routedHeader) || !hasHeader(ctx, tokenHeader) {
+			return status.Error(codes.PermissionDenied, "not forwarded by a coordinator")
+		}
+		return stream.SendMsg(&pb.TaskResponse{Accepted: true, Message: "served by b"})
+	}))
+	go member.Serve(lis)
+	defer member.Stop()
+
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	s.federation = &federation{self: FederationNode{NodeID: "a"}, nodes: []FederationNode{{NodeID: "a"}, {NodeID: "b", RPCAddress: lis.Addr().String()}}}
+	defer s.federation.conns.close()
+	jobOf := func(nodeID string) string {
+		for i := 0; ; i++ {
+			if jobID := fmt.Sprintf("job-%d", i); s.federation.owner(jobID).NodeID == nodeID {
+				return jobID
+			}
+		}
+	}
+
+	incoming := metadata.NewIncomingContext(context.Background(), metadata.Pairs(tokenHeader, "token"))
+	routed := metadata.NewIncomingContext(context.Background(), metadata.Pairs(tokenHeader, "token", routedHeader, "b"))
+	info := &grpc.UnaryServerInfo{FullMethod: pb.TangoService_SubmitTask_FullMethodName}
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		req    any
+		served string
+	}{
+		{"owned by another member", incoming, &pb.TaskRequest{JobId: jobOf("b")}, "served by b"},
+		{"owned locally", incoming, &pb.TaskRequest{JobId: jobOf("a")}, "served by a"},
+		{"already routed", routed, &pb.TaskRequest{JobId: jobOf("b")}, "served by a"},
+		{"naming no job", incoming, &pb.DeviceRequest{DeviceId: "device"}, "served by a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := s.RouteToOwner(tt.ctx, tt.req, info, func(context.Context, any) (any, error) {
+				return &pb.TaskResponse{Accepted: true, Message: "served by a"}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := reply.(*pb.TaskResponse).Message; got != tt.served {
+				t.Errorf("request %s, want %s", got, tt.served)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package tango
+
+import (
+	"expvar"
+	"log"
+)
+
+// flopsAnomalyTolerance is the relative difference between the FLOPs a device reports for a shard
+// and those the coordinator computes for it beyond which the report is flagged as anomalous.
+const flopsAnomalyTolerance = 0.1
+
+// flopsAnomalies counts the shard results whose reported FLOPs were anomalous, keyed by device.
+var flopsAnomalies = expvar.NewMap("tango_flops_anomalies")
+
+// operationFlops returns the FLOPs needed to compute a rows×cols block of the operation's result
+// over a shared dimension of d. A multiply-add counts as two FLOPs; scaling the result costs one more per element.
+func operationFlops(operation string, rows, cols, d int64) int64 {
+	flops := 2 * rows * cols * d
+	if operation == "scaled_matmul" {
+		flops += rows * cols
+	}
+	return flops
+}
+
+// estimatedFlops returns the FLOPs needed to compute the job, based on its dimensions.
+func (j *Job) estimatedFlops() int64 {
+	return operationFlops(j.Operation, int64(j.m), int64(j.n), int64(j.d))
+}
+
+// shardFlops returns the canonical FLOPs of the shard, computed from its shape and the job's operation,
+// as cut by prepareTaskAssignment. Devices are billed for these, never for the FLOPs they report.
+func (j *Job) shardFlops(index int) int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var rows, cols int
+	if j.Adaptive {
+		band, cut := j.Bands[index]
+		if !cut {
+			return 0
+		}
+		rows, cols = band.End-band.Start, int(j.n)
+	} else {
+		if j.RowSplits <= 0 || j.ColSplits <= 0 {
+			return 0
+		}
+		rowBlock := (index - 1) / int(j.ColSplits)
+		colBlock := (index - 1) % int(j.ColSplits)
+		startRow, endRow := blockBounds(int(j.m), int(j.RowSplits), rowBlock)
+		startCol, endCol := blockBounds(int(j.n), int(j.ColSplits), colBlock)
+		rows, cols = endRow-startRow, endCol-startCol
+	}
+	return operationFlops(j.Operation, int64(rows), int64(cols), int64(j.d))
+}
+
+// checkReportedFlops reports whether the FLOPs a device reported for a shard stray from the canonical count
+// by more than flopsAnomalyTolerance, counting and logging the anomaly if so. Devices that report nothing are not flagged.
+func checkReportedFlops(deviceID, taskID string, reported, canonical int64) bool {
+	if reported == 0 {
+		return false
+	}
+	diff := reported - canonical
+	if diff < 0 {
+		diff = -diff
+	}
+	if float64(diff) <= flopsAnomalyTolerance*float64(canonical) {
+		return false
+	}
+	flopsAnomalies.Add(deviceID, 1)
+	log.Printf("Device %s reported %d FLOPs for task %s, expected %d", deviceID, reported, taskID, canonical)
+	return true
+}
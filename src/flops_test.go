@@ -0,0 +1,82 @@
+package tango
+
+import (
+	"expvar"
+	"testing"
+)
+
+// TestShardFlops checks the canonical FLOPs of fixed grid shards, including uneven blocks, and of adaptive bands.
+func TestShardFlops(t *testing.T) {
+	// A 5×3 result over d = 4 in a 2×2 grid has blocks of 3 or 2 rows and 2 or 1 columns.
+	grid := func(operation string) *Job {
+		return &Job{Operation: operation, m: 5, n: 3, d: 4, RowSplits: 2, ColSplits: 2}
+	}
+	adaptive := &Job{Operation: "matmul", m: 5, n: 3, d: 4, Adaptive: true, Bands: map[int]RowBand{1: {Start: 2, End: 5}}}
+	tests := []struct {
+		name  string
+		job   *Job
+		index int
+		want  int64
+	}{
+		{"first block", grid("matmul"), 1, 2 * 3 * 2 * 4},
+		{"narrow block", grid("matmul"), 2, 2 * 3 * 1 * 4},
+		{"short block", grid("matmul"), 3, 2 * 2 * 2 * 4},
+		{"last block", grid("matmul"), 4, 2 * 2 * 1 * 4},
+		{"scaled", grid("scaled_matmul"), 1, 2*3*2*4 + 3*2},
+		{"band", adaptive, 1, 2 * 3 * 3 * 4},
+		{"band not cut", adaptive, 2, 0},
+		{"no grid", &Job{Operation: "matmul", m: 5, n: 3, d: 4}, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.job.shardFlops(tt.index); got != tt.want {
+				t.Errorf("shardFlops(%d) = %d, want %d", tt.index, got, tt.want)
+			}
+		})
+	}
+
+	job := grid("matmul")
+	var total int64
+	for index := 1; index <= 4; index++ {
+		total += job.shardFlops(index)
+	}
+	if total != job.estimatedFlops() {
+		t.Errorf("shards add up to %d FLOPs, want the job's %d", total, job.estimatedFlops())
+	}
+}
+
+// TestCheckReportedFlops checks that reports straying from the canonical FLOPs by more than the tolerance
+// are flagged and counted for the device, and that devices reporting nothing are not.
+func TestCheckReportedFlops(t *testing.T) {
+	tests := []struct {
+		name     string
+		reported int64
+		anomaly  bool
+	}{
+		{"not reported", 0, false},
+		{"exact", 1000, false},
+		{"within tolerance above", 1100, false},
+		{"within tolerance below", 900, false},
+		{"over", 1101, true},
+		{"under", 899, true},
+		{"inflated", 1000000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deviceID := "flops-" + tt.name
+			counted := func() int64 {
+				if v, ok := flopsAnomalies.Get(deviceID).(*expvar.Int); ok {
+					return v.Value()
+				}
+				return 0
+			}
+			before := counted()
+			if got := checkReportedFlops(deviceID, "job_1", tt.reported, 1000); got != tt.anomaly {
+				t.Errorf("checkReportedFlops(%d) = %v, want %v", tt.reported, got, tt.anomaly)
+			}
+			if got, want := counted()-before, map[bool]int64{true: 1}[tt.anomaly]; got != want {
+				t.Errorf("counted %d anomalies for the device, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package tango
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	pb "tango/tango/src/protobuff"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tokenUseRefresh marks refresh tokens, which only RefreshToken accepts.
+const tokenUseRefresh = "refresh"
+
+// publicMethods are the RPCs callable without a token, since they are how callers obtain one.
+var publicMethods = map[string]bool{
+	pb.TangoService_IssueToken_FullMethodName:   true,
+	pb.TangoService_RefreshToken_FullMethodName: true,
+}
+
+// activeSigner signs the tokens Tango issues, or is nil when they are signed with the HS256 JWT secret.
+var activeSigner atomic.Pointer[signer]
+
+// signer is a private key issued tokens are signed with, along with the algorithm and key ID they carry.
+type signer struct {
+	alg    string
+	kid    string
+	key    crypto.Signer
+	public verificationKey // Verifies the tokens this signer issued.
+}
+
+// LoadSigningKey loads the PEM private key configured under tokens.signing_key, so issued tokens are signed
+// with RS256 (RSA), ES256 (P-256) or EdDSA (Ed25519). Tokens signed with it are verified with its public key,
+// besides the keys of the JWKS. It does nothing when no signing key is configured.
+func LoadSigningKey() error {
+	path := AppConfig.Tokens.SigningKey
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read signing key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no PEM block found in %s", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid signing key: %v", err)
+	}
+	sg := &signer{kid: AppConfig.Tokens.SigningKeyID}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sg.alg, sg.key = "RS256", k
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return errors.New("EC signing keys must use P-256")
+		}
+		sg.alg, sg.key = "ES256", k
+	case ed25519.PrivateKey:
+		sg.alg, sg.key = "EdDSA", k
+	default:
+		return fmt.Errorf("unsupported signing key type %T", key)
+	}
+	sg.public = verificationKey{alg: sg.alg, key: sg.key.Public()}
+	activeSigner.Store(sg)
+	return nil
+}
+
+// sign returns the signature of a token with the signer's key, encoded as JWS expects.
+func (sg *signer) sign(signingInput string) ([]byte, error) {
+	if sg.alg == "EdDSA" {
+		return sg.key.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	if sg.alg == "RS256" {
+		return sg.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, sg.key.(*ecdsa.PrivateKey), digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature, nil
+}
+
+// signToken encodes and signs the claims with the configured signing key, or with the HS256 JWT secret.
+func signToken(claims *Claims) (string, error) {
+	header := joseHeader{Alg: "HS256"}
+	sg := activeSigner.Load()
+	if sg != nil {
+		header = joseHeader{Alg: sg.alg, Kid: sg.kid}
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	var signature []byte
+	if sg != nil {
+		if signature, err = sg.sign(signingInput); err != nil {
+			return "", err
+		}
+	} else {
+		secret, err := getTangoJWTSecret()
+		if err != nil || secret == "" {
+			return "", fmt.Errorf("no JWT secret to sign with: %v", err)
+		}
+		signature = generateHmacSha256Signature(signingInput, secret)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// newTokenID returns a random token ID for the jti claim.
+func newTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// matchAPIKey returns the configured API key whose digest matches the presented key.
+func matchAPIKey(presented string) (*APIKey, bool) {
+	sum := sha256.Sum256([]byte(presented))
+	digest := []byte(hex.EncodeToString(sum[:]))
+	for i := range AppConfig.Tokens.APIKeys {
+		key := &AppConfig.Tokens.APIKeys[i]
+		if subtle.ConstantTimeCompare(digest, []byte(strings.ToLower(key.SHA256))) == 1 {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// apiKeyNamed returns the configured API key with the given name.
+func apiKeyNamed(name string) (*APIKey, bool) {
+	for i := range AppConfig.Tokens.APIKeys {
+		if AppConfig.Tokens.APIKeys[i].Name == name {
+			return &AppConfig.Tokens.APIKeys[i], true
+		}
+	}
+	return nil, false
+}
+
+// scopeRoles returns the requested roles, or every granted role when none is requested.
+// It reports false if a requested role is not granted.
+func scopeRoles(requested, granted []string) ([]string, bool) {
+	if len(requested) == 0 {
+		return granted, true
+	}
+	for _, role := range requested {
+		if !slices.Contains(granted, role) {
+			return nil, false
+		}
+	}
+	return requested, true
+}
+
+// findDevice returns the registered device with the given ID. Devices are looked up in the store as well,
+// since followers of a cluster do not load them until promoted.
+func (s *server) findDevice(deviceID string) (*Device, bool) {
+	if device, exists := s.lookupDevice(deviceID); exists {
+		return device, true
+	}
+	for _, device := range s.store.Devices() {
+		if device.DeviceID == deviceID {
+			return device, true
+		}
+	}
+	return nil, false
+}
+
+// keyClaims returns the claims of tokens issued for the API key with the given roles.
+func keyClaims(key *APIKey, roles []string) Claims {
+	return Claims{
+		Subject:     key.Name,
+		ConsumerID:  key.ConsumerID,
+		MaxPriority: key.MaxPriority,
+		Roles:       roles,
+		APIKey:      true,
+	}
+}
+
+// deviceClaims returns the claims of the tokens of a device registered by the caller: tokens bound to the device
+// that only grant the device role, issued for the caller's API key if it used one.
+func deviceClaims(ctx context.Context, deviceID string) Claims {
+	claims := Claims{Subject: subjectFromContext(ctx), ConsumerID: consumerIDFromContext(ctx), Roles: []string{roleDevice}}
+	if key, found := apiKeyNamed(claims.Subject); found {
+		claims = keyClaims(key, claims.Roles)
+	}
+	claims.DeviceID = deviceID
+	return claims
+}
+
+// issueTokens signs an access token and a refresh token with the given subject, consumer, device binding,
+// priority limit and roles, setting their issuer, audience, lifetimes and token IDs.
+func issueTokens(claims Claims) (*pb.TokenReply, error) {
+	now := time.Now()
+	accessTTL := time.Duration(AppConfig.Tokens.AccessTTLSeconds) * time.Second
+	refreshTTL := time.Duration(AppConfig.Tokens.RefreshTTLSeconds) * time.Second
+	if accessTTL <= 0 || refreshTTL <= 0 {
+		return nil, status.Error(codes.FailedPrecondition, "token lifetimes are not configured")
+	}
+
+	claims.Issuer = AppConfig.Tokens.Issuer
+	claims.IssuedAt = float64(now.Unix())
+	if AppConfig.Tokens.Audience != "" {
+		claims.Audience = audience{AppConfig.Tokens.Audience}
+	}
+	access, refresh := claims, claims
+	access.ExpiresAt = float64(now.Add(accessTTL).Unix())
+	refresh.ExpiresAt = float64(now.Add(refreshTTL).Unix())
+	refresh.TokenUse = tokenUseRefresh
+
+	reply := &pb.TokenReply{Accepted: true, Message: "Token issued.", ExpiresAt: int64(access.ExpiresAt), RefreshExpiresAt: int64(refresh.ExpiresAt)}
+	for _, t := range []struct {
+		claims *Claims
+		token  *string
+	}{{&access, &reply.AccessToken}, {&refresh, &reply.RefreshToken}} {
+		id, err := newTokenID()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate token id: %w", err)
+		}
+		t.claims.ID = id
+		signed, err := signToken(t.claims)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to sign token: %v", err)
+		}
+		*t.token = signed
+	}
+	return reply, nil
+}
+
+// IssueToken exchanges a long-lived API key or device registration secret for a short-lived access token,
+// along with a refresh token to renew it. The tokens grant the requested roles, or every role of the key
+// when none is requested. They are never bound to a device: RegisterDevice issues the tokens of the device it registers.
+func (s *server) IssueToken(ctx context.Context, req *pb.TokenRequest) (*pb.TokenReply, error) {
+	key, found := matchAPIKey(req.ApiKey)
+	if !found {
+		return &pb.TokenReply{
+			Accepted: false,
+			Message:  "Invalid API key.",
+		}, nil
+	}
+	if revocations.revoked(revokeSubject, key.Name) {
+		return &pb.TokenReply{
+			Accepted: false,
+			Message:  "API key has been revoked.",
+		}, nil
+	}
+	roles, ok := scopeRoles(req.Roles, key.Roles)
+	if !ok {
+		return &pb.TokenReply{
+			Accepted: false,
+			Message:  "Requested roles exceed those of the API key.",
+		}, nil
+	}
+	return issueTokens(keyClaims(key, roles))
+}
+
+// RefreshToken exchanges a refresh token for a new access token and refresh token with the same scope,
+// so long-running devices never need their registration secret again. The API key the refresh token
+// was issued for must still be configured, and its roles still granted. The device tokens RegisterDevice issued
+// to callers authenticated otherwise than with an API key are renewed as they are. Refresh tokens are single use:
+// the one exchanged is revoked by its jti before the new tokens are issued, so a stolen refresh token
+// stops working once either party has used it.
+func (s *server) RefreshToken(ctx context.Context, req *pb.RefreshRequest) (*pb.TokenReply, error) {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	JWTSecrets, secretErr := jwtVerificationSecrets()
+	claims, err := ValidateJWT(req.RefreshToken, JWTSecrets...)
+	if errors.Is(err, errNoJWTSecret) {
+		return nil, status.Errorf(codes.Unavailable, "cannot verify HS256 tokens: %v", secretErr)
+	}
+	if err == nil && claims.TokenUse != tokenUseRefresh {
+		err = errors.New("not a refresh token")
+	}
+	if err == nil && claims.ID == "" {
+		err = errors.New("refresh token carries no jti")
+	}
+	if err == nil {
+		err = revocations.check(claims)
+	}
+	if err != nil {
+		return &pb.TokenReply{
+			Accepted: false,
+			Message:  fmt.Sprintf("Invalid refresh token: %v.", err),
+		}, nil
+	}
+	renewed := Claims{Subject: claims.Subject, ConsumerID: claims.ConsumerID, DeviceID: claims.DeviceID, Roles: []string{roleDevice}}
+	if key, found := apiKeyNamed(claims.Subject); found {
+		roles, ok := scopeRoles(claims.Roles, key.Roles)
+		if !ok {
+			return &pb.TokenReply{
+				Accepted: false,
+				Message:  "The roles of this refresh token are no longer granted.",
+			}, nil
+		}
+		renewed = keyClaims(key, roles)
+		renewed.DeviceID = claims.DeviceID
+	} else if claims.APIKey || claims.DeviceID == "" {
+		return &pb.TokenReply{
+			Accepted: false,
+			Message:  "The API key of this refresh token is no longer valid.",
+		}, nil
+	}
+	used := revocation{Kind: revokeJTI, Value: claims.ID, Reason: "refresh token used", RevokedAt: time.Now().UnixNano(), ExpiresAt: int64(claims.ExpiresAt)}
+	if err := s.revoke(used, false); err != nil {
+		return nil, err
+	}
+	return issueTokens(renewed)
+}
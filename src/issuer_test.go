@@ -0,0 +1,241 @@
+package tango
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// withAPIKey configures a single API key for the duration of the test.
+func withAPIKey(t *testing.T, key APIKey, secret string) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(secret))
+	key.SHA256 = hex.EncodeToString(sum[:])
+	saved := AppConfig.Tokens.APIKeys
+	AppConfig.Tokens.APIKeys = []APIKey{key}
+	t.Cleanup(func() { AppConfig.Tokens.APIKeys = saved })
+}
+
+// authenticated returns the context of a request authenticated with the access token.
+func authenticated(t *testing.T, token string) context.Context {
+	t.Helper()
+	ctx, err := authenticate(metadata.NewIncomingContext(context.Background(), metadata.Pairs(tokenHeader, token)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// validClaims returns the claims of a token issued by the server.
+func validClaims(t *testing.T, token string) *Claims {
+	t.Helper()
+	secrets, err := jwtVerificationSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ValidateJWT(token, secrets...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+// TestRegisterDeviceIssuesBoundTokens checks that registering a device returns device tokens bound to it,
+// that refreshing them keeps the binding, and that they stop being renewed once their API key is removed.
+func TestRegisterDeviceIssuesBoundTokens(t *testing.T) {
+	withAPIKey(t, APIKey{Name: "registration", Roles: []string{roleDevice, roleConsumer}}, "registration-secret")
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+
+	issued, err := s.IssueToken(context.Background(), &pb.TokenRequest{ApiKey: "registration-secret"})
+	if err != nil || !issued.Accepted {
+		t.Fatalf("IssueToken: %v %v", issued, err)
+	}
+	if claims := validClaims(t, issued.AccessToken); claims.DeviceID != "" {
+		t.Fatalf("IssueToken bound its token to device %s", claims.DeviceID)
+	}
+	reg, err := s.RegisterDevice(authenticated(t, issued.AccessToken), &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9})
+	if err != nil || !reg.Accepted || reg.Tokens == nil {
+		t.Fatalf("RegisterDevice: %v %v", reg, err)
+	}
+	claims := validClaims(t, reg.Tokens.AccessToken)
+	if claims.DeviceID != reg.DeviceId || claims.Subject != "registration" || len(claims.Roles) != 1 || claims.Roles[0] != roleDevice {
+		t.Fatalf("device token claims = %+v, want a device token of registration bound to %s", claims, reg.DeviceId)
+	}
+
+	refreshed, err := s.RefreshToken(context.Background(), &pb.RefreshRequest{RefreshToken: reg.Tokens.RefreshToken})
+	if err != nil || !refreshed.Accepted {
+		t.Fatalf("RefreshToken: %v %v", refreshed, err)
+	}
+	if claims := validClaims(t, refreshed.AccessToken); claims.DeviceID != reg.DeviceId {
+		t.Fatalf("refreshed token is bound to %q, want %s", claims.DeviceID, reg.DeviceId)
+	}
+
+	AppConfig.Tokens.APIKeys = nil
+	if r, err := s.RefreshToken(context.Background(), &pb.RefreshRequest{RefreshToken: refreshed.RefreshToken}); err != nil || r.Accepted {
+		t.Fatalf("RefreshToken after the API key was removed: %v %v", r, err)
+	}
+}
+
+// TestRefreshTokenSingleUse checks that a refresh token is revoked once exchanged, so replaying it fails,
+// while the refresh token issued in exchange still works.
+func TestRefreshTokenSingleUse(t *testing.T) {
+	withAPIKey(t, APIKey{Name: "consumer", ConsumerID: "consumer", Roles: []string{roleConsumer}}, "consumer-secret")
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+
+	issued, err := s.IssueToken(context.Background(), &pb.TokenRequest{ApiKey: "consumer-secret"})
+	if err != nil || !issued.Accepted {
+		t.Fatalf("IssueToken: %v %v", issued, err)
+	}
+	refreshed, err := s.RefreshToken(context.Background(), &pb.RefreshRequest{RefreshToken: issued.RefreshToken})
+	if err != nil || !refreshed.Accepted {
+		t.Fatalf("RefreshToken: %v %v", refreshed, err)
+	}
+	if r, err := s.RefreshToken(context.Background(), &pb.RefreshRequest{RefreshToken: issued.RefreshToken}); err != nil || r.Accepted {
+		t.Fatalf("RefreshToken replayed: %v %v, want it refused", r, err)
+	}
+	if r, err := s.RefreshToken(context.Background(), &pb.RefreshRequest{RefreshToken: refreshed.RefreshToken}); err != nil || !r.Accepted {
+		t.Fatalf("RefreshToken with the new refresh token: %v %v", r, err)
+	}
+	used := validClaims(t, issued.RefreshToken)
+	found := false
+	for _, r := range revocations.list() {
+		if r.Kind == revokeJTI && r.Value == used.ID {
+			found = true
+			if r.ExpiresAt != int64(used.ExpiresAt) {
+				t.Errorf("revocation of the used refresh token expires at %d, want %d", r.ExpiresAt, int64(used.ExpiresAt))
+			}
+		}
+	}
+	if !found {
+		t.Error("the used refresh token is not on the deny list")
+	}
+}
+
+// TestDenyListPrunesExpiredRevocations checks that revocations of expired tokens are dropped from the deny list.
+func TestDenyListPrunesExpiredRevocations(t *testing.T) {
+	dl := &denyList{entries: make(map[string]revocation)}
+	expired := revocation{Kind: revokeJTI, Value: "expired", ExpiresAt: time.Now().Add(-time.Hour).Unix()}
+	if err := dl.update(expired, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := dl.update(revocation{Kind: revokeSubject, Value: "subject"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if dl.revoked(revokeJTI, "expired") || !dl.revoked(revokeSubject, "subject") {
+		t.Errorf("deny list = %+v, want only the subject's revocation", dl.list())
+	}
+}
+
+// withDenyList restores the deny list as it was once the test is over.
+func withDenyList(t *testing.T) {
+	t.Helper()
+	saved := revocations.list()
+	t.Cleanup(func() {
+		if err := revocations.replace(saved); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestRevokeTokenExpiry checks that revocations of token IDs expire once any token they name has,
+// as bounded by the maximum token lifetime or the refresh token lifetime, and are kept for good without a cap.
+func TestRevokeTokenExpiry(t *testing.T) {
+	saved := AppConfig.Tokens
+	t.Cleanup(func() { AppConfig.Tokens = saved })
+	withDenyList(t)
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	ctx := testContext("admin", "")
+	tests := []struct {
+		name        string
+		kind        string
+		maxLifetime int
+		refreshTTL  int
+		lifetime    int64 // Seconds after the revocation it expires, or 0 when kept for good.
+	}{
+		{"jti", revokeJTI, 3600, 600, 3600},
+		{"jti of a refresh token", revokeJTI, 3600, 86400, 86400},
+		{"jti without a cap", revokeJTI, 0, 86400, 0},
+		{"subject", revokeSubject, 3600, 600, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AppConfig.Tokens.MaxLifetimeSeconds, AppConfig.Tokens.RefreshTTLSeconds = tt.maxLifetime, tt.refreshTTL
+			value := "expiry " + tt.name
+			before := time.Now().Unix()
+			if _, err := s.RevokeToken(ctx, &pb.RevocationRequest{Kind: tt.kind, Value: value}); err != nil {
+				t.Fatal(err)
+			}
+			after := time.Now().Unix()
+			for _, r := range revocations.list() {
+				if r.Value != value {
+					continue
+				}
+				if tt.lifetime == 0 && r.ExpiresAt != 0 || tt.lifetime != 0 && (r.ExpiresAt < before+tt.lifetime || r.ExpiresAt > after+tt.lifetime) {
+					t.Errorf("revocation expires at %d, want %d seconds after %d", r.ExpiresAt, tt.lifetime, before)
+				}
+				return
+			}
+			t.Error("revocation not on the deny list")
+		})
+	}
+}
+
+// TestRevokeTokenInFederation checks that a revocation is forwarded to every other federation member, but not
+// forwarded again by the members receiving it, and that members failing to apply it fail the revocation.
+func TestRevokeTokenInFederation(t *testing.T) {
+	withDenyList(t)
+	var forwarded atomic.Int32
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		var req pb.RevocationRequest
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		if method != pb.TangoService_RevokeToken_FullMethodName || req.Value != "mallory" || !hasHeader(stream.Context(), routedHeader) {
+			return status.Errorf(codes.InvalidArgument, "unexpected %s of %q", method, req.Value)
+		}
+		forwarded.Add(1)
+		return stream.SendMsg(&pb.RevocationReply{Accepted: true})
+	}))
+	go member.Serve(lis)
+	defer member.Stop()
+
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	s.federation = &federation{self: FederationNode{NodeID: "a"}, nodes: []FederationNode{{NodeID: "a"}, {NodeID: "b", RPCAddress: lis.Addr().String()}}}
+	defer s.federation.conns.close()
+	req := &pb.RevocationRequest{Kind: revokeSubject, Value: "mallory"}
+	if _, err := s.RevokeToken(testContext("admin", ""), req); err != nil {
+		t.Fatal(err)
+	}
+	routed := metadata.NewIncomingContext(testContext("admin", ""), metadata.Pairs(routedHeader, "b"))
+	if _, err := s.RevokeToken(routed, req); err != nil {
+		t.Fatal(err)
+	}
+	if got := forwarded.Load(); got != 1 {
+		t.Errorf("revocation forwarded %d times, want once", got)
+	}
+
+	s.federation.nodes = append(s.federation.nodes, FederationNode{NodeID: "c", RPCAddress: lis.Addr().String()})
+	if _, err := s.RevokeToken(testContext("admin", ""), &pb.RevocationRequest{Kind: revokeSubject, Value: "eve"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("revocation refused by members: %v, want Unavailable", err)
+	}
+}
@@ -2,6 +2,7 @@ package tango
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	pb "tango/tango/src/protobuff"
 )
@@ -11,15 +12,24 @@ import (
 // including input data, expected processing splits, results, and synchronization primitives.
 type Job struct {
 	JobID           string               // Unique identifier for the job.
+	ConsumerID      string               // Consumer that submitted the job, taken from its JWT.
+	Priority        int32                // Scheduling priority requested by the consumer; higher runs first.
+	SubmittedAt     int64                // Unix timestamp (nanoseconds) of the submission.
 	Operation       string               // The operation to be performed (e.g., "scaled_matmul").
+	DType           string               // Element type of the matrices (e.g., "float32").
 	AData           []byte               // Serialized data for matrix A.
 	BData           []byte               // Serialized data for matrix B.
+	InputBytes      int64                // Size of the serialized inputs as submitted.
 	m               int32                // Number of rows in matrix A.
 	n               int32                // Number of columns in matrix B.
 	d               int32                // Shared dimension for matrices A and B.
 	ExpectedSplits  int                  // Total number of expected splits/tasks.
 	RowSplits       int32                // Number of row splits.
 	ColSplits       int32                // Number of column splits.
+	Adaptive        bool                 // Whether shards are sized dynamically per device.
+	TargetShardMs   int32                // Target processing time of an adaptive shard, in milliseconds.
+	NextRow         int                  // First row of matrix A not yet cut into an adaptive band.
+	Bands           map[int]RowBand      // Adaptive row bands keyed by task index.
 	AssignedSplits  int                  // Number of splits assigned for processing.
 	ReceivedUpdates int                  // Number of task updates received.
 	Results         map[int][]byte       // Map storing partial results keyed by task index.
@@ -27,6 +37,9 @@ type Job struct {
 	ScaleBytes      []byte               // Serialized scale factor, if provided.
 	ScaleScalar     float32              // Numeric scale factor applied to the result.
 	PendingTasks    map[int]TimeDeadline // Map of pending tasks with their deadlines.
+	CompletedAt     int64                // Unix timestamp (nanoseconds) of the final result assembly, or 0.
+	inputsSpilled   bool                 // Whether AData and BData have been spilled to disk.
+	resultSpilled   bool                 // Whether FinalResult has been spilled to disk.
 	mu              sync.Mutex           // Mutex to protect concurrent access to the job.
 }
 
@@ -37,32 +50,84 @@ type TimeDeadline struct {
 	DeviceID string // Identifier of the device responsible for the task.
 }
 
+// RowBand describes a contiguous range of rows of matrix A cut for an adaptive shard.
+// Every adaptive shard spans all columns of matrix B.
+type RowBand struct {
+	Start int // First row of the band (inclusive).
+	End   int // Last row of the band (exclusive).
+}
+
+// requiredShardBytes estimates the size in bytes of the shard a device must be able to hold
+// to work on the job. For a fixed grid this is the job's largest shard; adaptive shards are
+// cut to fit each device, so only a single-row band is required.
+// Sizes account for the A rows, the B columns and the resulting C block, using the
+// dimensions of the submitted matrices.
+func (j *Job) requiredShardBytes() int64 {
+	if j.Adaptive {
+		return j.bandBytes(1)
+	}
+	if j.RowSplits <= 0 || j.ColSplits <= 0 {
+		return 0
+	}
+	rows := int64((j.m + j.RowSplits - 1) / j.RowSplits)
+	cols := int64((j.n + j.ColSplits - 1) / j.ColSplits)
+	d := int64(j.d)
+	return 4 * (rows*d + d*cols + rows*cols)
+}
+
+// bandBytes returns the size in bytes of an adaptive shard spanning the given number of rows.
+func (j *Job) bandBytes(rows int) int64 {
+	r, d, n := int64(rows), int64(j.d), int64(j.n)
+	return 4 * (r*d + d*n + r*n)
+}
+
+// isComplete reports whether every shard of the job has been received.
+// Adaptive jobs are complete once all rows have been cut and every band has a result.
+// The caller must hold j.mu.
+func (j *Job) isComplete() bool {
+	if j.CompletedAt != 0 {
+		return true
+	}
+	if j.Adaptive {
+		return j.NextRow >= int(j.m) && len(j.Results) == len(j.Bands)
+	}
+	return j.ReceivedUpdates >= j.ExpectedSplits
+}
+
 // GetJobStatus returns the current status of the job identified by req.JobId.
-// It locks the jobs map for thread-safe access, and checks whether the job exists.
+// It looks the job up in the job store and checks whether it exists.
 // If the job is not found, it assumes completion (possibly already aggregated).
-// If the number of received updates meets or exceeds the expected splits,
+// Jobs of other consumers are reported as not found, unless the caller is an admin.
+// If the job's final result has been assembled,
 // it returns a reply indicating that the job is complete, along with the final result.
 // Otherwise, it indicates that the job is still in progress.
+// Every reply carries the coordinator's current memory pressure.
 func (s *server) GetJobStatus(ctx context.Context, req *pb.JobStatusRequest) (*pb.JobStatusReply, error) {
-	s.jobsMu.Lock()
-	defer s.jobsMu.Unlock()
-
-	job, exists := s.jobs[req.JobId]
-	if !exists {
+	job, exists := s.store.Lookup(req.JobId)
+	if !exists || !canAccessJob(ctx, job) {
 		return &pb.JobStatusReply{
-			IsComplete: true,
-			Message:    "Job not found (possible completion).",
+			IsComplete:     true,
+			Message:        "Job not found (possible completion).",
+			MemoryPressure: s.memory.pressure(),
 		}, nil
 	}
-	if job.ReceivedUpdates >= job.ExpectedSplits {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.CompletedAt != 0 {
+		finalResult, err := job.finalResult()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load final result: %w", err)
+		}
 		return &pb.JobStatusReply{
-			IsComplete:  true,
-			Message:     "Job is complete.",
-			FinalResult: job.FinalResult,
+			IsComplete:     true,
+			Message:        "Job is complete.",
+			FinalResult:    finalResult,
+			MemoryPressure: s.memory.pressure(),
 		}, nil
 	}
 	return &pb.JobStatusReply{
-		IsComplete: false,
-		Message:    "Job is still in progress.",
+		IsComplete:     false,
+		Message:        "Job is still in progress.",
+		MemoryPressure: s.memory.pressure(),
 	}, nil
 }
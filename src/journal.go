@@ -0,0 +1,545 @@
+package tango
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Journal entry types recorded in the write-ahead log.
+const (
+	entryRegister = "register" // A device registered with the server.
+	entrySubmit   = "submit"   // A job was accepted.
+	entryAssign   = "assign"   // A shard was leased to a device.
+	entryResult   = "result"   // A shard result was received.
+	entryComplete = "complete" // A job's final result was assembled.
+	entryDelete   = "delete"   // A job was removed from the store.
+	entryRevoke   = "revoke"   // A token ID, subject or device was revoked, or its revocation lifted. Only replicated in cluster mode.
+)
+
+// journalFile is the name of the write-ahead log inside the configured store directory.
+const journalFile = "journal.log"
+
+// journalCompactMinBytes is the size the write-ahead log must reach before it is compacted while the store is open.
+// Past it, the log is compacted whenever it has doubled since it was last compacted.
+const journalCompactMinBytes = 64 << 20
+
+// journalEntry is a single record of the write-ahead log, serialized as one JSON line.
+// Only the fields relevant to the entry type are populated.
+type journalEntry struct {
+	Type       string       `json:"type"`
+	Job        *jobSnapshot `json:"job,omitempty"`
+	Device     *Device      `json:"device,omitempty"`
+	JobID      string       `json:"job_id,omitempty"`
+	Index      int          `json:"index,omitempty"`
+	DeviceID   string       `json:"device_id,omitempty"`
+	Deadline   int64        `json:"deadline,omitempty"`
+	Band       *RowBand     `json:"band,omitempty"`
+	Data       []byte       `json:"data,omitempty"`
+	Time       int64        `json:"time,omitempty"`
+	Revocation *revocation  `json:"revocation,omitempty"`
+	Restore    bool         `json:"restore,omitempty"`
+}
+
+// jobSnapshot holds the immutable fields of a job as recorded at submission time.
+type jobSnapshot struct {
+	JobID         string  `json:"job_id"`
+	ConsumerID    string  `json:"consumer_id"`
+	Priority      int32   `json:"priority"`
+	SubmittedAt   int64   `json:"submitted_at"`
+	Operation     string  `json:"operation"`
+	DType         string  `json:"dtype"`
+	AData         []byte  `json:"a_data,omitempty"`
+	BData         []byte  `json:"b_data,omitempty"`
+	InputBytes    int64   `json:"input_bytes"`
+	M             int32   `json:"m"`
+	N             int32   `json:"n"`
+	D             int32   `json:"d"`
+	RowSplits     int32   `json:"row_splits"`
+	ColSplits     int32   `json:"col_splits"`
+	Adaptive      bool    `json:"adaptive"`
+	TargetShardMs int32   `json:"target_shard_ms"`
+	ScaleBytes    []byte  `json:"scale_bytes,omitempty"`
+	ScaleScalar   float32 `json:"scale_scalar"`
+}
+
+// snapshotJob captures the submission-time fields of a job, including its inputs.
+// The caller must hold j.mu, or own the job exclusively.
+func snapshotJob(j *Job, aData, bData []byte) *jobSnapshot {
+	return &jobSnapshot{
+		JobID:         j.JobID,
+		ConsumerID:    j.ConsumerID,
+		Priority:      j.Priority,
+		SubmittedAt:   j.SubmittedAt,
+		Operation:     j.Operation,
+		DType:         j.DType,
+		AData:         aData,
+		BData:         bData,
+		InputBytes:    j.InputBytes,
+		M:             j.m,
+		N:             j.n,
+		D:             j.d,
+		RowSplits:     j.RowSplits,
+		ColSplits:     j.ColSplits,
+		Adaptive:      j.Adaptive,
+		TargetShardMs: j.TargetShardMs,
+		ScaleBytes:    j.ScaleBytes,
+		ScaleScalar:   j.ScaleScalar,
+	}
+}
+
+// restore rebuilds a queued job from its snapshot.
+func (js *jobSnapshot) restore() *Job {
+	job := &Job{
+		JobID:          js.JobID,
+		ConsumerID:     js.ConsumerID,
+		Priority:       js.Priority,
+		SubmittedAt:    js.SubmittedAt,
+		Operation:      js.Operation,
+		DType:          js.DType,
+		AData:          js.AData,
+		BData:          js.BData,
+		InputBytes:     js.InputBytes,
+		m:              js.M,
+		n:              js.N,
+		d:              js.D,
+		ExpectedSplits: int(js.RowSplits) * int(js.ColSplits),
+		RowSplits:      js.RowSplits,
+		ColSplits:      js.ColSplits,
+		Adaptive:       js.Adaptive,
+		TargetShardMs:  js.TargetShardMs,
+		Results:        make(map[int][]byte),
+		ScaleBytes:     js.ScaleBytes,
+		ScaleScalar:    js.ScaleScalar,
+		PendingTasks:   make(map[int]TimeDeadline),
+	}
+	if job.Adaptive {
+		job.ExpectedSplits = 0
+		job.Bands = make(map[int]RowBand)
+	}
+	return job
+}
+
+// journal is an append-only write-ahead log of submissions, assignments and shard results.
+// It is replayed on startup to rebuild the disk store's jobs, job queue and devices.
+type journal struct {
+	mu          sync.Mutex
+	file        *os.File
+	path        string
+	fsync       bool
+	size        int64 // Length of the log, up to the end of its last entry.
+	compactedAt int64 // Length of the log right after it was last compacted.
+}
+
+// openJournal opens the write-ahead log in the given directory, creating it if needed.
+func openJournal(dir string, fsync bool) (*journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, journalFile)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &journal{file: f, path: path, fsync: fsync, size: info.Size(), compactedAt: info.Size()}, nil
+}
+
+// append writes an entry to the log, syncing it to disk if configured.
+// A write that fails midway is cut off, so the entries appended after it are not glued to a partial line.
+func (jl *journal) append(entry *journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+	if _, err := jl.file.Write(line); err != nil {
+		if truncErr := jl.file.Truncate(jl.size); truncErr != nil {
+			log.Printf("Failed to cut off partial journal entry in %s: %v", jl.path, truncErr)
+		}
+		return err
+	}
+	jl.size += int64(len(line))
+	if jl.fsync {
+		return jl.file.Sync()
+	}
+	return nil
+}
+
+// needsCompaction reports whether the log has grown enough since it was last compacted to be compacted again.
+func (jl *journal) needsCompaction() bool {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+	return jl.size >= journalCompactMinBytes && jl.size >= 2*jl.compactedAt
+}
+
+// close syncs the log to disk and closes the underlying file.
+func (jl *journal) close() error {
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+	return errors.Join(jl.file.Sync(), jl.file.Close())
+}
+
+// readJournal reads every entry from the log at the given path.
+// A truncated trailing entry, as left by a crash mid-write, is dropped. A corrupt entry elsewhere is logged
+// and skipped, and the entries after it are still read.
+func readJournal(path string) ([]*journalEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*journalEntry
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding truncated journal entry at end of %s", path)
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("Skipping corrupt journal entry in %s: %v", path, err)
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+}
+
+// compact rewrites the log so it only describes the current state of the given devices and jobs.
+// The new log is written to a temporary file and atomically renamed over the old one.
+// It is called at startup, and whenever the log has grown enough; the caller must make sure
+// no entries are appended while the state is captured and the log rewritten.
+func (jl *journal) compact(devices []*Device, jobs []*Job) error {
+	tmpPath := jl.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+
+	for _, entry := range stateEntries(devices, jobs) {
+		if err := encoder.Encode(entry); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+	if err := jl.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, jl.path); err != nil {
+		return err
+	}
+	jl.file, err = os.OpenFile(jl.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := jl.file.Stat()
+	if err != nil {
+		return err
+	}
+	jl.size, jl.compactedAt = info.Size(), info.Size()
+	return nil
+}
+
+// stateEntries returns the entries that recreate the given devices and jobs on replay,
+// with jobs in submission order so the job queue is rebuilt in the same order.
+func stateEntries(devices []*Device, jobs []*Job) []*journalEntry {
+	ordered := make([]*Job, len(jobs))
+	copy(ordered, jobs)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].SubmittedAt < ordered[j].SubmittedAt })
+
+	var entries []*journalEntry
+	for _, device := range devices {
+		entries = append(entries, &journalEntry{Type: entryRegister, Device: device})
+	}
+	for _, job := range ordered {
+		entries = append(entries, jobEntries(job)...)
+	}
+	return entries
+}
+
+// jobEntries returns the entries that recreate the job's current state on replay.
+// Completed jobs are recorded without their inputs, which are no longer needed.
+func jobEntries(job *Job) []*journalEntry {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.CompletedAt != 0 {
+		final, err := job.finalResult()
+		if err != nil {
+			log.Printf("Failed to load final result of job %s for compaction: %v", job.JobID, err)
+			return nil
+		}
+		return []*journalEntry{
+			{Type: entrySubmit, Job: snapshotJob(job, nil, nil)},
+			{Type: entryComplete, JobID: job.JobID, Data: final, Time: job.CompletedAt},
+		}
+	}
+
+	aData, bData := job.AData, job.BData
+	if job.inputsSpilled {
+		var errA, errB error
+		aData, errA = readSpill(job.JobID, "a")
+		bData, errB = readSpill(job.JobID, "b")
+		if err := errors.Join(errA, errB); err != nil {
+			log.Printf("Failed to load spilled inputs of job %s for compaction: %v", job.JobID, err)
+			return nil
+		}
+	}
+	entries := []*journalEntry{{Type: entrySubmit, Job: snapshotJob(job, aData, bData)}}
+	for idx := 1; idx <= len(job.Bands); idx++ {
+		band := job.Bands[idx]
+		entries = append(entries, &journalEntry{Type: entryAssign, JobID: job.JobID, Index: idx, Band: &band})
+	}
+	for idx, td := range job.PendingTasks {
+		entries = append(entries, &journalEntry{Type: entryAssign, JobID: job.JobID, Index: idx, DeviceID: td.DeviceID, Deadline: td.Deadline})
+	}
+	for idx, data := range job.Results {
+		entries = append(entries, &journalEntry{Type: entryResult, JobID: job.JobID, Index: idx, Data: data})
+	}
+	return entries
+}
+
+// assignEntry builds the journal entry recording that a shard of the job was leased.
+// The caller must hold job.mu.
+func assignEntry(job *Job, taskIndex int) *journalEntry {
+	td := job.PendingTasks[taskIndex]
+	entry := &journalEntry{
+		Type:     entryAssign,
+		JobID:    job.JobID,
+		Index:    taskIndex,
+		DeviceID: td.DeviceID,
+		Deadline: td.Deadline,
+	}
+	if job.Adaptive {
+		band := job.Bands[taskIndex]
+		entry.Band = &band
+	}
+	return entry
+}
+
+// diskStore is a JobStore that keeps jobs in memory and records every change in a write-ahead log,
+// so that jobs, the job queue and the device registry survive a restart. The log is compacted
+// whenever it has doubled in size since it was last compacted.
+type diskStore struct {
+	*memoryStore
+	journal   *journal
+	createMu  sync.Mutex   // Serializes Create, so a job ID is checked and logged atomically.
+	compactMu sync.RWMutex // Held for reading by every change, and for writing while the log is compacted.
+	devices   deviceRegistry
+}
+
+// openDiskStore rebuilds a job store from the write-ahead log in the given directory and compacts the log.
+// Replay restores all job data into memory, so spill files of a previous run are not read back.
+func openDiskStore(dir string, fsync bool) (*diskStore, error) {
+	entries, err := readJournal(filepath.Join(dir, journalFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	ds := &diskStore{memoryStore: newMemoryStore()}
+	for _, entry := range entries {
+		ds.apply(entry)
+	}
+	jl, err := openJournal(dir, fsync)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	if err := jl.compact(ds.devices.list(), ds.List()); err != nil {
+		jl.close()
+		return nil, fmt.Errorf("failed to compact journal: %w", err)
+	}
+	ds.journal = jl
+	if len(entries) > 0 {
+		log.Printf("Recovered %d jobs (%d queued) and %d devices from %s", len(ds.List()), len(ds.Queued()), len(ds.devices.list()), dir)
+	}
+	return ds, nil
+}
+
+// apply replays a journal entry against the store's jobs, job queue and devices.
+func (ds *diskStore) apply(entry *journalEntry) {
+	if entry.Type == entryRegister {
+		if entry.Device != nil {
+			ds.devices.save(entry.Device)
+		}
+		return
+	}
+	ds.memoryStore.apply(entry)
+}
+
+// Create records the job in the log and adds it to the store.
+// The job is only added once its submission is durable.
+func (ds *diskStore) Create(job *Job) error {
+	ds.createMu.Lock()
+	defer ds.createMu.Unlock()
+	defer ds.compactIfNeeded()
+	ds.compactMu.RLock()
+	defer ds.compactMu.RUnlock()
+	if _, exists := ds.Lookup(job.JobID); exists {
+		return ErrJobExists
+	}
+	snapshot := snapshotJob(job, job.AData, job.BData)
+	if err := ds.journal.append(&journalEntry{Type: entrySubmit, Job: snapshot}); err != nil {
+		return fmt.Errorf("failed to persist job: %w", err)
+	}
+	return ds.memoryStore.Create(job)
+}
+
+// ReserveShard leases an available shard of the job to the device and records the lease.
+// A failure to record the lease is only logged: on recovery the shard is simply leased again.
+func (ds *diskStore) ReserveShard(job *Job, now int64, device *Device) (int, bool) {
+	defer ds.compactIfNeeded()
+	ds.compactMu.RLock()
+	defer ds.compactMu.RUnlock()
+	taskIndex, found := ds.memoryStore.ReserveShard(job, now, device)
+	if !found {
+		return 0, false
+	}
+	job.mu.Lock()
+	entry := assignEntry(job, taskIndex)
+	job.mu.Unlock()
+	ds.logBestEffort(entry, fmt.Sprintf("assignment of shard %d", taskIndex), job.JobID)
+	return taskIndex, true
+}
+
+// UpdateShard records the result of a shard in the store and the log.
+// A failure to log the result is only logged: on recovery the shard is simply computed again.
+func (ds *diskStore) UpdateShard(job *Job, index int, deviceID string, data []byte, record func(lease TimeDeadline) error) (bool, error) {
+	defer ds.compactIfNeeded()
+	ds.compactMu.RLock()
+	defer ds.compactMu.RUnlock()
+	ready, err := ds.memoryStore.UpdateShard(job, index, deviceID, data, record)
+	if err != nil {
+		return false, err
+	}
+	ds.logBestEffort(&journalEntry{Type: entryResult, JobID: job.JobID, Index: index, Data: data}, fmt.Sprintf("result of shard %d", index), job.JobID)
+	return ready, nil
+}
+
+// Complete records the job's final result in the store and the log.
+func (ds *diskStore) Complete(job *Job, finalResult []byte) error {
+	defer ds.compactIfNeeded()
+	ds.compactMu.RLock()
+	defer ds.compactMu.RUnlock()
+	if err := ds.memoryStore.Complete(job, finalResult); err != nil {
+		return err
+	}
+	job.mu.Lock()
+	completedAt := job.CompletedAt
+	job.mu.Unlock()
+	return ds.journal.append(&journalEntry{Type: entryComplete, JobID: job.JobID, Data: finalResult, Time: completedAt})
+}
+
+// Delete removes the job from the store and records the deletion in the log.
+func (ds *diskStore) Delete(jobID string) error {
+	ds.compactMu.RLock()
+	defer ds.compactMu.RUnlock()
+	if err := ds.journal.append(&journalEntry{Type: entryDelete, JobID: jobID}); err != nil {
+		return err
+	}
+	return ds.memoryStore.Delete(jobID)
+}
+
+// SaveDevice records a registered device in the log.
+func (ds *diskStore) SaveDevice(device *Device) error {
+	ds.compactMu.RLock()
+	defer ds.compactMu.RUnlock()
+	if err := ds.journal.append(&journalEntry{Type: entryRegister, Device: device}); err != nil {
+		return err
+	}
+	ds.devices.save(device)
+	return nil
+}
+
+// Devices returns the devices recorded in the log.
+func (ds *diskStore) Devices() []*Device {
+	return ds.devices.list()
+}
+
+// Close closes the write-ahead log.
+func (ds *diskStore) Close() error {
+	return ds.journal.close()
+}
+
+// compactIfNeeded compacts the log if it has grown enough since it was last compacted,
+// holding off every change to the store meanwhile. A failure is only logged, and compaction
+// is tried again once the log has doubled again.
+func (ds *diskStore) compactIfNeeded() {
+	if !ds.journal.needsCompaction() {
+		return
+	}
+	ds.compactMu.Lock()
+	defer ds.compactMu.Unlock()
+	if !ds.journal.needsCompaction() {
+		return
+	}
+	if err := ds.journal.compact(ds.devices.list(), ds.List()); err != nil {
+		log.Printf("Failed to compact journal %s: %v", ds.journal.path, err)
+		ds.journal.mu.Lock()
+		ds.journal.compactedAt = ds.journal.size
+		ds.journal.mu.Unlock()
+	}
+}
+
+// logBestEffort appends an entry to the log, logging rather than returning any failure.
+func (ds *diskStore) logBestEffort(entry *journalEntry, what, jobID string) {
+	if err := ds.journal.append(entry); err != nil {
+		log.Printf("Failed to persist %s of job %s: %v", what, jobID, err)
+	}
+}
+
+// removeStaleSpills deletes job data spilled to disk by a previous run of the server.
+// Without a spill directory configured nothing is deleted, rather than matching files in the working directory.
+func removeStaleSpills() {
+	if AppConfig.Memory.SpillDir == "" {
+		return
+	}
+	for _, part := range []string{"a", "b", "final"} {
+		matches, err := filepath.Glob(filepath.Join(AppConfig.Memory.SpillDir, "*."+part))
+		if err != nil {
+			continue
+		}
+		for _, path := range matches {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to remove stale spill file %s: %v", path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package tango
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "tango/tango/src/protobuff"
+)
+
+// TestRecoverJobCrashedBeforeCompletion crashes the coordinator after it stored the last result of a job
+// but before it completed the job, and checks the job is completed, and its records shipped, on restart.
+func TestRecoverJobCrashedBeforeCompletion(t *testing.T) {
+	AppConfig.Store.Enabled = true
+	AppConfig.Store.Dir = t.TempDir()
+	AppConfig.Records.Dir = t.TempDir()
+	defer func() {
+		AppConfig.Store.Enabled = false
+		AppConfig.Records.Dir = ""
+	}()
+
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := testContext("alice", "")
+	reg, err := s.RegisterDevice(ctx, &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9})
+	if err != nil || !reg.Accepted {
+		t.Fatalf("RegisterDevice: %v %v", reg, err)
+	}
+	ctx = testContext("alice", reg.DeviceId)
+	submitted, err := s.SubmitTask(ctx, &pb.TaskRequest{JobId: "crashed", Operation: "matmul", AData: testMatrix(t, 2, 1), BData: testMatrix(t, 1, 2), RowSplits: 2, ColSplits: 1})
+	if err != nil || !submitted.Accepted {
+		t.Fatalf("SubmitTask: %v %v", submitted, err)
+	}
+	results := map[int]string{1: "0 1", 2: "1 2"}
+	first, err := s.FetchTask(ctx, &pb.DeviceRequest{DeviceId: reg.DeviceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _ := extractShardIndex(first.TaskId)
+	if _, err := s.ReportResult(ctx, &pb.TaskResult{DeviceId: reg.DeviceId, JobId: "crashed", TaskId: first.TaskId, ResultData: []byte(results[index])}); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.FetchTask(ctx, &pb.DeviceRequest{DeviceId: reg.DeviceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Store the last result the way ReportResult does, then crash before the job is completed.
+	index, _ = extractShardIndex(second.TaskId)
+	job, _ := s.store.Lookup("crashed")
+	if _, err := s.store.UpdateShard(job, index, reg.DeviceId, []byte(results[index]), nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	job, exists := s.store.Lookup("crashed")
+	if !exists || !job.completed() {
+		t.Fatal("job recovered with every shard result was not completed")
+	}
+	status, err := s.GetJobStatus(ctx, &pb.JobStatusRequest{JobId: "crashed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0 1\n1 2"; string(status.FinalResult) != want {
+		t.Errorf("final result = %q, want %q", status.FinalResult, want)
+	}
+	if _, err := os.Stat(filepath.Join(AppConfig.Records.ExportDir, "crashed.csv")); err != nil {
+		t.Errorf("records of the recovered job were not shipped: %v", err)
+	}
+}
+
+// TestReadJournalSkipsCorruptEntries checks that a corrupt entry in the middle of the log is skipped
+// without discarding the entries after it, and that a truncated trailing entry is dropped.
+func TestReadJournalSkipsCorruptEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), journalFile)
+	contents := `{"type":"submit","job":{"job_id":"first"}}
+{"type":"result","job_id":"fir
+{"type":"submit","job":{"job_id":"second"}}
+{"type":"complete","job_i`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Job.JobID != "first" || entries[1].Job.JobID != "second" {
+		t.Fatalf("entries = %+v, want the submissions of first and second", entries)
+	}
+}
+
+// TestJobSnapshotRestore checks that a job restored from its snapshot expects as many shards as when submitted,
+// including grids whose shard count overflows an int32.
+func TestJobSnapshotRestore(t *testing.T) {
+	for _, tt := range []struct {
+		rowSplits, colSplits int32
+		want                 int
+	}{
+		{3, 2, 6},
+		{70000, 70000, 4900000000},
+	} {
+		job := createJob(&pb.TaskRequest{JobId: "restored", RowSplits: tt.rowSplits, ColSplits: tt.colSplits})
+		restored := snapshotJob(job, nil, nil).restore()
+		if job.ExpectedSplits != tt.want || restored.ExpectedSplits != tt.want {
+			t.Errorf("%dx%d grid: submitted with %d shards, restored with %d, want %d", tt.rowSplits, tt.colSplits, job.ExpectedSplits, restored.ExpectedSplits, tt.want)
+		}
+	}
+}
+
+// TestRemoveStaleSpillsWithoutSpillDir checks that no file of the working directory is deleted when no spill directory is configured.
+func TestRemoveStaleSpillsWithoutSpillDir(t *testing.T) {
+	spillDir := AppConfig.Memory.SpillDir
+	defer func() { AppConfig.Memory.SpillDir = spillDir }()
+	AppConfig.Memory.SpillDir = ""
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.WriteFile("notes.final", []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	removeStaleSpills()
+	if _, err := os.Stat("notes.final"); err != nil {
+		t.Errorf("file of the working directory removed: %v", err)
+	}
+}
+
+// TestNewJobStoreRemovesStaleSpills checks that spill files of a previous run are removed when the store is opened,
+// even by the in-memory store, while other files of the spill directory are kept.
+func TestNewJobStoreRemovesStaleSpills(t *testing.T) {
+	spillDir := AppConfig.Memory.SpillDir
+	defer func() { AppConfig.Memory.SpillDir = spillDir }()
+	AppConfig.Memory.SpillDir = t.TempDir()
+	stale := []string{spillPath("old", "a"), spillPath("old", "b"), spillPath("done", "final")}
+	kept := filepath.Join(AppConfig.Memory.SpillDir, "notes.txt")
+	for _, path := range append(stale, kept) {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := newJobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, ok := store.(*memoryStore); !ok {
+		t.Fatalf("newJobStore = %T, want the in-memory store", store)
+	}
+	for _, path := range stale {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("stale spill file %s not removed: %v", filepath.Base(path), err)
+		}
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("file other than a spill removed: %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package tango
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// jwksMissRefreshInterval is the minimum time between reloads of the key set triggered by tokens
+// signed with an unknown key ID, so forged key IDs cannot make Tango hammer the key set's source.
+const jwksMissRefreshInterval = 30 * time.Second
+
+// errNoJWTSecret is returned when an HS256 token cannot be verified because no JWT secret is available.
+var errNoJWTSecret = errors.New("no JWT secret available")
+
+// activeKeySet holds the public keys that verify asymmetrically signed tokens, or nil when no JWKS is configured.
+var activeKeySet atomic.Pointer[keySet]
+
+// jwk is a single JSON Web Key, as found in the "keys" array of a JWKS document.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA modulus.
+	E   string `json:"e"`   // RSA public exponent.
+	Crv string `json:"crv"` // Curve of EC and OKP keys.
+	X   string `json:"x"`   // EC x coordinate, or the Ed25519 public key.
+	Y   string `json:"y"`   // EC y coordinate.
+}
+
+// verificationKey is a public key along with the only algorithm it may verify.
+type verificationKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// keySet holds the keys of a JWKS document, keyed by key ID, and reloads them from their source.
+type keySet struct {
+	source string // File path or http(s) URL of the JWKS document.
+
+	mu            sync.RWMutex
+	keys          map[string]verificationKey
+	loadedAt      time.Time
+	missReloadAt  time.Time          // When an unknown key ID last triggered a reload, successful or not.
+	missReloading singleflight.Group // Collapses the reloads triggered by concurrent lookups of unknown key IDs.
+}
+
+// LoadJWKS loads the JWKS document configured under tokens.jwks, so tokens signed with RS256, ES256 or EdDSA
+// can be verified. It does nothing when no JWKS is configured. The server reloads it periodically once started.
+func LoadJWKS() error {
+	source := AppConfig.Tokens.JWKS
+	if source == "" {
+		return nil
+	}
+	ks := &keySet{source: source}
+	if err := ks.load(); err != nil {
+		return err
+	}
+	activeKeySet.Store(ks)
+	return nil
+}
+
+// fetch returns the raw JWKS document, read from a file or fetched over HTTP.
+func (ks *keySet) fetch() ([]byte, error) {
+	if !strings.HasPrefix(ks.source, "http://") && !strings.HasPrefix(ks.source, "https://") {
+		return os.ReadFile(ks.source)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(ks.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// load fetches and parses the JWKS document and swaps its keys in. On error, the keys previously loaded stay in use.
+func (ks *keySet) load() error {
+	data, err := ks.fetch()
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS from %s: %v", ks.source, err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS from %s: %v", ks.source, err)
+	}
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.loadedAt = time.Now()
+	ks.mu.Unlock()
+	return nil
+}
+
+// reloadEvery reloads the key set at the given interval. It returns once stop is closed.
+func (ks *keySet) reloadEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := ks.load(); err != nil {
+			log.Printf("Failed to reload JWKS, keeping the current keys: %v", err)
+		}
+	}
+}
+
+// lookup returns the key with the given ID. A token without a key ID is accepted only when the set holds
+// a single key. Unknown key IDs trigger a reload, at most once per jwksMissRefreshInterval even when it fails,
+// so keys published by the issuer are picked up before the next periodic reload. Lookups missing concurrently
+// share a single reload and wait for it.
+func (ks *keySet) lookup(kid string) (verificationKey, bool) {
+	ks.mu.RLock()
+	key, found := ks.find(kid)
+	stale := time.Since(ks.loadedAt) > jwksMissRefreshInterval && time.Since(ks.missReloadAt) > jwksMissRefreshInterval
+	ks.mu.RUnlock()
+	if found || !stale {
+		return key, found
+	}
+	ks.missReloading.Do("reload", func() (interface{}, error) {
+		ks.mu.RLock()
+		reloaded := time.Since(ks.missReloadAt) <= jwksMissRefreshInterval
+		ks.mu.RUnlock()
+		if reloaded {
+			return nil, nil
+		}
+		err := ks.load()
+		ks.mu.Lock()
+		ks.missReloadAt = time.Now()
+		ks.mu.Unlock()
+		if err != nil {
+			log.Printf("Failed to reload JWKS for unknown key ID %q: %v", kid, err)
+		}
+		return nil, err
+	})
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.find(kid)
+}
+
+// find returns the key with the given ID. The caller must hold ks.mu.
+func (ks *keySet) find(kid string) (verificationKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, found := ks.keys[kid]
+	return key, found
+}
+
+// parseJWKS parses a JWKS document into verification keys keyed by key ID.
+// Keys not meant for signatures, or of a type Tango cannot verify, are skipped.
+func parseJWKS(data []byte) (map[string]verificationKey, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]verificationKey)
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.verificationKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+// verificationKey decodes the public key, and checks it matches the algorithm it declares, if any.
+func (k jwk) verificationKey() (verificationKey, error) {
+	var vk verificationKey
+	switch {
+	case k.Kty == "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return vk, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return vk, err
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return vk, errors.New("unsupported RSA key size or exponent")
+		}
+		vk = verificationKey{alg: "RS256", key: &rsa.PublicKey{N: n, E: int(e.Int64())}}
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return vk, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return vk, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return vk, errors.New("point is not on P-256")
+		}
+		vk = verificationKey{alg: "ES256", key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return vk, errors.New("invalid Ed25519 public key")
+		}
+		vk = verificationKey{alg: "EdDSA", key: ed25519.PublicKey(x)}
+	default:
+		return vk, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+	}
+	if k.Alg != "" && k.Alg != vk.alg {
+		return vk, fmt.Errorf("algorithm %s does not match key type %s", k.Alg, k.Kty)
+	}
+	return vk, nil
+}
+
+// decodeBigInt decodes a base64url-encoded unsigned big-endian integer.
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter encoding")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// verify checks a token signature made with the key's algorithm.
+func (vk verificationKey) verify(signingInput string, signature []byte) bool {
+	switch key := vk.key.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS encodes ES256 signatures as the concatenation of r and s, 32 bytes each.
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, []byte(signingInput), signature)
+	}
+	return false
+}
+
+// verifyTokenSignature checks the signature of a token against the algorithm named in its header.
+// HS256 tokens are verified with any of the shared secrets, never with an empty one; RS256, ES256 and EdDSA tokens with Tango's own signing key
+// or the key of the configured JWKS named by the token's key ID, which must be registered for that very algorithm.
+func verifyTokenSignature(alg, kid, signingInput string, signature []byte, secretKeys []string) error {
+	if alg == "HS256" {
+		secretKeys = slices.DeleteFunc(slices.Clone(secretKeys), func(key string) bool { return key == "" })
+		if len(secretKeys) == 0 {
+			return errNoJWTSecret
+		}
+		for _, secretKey := range secretKeys {
+			expectedSignature := generateHmacSha256Signature(signingInput, secretKey)
+			if subtle.ConstantTimeCompare(expectedSignature, signature) == 1 {
+				return nil
+			}
+		}
+		return errors.New("invalid signature")
+	}
+	if alg != "RS256" && alg != "ES256" && alg != "EdDSA" {
+		return errors.New("invalid algorithm")
+	}
+	var key verificationKey
+	if sg := activeSigner.Load(); sg != nil && sg.kid == kid {
+		key = sg.public
+	} else if ks := activeKeySet.Load(); ks != nil {
+		var found bool
+		if key, found = ks.lookup(kid); !found {
+			return fmt.Errorf("unknown key ID %q", kid)
+		}
+	} else {
+		return errors.New("invalid algorithm")
+	}
+	if key.alg != alg {
+		return errors.New("invalid algorithm")
+	}
+	if !key.verify(signingInput, signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package tango
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestKeySetLookupReloadsOnce checks that concurrent lookups of an unknown key ID share a single reload of the key set,
+// and that lookups right after it do not trigger another one, even though the key is still unknown.
+func TestKeySetLookupReloadsOnce(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, `{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"known","x":%q}]}`, base64.RawURLEncoding.EncodeToString(public))
+	}))
+	defer source.Close()
+
+	ks := &keySet{source: source.URL}
+	if err := ks.load(); err != nil {
+		t.Fatal(err)
+	}
+	ks.loadedAt = time.Now().Add(-2 * jwksMissRefreshInterval)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, found := ks.lookup("unknown"); found {
+				t.Error("found an unknown key ID")
+			}
+		}()
+	}
+	wg.Wait()
+	if _, found := ks.lookup("unknown"); found {
+		t.Error("found an unknown key ID")
+	}
+	if _, found := ks.lookup("known"); !found {
+		t.Error("known key ID not found")
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("key set fetched %d times, want once to load it and once for the unknown key ID", got)
+	}
+}
+
+// TestKeySetReloadEvery checks that the key set is reloaded periodically, and no longer once stopped.
+func TestKeySetReloadEvery(t *testing.T) {
+	var fetches atomic.Int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		fmt.Fprint(w, `{"keys":[]}`)
+	}))
+	defer source.Close()
+
+	ks := &keySet{source: source.URL}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		ks.reloadEvery(5*time.Millisecond, stop)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); fetches.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("key set not reloaded periodically")
+		}
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("key set reload still running after stop")
+	}
+	stopped := fetches.Load()
+	time.Sleep(20 * time.Millisecond)
+	if got := fetches.Load(); got != stopped {
+		t.Errorf("key set fetched %d times after stop", got-stopped)
+	}
+}
+
+// testKeys holds a key pair of each algorithm a JWKS may hold, under the key IDs "rsa", "ec" and "ed".
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+	ed  ed25519.PrivateKey
+}
+
+// newTestKeys generates the test key pairs and installs their public keys as the active key set for the duration of the test.
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	doc, err := json.Marshal(map[string][]map[string]string{"keys": {
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseJWKS(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := activeKeySet.Load()
+	activeKeySet.Store(&keySet{keys: keys, loadedAt: time.Now()})
+	t.Cleanup(func() { activeKeySet.Store(saved) })
+	return &testKeys{rsa: rsaKey, ec: ecKey, ed: edKey}
+}
+
+// sign returns a token of the claims with the given header, signed by the key of the given algorithm.
+func (tk *testKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, tk.rsa, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, tk.ec, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(tk.ed, []byte(input))
+	case "HS256":
+		// Keyed with the RSA public key, as in algorithm confusion attacks.
+		signature = generateHmacSha256Signature(input, string(x509.MarshalPKCS1PublicKey(&tk.rsa.PublicKey)))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// TestValidateJWTWithJWKS checks that RS256, ES256 and EdDSA tokens are verified with the JWKS key named by their kid,
+// which must be registered for the token's algorithm, and that HS256 tokens naming a JWKS key are not verified with it.
+func TestValidateJWTWithJWKS(t *testing.T) {
+	keys := newTestKeys(t)
+	claims := map[string]any{"exp": time.Now().Add(time.Minute).Unix()}
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", keys.sign(t, "RS256", "rsa", claims), true},
+		{"ES256", keys.sign(t, "ES256", "ec", claims), true},
+		{"EdDSA", keys.sign(t, "EdDSA", "ed", claims), true},
+		{"unknown kid", keys.sign(t, "RS256", "missing", claims), false},
+		{"kid of another algorithm", keys.sign(t, "ES256", "rsa", claims), false},
+		{"HS256 with a JWKS kid", keys.sign(t, "HS256", "rsa", claims), false},
+		{"none", keys.sign(t, "none", "rsa", claims), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateJWT(tt.token, "0123456789abcdef0123456789abcdef")
+			if (err == nil) != tt.valid {
+				t.Errorf("ValidateJWT = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+	tampered := keys.sign(t, "EdDSA", "ed", claims)
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	if _, err := ValidateJWT(tampered); err == nil {
+		t.Error("ValidateJWT accepted a tampered EdDSA signature")
+	}
+}
+
+// TestParseJWKSRefusesWeakKeys checks that RSA keys under 2048 bits, EC keys on other curves than P-256
+// and keys declaring another algorithm than their type's are skipped.
+func TestParseJWKSRefusesWeakKeys(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	for name, key := range map[string]jwk{
+		"RSA 1024":             {Kty: "RSA", N: b64(small.N.Bytes()), E: b64(big.NewInt(int64(small.E)).Bytes())},
+		"EC P-384":             {Kty: "EC", Crv: "P-384", X: b64(p384.X.Bytes()), Y: b64(p384.Y.Bytes())},
+		"EC P-384 named P-256": {Kty: "EC", Crv: "P-256", X: b64(p384.X.Bytes()), Y: b64(p384.Y.Bytes())},
+		"Ed25519 as RS256":     {Kty: "OKP", Crv: "Ed25519", Alg: "RS256", X: b64(edKey.Public().(ed25519.PublicKey))},
+	} {
+		if _, err := key.verificationKey(); err == nil {
+			t.Errorf("%s: key accepted", name)
+		}
+	}
+}
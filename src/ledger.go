@@ -0,0 +1,375 @@
+package tango
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Kinds of ledger entries.
+const (
+	ledgerShard   = "shard"   // A device reported the result of a shard.
+	ledgerStaged  = "staged"  // The shard entries of a job up to a sequence number were put in the outbox, to be uploaded.
+	ledgerShipped = "shipped" // The staged shard entries of a job were uploaded.
+)
+
+// Verification statuses of shard entries.
+const (
+	verificationUnverified = "unverified" // The result was accepted without being checked.
+)
+
+// ledgerFile is the name of the ledger inside the configured records directory.
+const ledgerFile = "ledger.jsonl"
+
+// LedgerEntry is a single entry of the billing ledger, serialized as one JSON line.
+// Shard entries record the work a device did for a consumer; staged and shipped entries record
+// which shard entries of a job are in the outbox and which have been uploaded, so they are never lost.
+type LedgerEntry struct {
+	Seq            uint64  `json:"seq"` // Position of the entry in the ledger, starting at 1.
+	Kind           string  `json:"kind"`
+	JobID          string  `json:"job_id"`
+	Shard          int     `json:"shard"`
+	DeviceID       string  `json:"device_id,omitempty"`
+	ConsumerID     string  `json:"consumer_id,omitempty"`
+	Operation      string  `json:"operation,omitempty"`
+	Priority       int32   `json:"priority,omitempty"`        // Priority the job was submitted with.
+	Flops          int64   `json:"flops,omitempty"`           // FLOPs of the shard, computed by the coordinator from its shape.
+	ReportedFlops  int64   `json:"reported_flops,omitempty"`  // FLOPs reported by the device, kept for anomaly detection only.
+	FlopsAnomaly   bool    `json:"flops_anomaly,omitempty"`   // Whether the reported FLOPs stray from the computed ones.
+	LeaseDeadline  int64   `json:"lease_deadline,omitempty"`  // Unix timestamp (nanoseconds) the shard's lease expired at.
+	ReportedAt     int64   `json:"reported_at,omitempty"`     // Unix timestamp (nanoseconds) the result was received.
+	Verification   string  `json:"verification,omitempty"`    // Verification status of the result.
+	Priced         bool    `json:"priced,omitempty"`          // Whether the shard was priced when recorded; entries that were not are priced when billed.
+	PricePerGFLOP  float64 `json:"price_per_gflop,omitempty"` // Price per GFLOP of the operation, before the tier multiplier.
+	PriorityTier   int32   `json:"priority_tier,omitempty"`   // Minimum priority of the priority tier the job fell in.
+	TierMultiplier float64 `json:"tier_multiplier,omitempty"` // Multiplier of that tier, 1 for priorities below every tier.
+	DeviceShare    float64 `json:"device_share,omitempty"`    // Fraction of the charge paid out to the device.
+	ShippedThrough uint64  `json:"shipped_through,omitempty"` // Last shard entry of the job staged or uploaded, for staged and shipped entries.
+	Object         string  `json:"object,omitempty"`          // Name of the object uploaded, for staged and shipped entries.
+}
+
+// ledger is an append-only log of the shards computed by devices for consumers, kept per coordinator.
+// Each entry is appended with a single write, and the shard entries of a job not yet uploaded
+// are kept in memory until they are shipped. The ledger doubles as a durable outbox: a batch of entries
+// is staged before it is uploaded, and only marked as shipped once the upload is confirmed,
+// so a batch whose upload failed, or was interrupted by a crash, is uploaded again as is.
+type ledger struct {
+	shipMu sync.Mutex // Serializes shipments, so concurrent ones never upload the same entries.
+
+	mu        sync.Mutex
+	file      *os.File // Ledger file, or nil for a ledger kept in memory.
+	path      string
+	fsync     bool
+	size      int64 // Length of the ledger file, up to the end of its last entry.
+	nextSeq   uint64
+	unshipped map[string][]LedgerEntry // Shard entries not yet uploaded, keyed by job ID.
+	outbox    map[string]LedgerEntry   // Batch staged for upload, keyed by job ID.
+	shipped   map[string]bool          // Jobs with at least one shipment.
+	memory    []LedgerEntry            // Every entry, for a ledger kept in memory; never trimmed, as billing reports read them all.
+}
+
+// newMemoryLedger returns a ledger kept in memory only, as used when records.dir is not set. It keeps every entry
+// for the lifetime of the process, so its memory grows with every shard computed, and it is lost on restart:
+// it suits tests and short offline runs, not production.
+func newMemoryLedger() *ledger {
+	return &ledger{
+		nextSeq:   1,
+		unshipped: make(map[string][]LedgerEntry),
+		outbox:    make(map[string]LedgerEntry),
+		shipped:   make(map[string]bool),
+	}
+}
+
+// openLedger opens the ledger in the given directory, creating it if needed, and replays it
+// to find the entries not yet shipped. A truncated trailing entry, as left by a crash mid-write, is cut off;
+// corrupt entries elsewhere are skipped.
+func openLedger(dir string, fsync bool) (*ledger, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := newMemoryLedger()
+	l.path = filepath.Join(dir, ledgerFile)
+	l.fsync = fsync
+	valid, err := l.replay()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.file = f
+	l.size = valid
+	return l, nil
+}
+
+// replay rebuilds the ledger's state from its file, and returns the length of its complete lines.
+func (l *ledger) replay() (int64, error) {
+	return l.scan(-1, func(entry *LedgerEntry) {
+		l.apply(*entry)
+	})
+}
+
+// scan calls fn with every entry of the first limit bytes of the ledger file, or of the whole file if limit is negative,
+// and returns the length of its complete lines. A truncated trailing entry, as left by a crash mid-write, is dropped.
+// A corrupt entry elsewhere is logged and skipped, and the entries after it are still read.
+func (l *ledger) scan(limit int64, fn func(entry *LedgerEntry)) (int64, error) {
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+	var offset int64
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding truncated ledger entry at end of %s", l.path)
+			}
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+		var entry LedgerEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("Skipping corrupt ledger entry in %s: %v", l.path, err)
+			continue
+		}
+		fn(&entry)
+	}
+}
+
+// apply updates the ledger's state with an entry. The caller must hold l.mu, or own the ledger exclusively.
+func (l *ledger) apply(entry LedgerEntry) {
+	if entry.Seq >= l.nextSeq {
+		l.nextSeq = entry.Seq + 1
+	}
+	switch entry.Kind {
+	case ledgerShard:
+		l.unshipped[entry.JobID] = append(l.unshipped[entry.JobID], entry)
+	case ledgerStaged:
+		l.outbox[entry.JobID] = entry
+	case ledgerShipped:
+		delete(l.outbox, entry.JobID)
+		l.shipped[entry.JobID] = true
+		remaining := l.unshipped[entry.JobID][:0]
+		for _, e := range l.unshipped[entry.JobID] {
+			if e.Seq > entry.ShippedThrough {
+				remaining = append(remaining, e)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(l.unshipped, entry.JobID)
+		} else {
+			l.unshipped[entry.JobID] = remaining
+		}
+	}
+}
+
+// append assigns the entry its sequence number and writes it to the ledger with a single write,
+// syncing it to disk if configured. The entry is only applied once written; a write that fails midway
+// is cut off, so the entries appended after it are not glued to a partial line.
+func (l *ledger) append(entry LedgerEntry) (LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.Seq = l.nextSeq
+	if l.file != nil {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return entry, err
+		}
+		line = append(line, '\n')
+		if _, err := l.file.Write(line); err != nil {
+			if truncErr := l.file.Truncate(l.size); truncErr != nil {
+				log.Printf("Failed to cut off partial ledger entry in %s: %v", l.path, truncErr)
+			} else if _, seekErr := l.file.Seek(l.size, io.SeekStart); seekErr != nil {
+				log.Printf("Failed to rewind ledger %s: %v", l.path, seekErr)
+			}
+			return entry, err
+		}
+		l.size += int64(len(line))
+		if l.fsync {
+			if err := l.file.Sync(); err != nil {
+				return entry, err
+			}
+		}
+	} else {
+		l.memory = append(l.memory, entry)
+	}
+	l.apply(entry)
+	return entry, nil
+}
+
+// recordShard appends a shard entry to the ledger, unless the shard is already recorded for the device under the same lease,
+// as when the device reports it again because its result could not be stored once recorded.
+func (l *ledger) recordShard(entry LedgerEntry) error {
+	entry.Kind = ledgerShard
+	if entry.Verification == "" {
+		entry.Verification = verificationUnverified
+	}
+	l.mu.Lock()
+	recorded := slices.ContainsFunc(l.unshipped[entry.JobID], func(e LedgerEntry) bool {
+		return e.Shard == entry.Shard && e.DeviceID == entry.DeviceID && e.LeaseDeadline == entry.LeaseDeadline
+	})
+	l.mu.Unlock()
+	if recorded {
+		return nil
+	}
+	_, err := l.append(entry)
+	return err
+}
+
+// ship uploads the shard entries of the job not yet shipped to the sink, as CSV, until none is left.
+// Each batch is staged in the outbox before it is uploaded, and recorded as shipped once the upload succeeded;
+// a batch staged earlier is uploaded again as is, under the same name. Entries are never dropped before that,
+// so a failed upload is simply retried later. The first batch of a job is named after the job;
+// later ones, holding results that arrived after it, after their first sequence number as well.
+func (l *ledger) ship(ctx context.Context, jobID string, sink RecordsSink) error {
+	l.shipMu.Lock()
+	defer l.shipMu.Unlock()
+	for {
+		batch, entries, err := l.stage(jobID)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := writeRecordsCSV(&buf, entries); err != nil {
+			return err
+		}
+		if err := sink.Put(ctx, batch.Object, buf.Bytes()); err != nil {
+			recordsUploadFailures.Add(sinkName(sink), 1)
+			return fmt.Errorf("failed to upload %s: %w", batch.Object, err)
+		}
+		recordsUploaded.Add(int64(len(entries)))
+		if _, err := l.append(LedgerEntry{
+			Kind:           ledgerShipped,
+			JobID:          jobID,
+			ShippedThrough: batch.ShippedThrough,
+			Object:         batch.Object,
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// stage returns the batch of the job in the outbox along with its entries, staging the entries
+// not yet shipped as a new batch if there is none. It returns no entries when there is nothing to ship.
+// The caller must hold l.shipMu.
+func (l *ledger) stage(jobID string) (LedgerEntry, []LedgerEntry, error) {
+	l.mu.Lock()
+	batch, staged := l.outbox[jobID]
+	unshipped := append([]LedgerEntry(nil), l.unshipped[jobID]...)
+	shippedBefore := l.shipped[jobID]
+	l.mu.Unlock()
+	if !staged {
+		if len(unshipped) == 0 {
+			return batch, nil, nil
+		}
+		object := fmt.Sprintf("%s.csv", jobID)
+		if shippedBefore {
+			object = fmt.Sprintf("%s-%d.csv", jobID, unshipped[0].Seq)
+		}
+		var err error
+		batch, err = l.append(LedgerEntry{
+			Kind:           ledgerStaged,
+			JobID:          jobID,
+			ShippedThrough: unshipped[len(unshipped)-1].Seq,
+			Object:         object,
+		})
+		if err != nil {
+			return batch, nil, err
+		}
+	}
+	var entries []LedgerEntry
+	for _, e := range unshipped {
+		if e.Seq <= batch.ShippedThrough {
+			entries = append(entries, e)
+		}
+	}
+	return batch, entries, nil
+}
+
+// outboxJobs returns the IDs of the jobs with a batch staged in the outbox.
+func (l *ledger) outboxJobs() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	jobs := make([]string, 0, len(l.outbox))
+	for jobID := range l.outbox {
+		jobs = append(jobs, jobID)
+	}
+	recordsOutbox.Set(int64(len(jobs)))
+	return jobs
+}
+
+// unshippedJobs returns the IDs of the jobs with shard entries not yet uploaded, staged or not.
+func (l *ledger) unshippedJobs() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	jobs := make([]string, 0, len(l.unshipped))
+	for jobID := range l.unshipped {
+		jobs = append(jobs, jobID)
+	}
+	return jobs
+}
+
+// entries returns the entries of the ledger for which match returns true, oldest first.
+// The ledger is read as of the call without holding its lock, so results keep being recorded meanwhile:
+// entries are only ever appended, so the file's first size bytes, and the first entries kept in memory, never change.
+func (l *ledger) entries(match func(*LedgerEntry) bool) ([]LedgerEntry, error) {
+	l.mu.Lock()
+	inFile, size, memory := l.file != nil, l.size, l.memory[:len(l.memory):len(l.memory)]
+	l.mu.Unlock()
+	var matched []LedgerEntry
+	if !inFile {
+		for i := range memory {
+			if match(&memory[i]) {
+				matched = append(matched, memory[i])
+			}
+		}
+		return matched, nil
+	}
+	_, err := l.scan(size, func(entry *LedgerEntry) {
+		if match(entry) {
+			matched = append(matched, *entry)
+		}
+	})
+	return matched, err
+}
+
+// close syncs the ledger to disk and closes its file.
+func (l *ledger) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return errors.Join(l.file.Sync(), l.file.Close())
+}
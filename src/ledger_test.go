@@ -0,0 +1,99 @@
+package tango
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenLedgerSkipsCorruptEntries checks that replaying the ledger skips a corrupt entry without discarding
+// the entries after it, and cuts off a truncated trailing entry so later entries are appended after the last complete one.
+func TestOpenLedgerSkipsCorruptEntries(t *testing.T) {
+	dir := t.TempDir()
+	contents := `{"seq":1,"kind":"shard","job_id":"job","shard":1}
+{"seq":2,"kind":"sha
+{"seq":3,"kind":"shard","job_id":"job","shard":2}
+{"seq":4,"kind":"shard","job_`
+	if err := os.WriteFile(filepath.Join(dir, ledgerFile), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := openLedger(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(l.unshipped["job"]); got != 2 {
+		t.Fatalf("replayed %d shard entries, want 2", got)
+	}
+	if err := l.recordShard(LedgerEntry{JobID: "job", Shard: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = openLedger(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	shards := l.unshipped["job"]
+	if len(shards) != 3 || shards[2].Shard != 3 || shards[2].Seq != 4 {
+		t.Fatalf("shard entries after reopening = %+v, want shards 1, 2 and 3", shards)
+	}
+}
+
+// TestLedgerEntriesWithoutLock checks that reading the ledger does not hold its lock, so results can be recorded
+// while it is read, and that the entries returned are those recorded when the read started.
+func TestLedgerEntriesWithoutLock(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		var l *ledger
+		var err error
+		if dir == "" {
+			l = newMemoryLedger()
+		} else if l, err = openLedger(dir, false); err != nil {
+			t.Fatal(err)
+		}
+		for shard := 1; shard <= 2; shard++ {
+			if err := l.recordShard(LedgerEntry{JobID: "job", Shard: shard}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := l.entries(func(e *LedgerEntry) bool {
+			if err := l.recordShard(LedgerEntry{JobID: "job", Shard: 10 + e.Shard}); err != nil {
+				t.Error(err)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("read %d entries of the ledger in %q, want the 2 recorded before reading", len(entries), dir)
+		}
+		l.close()
+	}
+}
+
+// TestRecordShardOncePerLease checks that a shard is recorded once per lease, so a device reporting it again
+// under the same lease is not billed twice, while a later lease of the shard is billed again.
+func TestRecordShardOncePerLease(t *testing.T) {
+	l := newMemoryLedger()
+	for _, entry := range []LedgerEntry{
+		{JobID: "job", Shard: 1, DeviceID: "device_a", LeaseDeadline: 100},
+		{JobID: "job", Shard: 1, DeviceID: "device_a", LeaseDeadline: 100},
+		{JobID: "job", Shard: 1, DeviceID: "device_a", LeaseDeadline: 200},
+		{JobID: "job", Shard: 1, DeviceID: "device_b", LeaseDeadline: 200},
+		{JobID: "job", Shard: 2, DeviceID: "device_a", LeaseDeadline: 100},
+	} {
+		if err := l.recordShard(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := l.entries(func(e *LedgerEntry) bool { return e.Kind == ledgerShard })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("%d shard entries recorded, want 4", len(entries))
+	}
+}
@@ -0,0 +1,261 @@
+package tango
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// memoryBudget tracks the bytes each job holds in memory against the server-wide budget.
+type memoryBudget struct {
+	mu    sync.Mutex
+	held  map[string]int64 // Bytes held in memory, keyed by job ID.
+	total int64            // Sum of all held bytes.
+}
+
+// newMemoryBudget creates an empty memory budget tracker.
+func newMemoryBudget() *memoryBudget {
+	return &memoryBudget{held: make(map[string]int64)}
+}
+
+// set records the number of bytes the job currently holds in memory.
+func (m *memoryBudget) set(jobID string, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total += bytes - m.held[jobID]
+	if bytes == 0 {
+		delete(m.held, jobID)
+		return
+	}
+	m.held[jobID] = bytes
+}
+
+// used returns the total number of bytes held by all jobs.
+func (m *memoryBudget) used() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// pressure returns the fraction of the configured budget currently in use.
+// It returns 0 when no budget is configured.
+func (m *memoryBudget) pressure() float64 {
+	budget := AppConfig.Memory.BudgetBytes
+	if budget <= 0 {
+		return 0
+	}
+	return float64(m.used()) / float64(budget)
+}
+
+// highWatermark returns the number of bytes above which the server spills cold job data
+// and refuses new submissions. It returns 0 when no budget is configured.
+func highWatermark() int64 {
+	budget := AppConfig.Memory.BudgetBytes
+	if budget <= 0 {
+		return 0
+	}
+	ratio := AppConfig.Memory.HighWatermark
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	return int64(float64(budget) * ratio)
+}
+
+// heldBytes returns the number of bytes of job data currently held in memory.
+// The caller must hold j.mu.
+func (j *Job) heldBytes() int64 {
+	held := int64(len(j.AData) + len(j.BData) + len(j.ScaleBytes) + len(j.FinalResult))
+	for _, result := range j.Results {
+		held += int64(len(result))
+	}
+	return held
+}
+
+// spillPath returns the path of the file holding the named part of a job's spilled data.
+// Job IDs are hex encoded so that consumer-chosen IDs cannot escape the spill directory.
+func spillPath(jobID, part string) string {
+	return filepath.Join(AppConfig.Memory.SpillDir, hex.EncodeToString([]byte(jobID))+"."+part)
+}
+
+// writeSpill writes a part of a job's data to the spill directory.
+func writeSpill(jobID, part string, data []byte) error {
+	if err := os.MkdirAll(AppConfig.Memory.SpillDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(spillPath(jobID, part), data, 0644)
+}
+
+// readSpill reads a part of a job's data back from the spill directory.
+func readSpill(jobID, part string) ([]byte, error) {
+	return os.ReadFile(spillPath(jobID, part))
+}
+
+// removeSpill deletes a part of a job's data from the spill directory, if present.
+func removeSpill(jobID, part string) {
+	if err := os.Remove(spillPath(jobID, part)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove spilled %s of job %s: %v", part, jobID, err)
+	}
+}
+
+// loadInputs returns the job's serialized matrices, loading them back from disk
+// and re-accounting their memory if they were spilled.
+func (s *server) loadInputs(j *Job) ([]byte, []byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.inputsSpilled {
+		a, err := readSpill(j.JobID, "a")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load spilled AData: %w", err)
+		}
+		b, err := readSpill(j.JobID, "b")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load spilled BData: %w", err)
+		}
+		j.AData, j.BData = a, b
+		j.inputsSpilled = false
+		removeSpill(j.JobID, "a")
+		removeSpill(j.JobID, "b")
+		s.trackMemory(j)
+	}
+	return j.AData, j.BData, nil
+}
+
+// finalResult returns the job's final result, reading it from disk if it was spilled.
+// A spilled result is served from disk without being loaded back into memory.
+// The caller must hold j.mu.
+func (j *Job) finalResult() ([]byte, error) {
+	if j.resultSpilled {
+		return readSpill(j.JobID, "final")
+	}
+	return j.FinalResult, nil
+}
+
+// spillInputs writes the job's matrices to disk and releases them from memory.
+// Jobs with shards in flight are skipped, since their inputs will be needed again shortly.
+// The caller must hold j.mu.
+func (j *Job) spillInputs() (bool, error) {
+	if j.inputsSpilled || len(j.PendingTasks) > 0 || len(j.AData)+len(j.BData) == 0 {
+		return false, nil
+	}
+	if err := writeSpill(j.JobID, "a", j.AData); err != nil {
+		return false, err
+	}
+	if err := writeSpill(j.JobID, "b", j.BData); err != nil {
+		removeSpill(j.JobID, "a")
+		return false, err
+	}
+	j.AData, j.BData = nil, nil
+	j.inputsSpilled = true
+	return true, nil
+}
+
+// spillResult writes the job's final result to disk and releases it from memory.
+// The caller must hold j.mu.
+func (j *Job) spillResult() (bool, error) {
+	if j.resultSpilled || len(j.FinalResult) == 0 {
+		return false, nil
+	}
+	if err := writeSpill(j.JobID, "final", j.FinalResult); err != nil {
+		return false, err
+	}
+	j.FinalResult = nil
+	j.resultSpilled = true
+	return true, nil
+}
+
+// releaseInputs drops the job's matrices and shard results once its final result has been assembled,
+// including any inputs spilled to disk.
+// The caller must hold j.mu.
+func (j *Job) releaseInputs() {
+	if j.inputsSpilled {
+		removeSpill(j.JobID, "a")
+		removeSpill(j.JobID, "b")
+		j.inputsSpilled = false
+	}
+	j.AData, j.BData = nil, nil
+	j.Results = make(map[int][]byte)
+}
+
+// trackMemory refreshes the memory accounted to the job.
+// The caller must hold job.mu.
+func (s *server) trackMemory(job *Job) {
+	s.memory.set(job.JobID, job.heldBytes())
+}
+
+// refreshMemory locks the job and refreshes the memory accounted to it.
+func (s *server) refreshMemory(job *Job) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	s.trackMemory(job)
+}
+
+// relieveMemoryPressure spills cold job data to disk until usage drops to the target number of bytes.
+// Final results of completed jobs are spilled first, oldest completion first, followed by the inputs
+// of queued jobs without shards in flight, starting from the back of the queue.
+func (s *server) relieveMemoryPressure(target int64) {
+	if s.memory.used() <= target {
+		return
+	}
+
+	queue := s.store.Queued()
+	queued := make(map[*Job]bool, len(queue))
+	for _, job := range queue {
+		queued[job] = true
+	}
+	var completed []*Job
+	for _, job := range s.store.List() {
+		if !queued[job] {
+			completed = append(completed, job)
+		}
+	}
+	cold := make([]*Job, 0, len(queue))
+	for i := len(queue) - 1; i >= 0; i-- {
+		cold = append(cold, queue[i])
+	}
+
+	sort.Slice(completed, func(i, j int) bool { return completed[i].CompletedAt < completed[j].CompletedAt })
+	spill := func(job *Job, spillFn func(*Job) (bool, error)) bool {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		spilled, err := spillFn(job)
+		if err != nil {
+			log.Printf("Failed to spill job %s: %v", job.JobID, err)
+		}
+		if spilled {
+			s.trackMemory(job)
+		}
+		return s.memory.used() <= target
+	}
+	for _, job := range completed {
+		if spill(job, (*Job).spillResult) {
+			return
+		}
+	}
+	for _, job := range cold {
+		if spill(job, (*Job).spillInputs) {
+			return
+		}
+	}
+}
+
+// checkMemory ensures there is room for a new submission of the given size.
+// If admitting it would push usage above the high watermark, cold job data is spilled first;
+// if usage would still exceed the high watermark, the submission is refused with a ResourceExhausted error.
+func (s *server) checkMemory(incoming int64) error {
+	limit := highWatermark()
+	if limit <= 0 || s.memory.used()+incoming <= limit {
+		return nil
+	}
+	s.relieveMemoryPressure(limit - incoming)
+	if used := s.memory.used(); used+incoming > limit {
+		return status.Errorf(codes.ResourceExhausted, "coordinator memory budget exhausted: %d of %d bytes in use, retry later", used, AppConfig.Memory.BudgetBytes)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package tango
+
+import (
+	"os"
+	"testing"
+
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMemoryBackpressure checks that a submission over the high watermark first spills the inputs of queued jobs
+// without shards in flight, that spilled inputs are loaded back when a shard is handed out, and that submissions
+// are refused with ResourceExhausted once nothing more can be spilled.
+func TestMemoryBackpressure(t *testing.T) {
+	saved := AppConfig.Memory
+	defer func() { AppConfig.Memory = saved }()
+	a, b := testMatrix(t, 4, 4), testMatrix(t, 4, 4)
+	size := int64(len(a) + len(b))
+	AppConfig.Memory = MemoryConfig{BudgetBytes: 2*size - 1, HighWatermark: 1, SpillDir: t.TempDir()}
+
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	ctx := testContext("alice", "")
+	submit := func(jobID string) (*pb.TaskResponse, error) {
+		return s.SubmitTask(ctx, &pb.TaskRequest{JobId: jobID, Operation: "matmul", AData: a, BData: b, RowSplits: 2, ColSplits: 2})
+	}
+	if reply, err := submit("first"); err != nil || !reply.Accepted {
+		t.Fatalf("SubmitTask first: %v %v", reply, err)
+	}
+	reply, err := submit("second")
+	if err != nil || !reply.Accepted {
+		t.Fatalf("SubmitTask second: %v %v", reply, err)
+	}
+	first, _ := s.store.Lookup("first")
+	if !first.inputsSpilled || first.AData != nil {
+		t.Fatal("inputs of the first job not spilled to admit the second")
+	}
+	if _, err := os.Stat(spillPath("first", "a")); err != nil {
+		t.Fatalf("spilled inputs not written: %v", err)
+	}
+	if used := s.memory.used(); used != size || reply.MemoryPressure != float64(size)/float64(2*size-1) {
+		t.Errorf("using %d bytes at pressure %v, want %d bytes of the second job", used, reply.MemoryPressure, size)
+	}
+
+	reg, err := s.RegisterDevice(ctx, &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9})
+	if err != nil || !reg.Accepted {
+		t.Fatalf("RegisterDevice: %v %v", reg, err)
+	}
+	assignment, err := s.FetchTask(testContext("alice", reg.DeviceId), &pb.DeviceRequest{DeviceId: reg.DeviceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignment.JobId != "first" || len(assignment.AData) == 0 || first.inputsSpilled {
+		t.Fatalf("assigned a shard of %s with %d bytes of A, want the first job loaded back", assignment.JobId, len(assignment.AData))
+	}
+	if _, err := os.Stat(spillPath("first", "a")); !os.IsNotExist(err) {
+		t.Errorf("spill file kept after the inputs were loaded back: %v", err)
+	}
+
+	// The second job is spilled again, but the first has a shard in flight and stays, leaving no room.
+	if _, err := submit("third"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("SubmitTask over the budget = %v, want ResourceExhausted", err)
+	}
+	if second, _ := s.store.Lookup("second"); !second.inputsSpilled {
+		t.Error("inputs of the second job not spilled before refusing the third")
+	}
+}
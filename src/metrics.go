@@ -0,0 +1,79 @@
+package tango
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RPC metrics, published through expvar under /debug/vars when the metrics endpoint is enabled.
+var (
+	rpcCalls    = expvar.NewMap("tango_rpc_calls")                // Completed RPCs, keyed by "method:code".
+	rpcLatency  = expvar.NewMap("tango_rpc_latency_microseconds") // Cumulative time spent serving RPCs, keyed by method.
+	rpcInFlight = expvar.NewInt("tango_rpc_in_flight")            // RPCs currently being served.
+)
+
+// recordRPC records a completed RPC in the metrics.
+func recordRPC(fullMethod string, err error, elapsed time.Duration) {
+	method := path.Base(fullMethod)
+	rpcCalls.Add(method+":"+status.Code(err).String(), 1)
+	rpcLatency.Add(method, elapsed.Microseconds())
+}
+
+// logRPC logs a completed RPC. Every RPC is logged at the DEBUG level; otherwise only server faults are,
+// since devices polling for work routinely fail FetchTask when no task is available.
+func logRPC(fullMethod string, err error, elapsed time.Duration) {
+	code := status.Code(err)
+	if !strings.EqualFold(AppConfig.Logging.Level, "DEBUG") && code != codes.Internal && code != codes.DataLoss {
+		return
+	}
+	if err != nil {
+		log.Printf("%s failed with %s after %v: %v", fullMethod, code, elapsed, err)
+	} else {
+		log.Printf("%s served in %v", fullMethod, elapsed)
+	}
+}
+
+// MetricsInterceptor is a gRPC unary interceptor that counts RPCs by method and status code,
+// and accumulates the time spent serving them.
+func MetricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	rpcInFlight.Add(1)
+	defer rpcInFlight.Add(-1)
+	start := time.Now()
+	reply, err := handler(ctx, req)
+	recordRPC(info.FullMethod, err, time.Since(start))
+	return reply, err
+}
+
+// StreamMetricsInterceptor is the streaming counterpart of MetricsInterceptor. A stream is counted once it ends.
+func StreamMetricsInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	rpcInFlight.Add(1)
+	defer rpcInFlight.Add(-1)
+	start := time.Now()
+	err := handler(srv, ss)
+	recordRPC(info.FullMethod, err, time.Since(start))
+	return err
+}
+
+// LoggingInterceptor is a gRPC unary interceptor that logs RPCs along with how long they took.
+func LoggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	reply, err := handler(ctx, req)
+	logRPC(info.FullMethod, err, time.Since(start))
+	return reply, err
+}
+
+// StreamLoggingInterceptor is the streaming counterpart of LoggingInterceptor. A stream is logged once it ends.
+func StreamLoggingInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logRPC(info.FullMethod, err, time.Since(start))
+	return err
+}
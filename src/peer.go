@@ -0,0 +1,283 @@
+package tango
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// forwardMessageLimit matches the message size limit of the gRPC server, so forwarded jobs are not truncated.
+const forwardMessageLimit = 100 * 512 * 512
+
+// tokenHeader is the metadata key carrying the caller's JWT.
+const tokenHeader = "tango-token"
+
+// Metadata keys proving a request was forwarded by another coordinator, when peers are not authenticated by mutual TLS.
+const (
+	peerTimestampHeader = "tango-peer-timestamp" // Unix time (seconds) the request was signed at.
+	peerSignatureHeader = "tango-peer-signature" // Hex HMAC-SHA256 of the request's method, timestamp, message and peer headers.
+)
+
+// peerSignatureMaxAge bounds how far the timestamp of a peer signature may be from the receiving coordinator's clock.
+const peerSignatureMaxAge = time.Minute
+
+// peerHeaders are the metadata keys only other coordinators may set. They are stripped from
+// every request that is not authenticated as coming from a peer.
+var peerHeaders = []string{forwardedHeader, routedHeader, identityHeader, peerTimestampHeader, peerSignatureHeader}
+
+// signedPeerHeaders are the metadata keys covered by a peer signature.
+var signedPeerHeaders = []string{tokenHeader, forwardedHeader, routedHeader, identityHeader}
+
+// peerConns caches gRPC connections to other coordinators.
+type peerConns struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn // Connections keyed by RPC address.
+}
+
+// dial returns a cached connection to the coordinator at the given RPC address.
+// Connections use TLS when the server itself serves TLS.
+func (pc *peerConns) dial(addr string) (*grpc.ClientConn, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if conn, exists := pc.conns[addr]; exists {
+		return conn, nil
+	}
+	creds := insecure.NewCredentials()
+	if r := activeTLS.Load(); r != nil {
+		creds = credentials.NewTLS(r.clientConfig())
+	}
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(forwardMessageLimit), grpc.MaxCallSendMsgSize(forwardMessageLimit)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if pc.conns == nil {
+		pc.conns = make(map[string]*grpc.ClientConn)
+	}
+	pc.conns[addr] = conn
+	return conn, nil
+}
+
+// close closes every cached connection.
+func (pc *peerConns) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for addr, conn := range pc.conns {
+		conn.Close()
+		delete(pc.conns, addr)
+	}
+}
+
+// forwardCall invokes the given gRPC method on another coordinator and returns its reply.
+// The caller's token is forwarded along with the given marker header, so the receiving coordinator
+// authenticates the original caller and knows the request has already been routed once.
+// Markers set by earlier hops are kept, so a request routed to a federation member is still
+// recognized as routed after a follower of that member forwards it to its leader.
+// The client certificate identity of the original caller is forwarded as well. Unless peers are authenticated
+// by mutual TLS, the request is signed with the peer secret.
+func (pc *peerConns) forwardCall(ctx context.Context, addr, fullMethod string, req interface{}, header, value string) (proto.Message, error) {
+	reply, err := newReply(fullMethod)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pc.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	outgoing := metadata.Pairs(header, value)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range []string{tokenHeader, forwardedHeader, routedHeader} {
+		if key != header {
+			outgoing.Append(key, md.Get(key)...)
+		}
+	}
+	if identity, ok := requestCertIdentity(ctx); ok {
+		outgoing.Set(identityHeader, identity)
+	}
+	if !peerTLS() {
+		secret, err := peerSecret.get()
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "cannot sign request to %s: %v", addr, err)
+		}
+		digest, err := messageDigest(req)
+		if err != nil {
+			return nil, err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		outgoing.Set(peerTimestampHeader, timestamp)
+		outgoing.Set(peerSignatureHeader, hex.EncodeToString(peerSignature(secret, fullMethod, timestamp, digest, outgoing)))
+	}
+	if err := conn.Invoke(metadata.NewOutgoingContext(ctx, outgoing), fullMethod, req, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// peerTLS reports whether other coordinators are authenticated by mutual TLS, with their client certificates
+// named in tls.peer_names. Otherwise they authenticate by signing their requests with the peer secret.
+func peerTLS() bool {
+	return AppConfig.TLS.Enabled && AppConfig.TLS.ClientCA != "" && len(AppConfig.TLS.PeerNames) > 0
+}
+
+// checkPeerAuthentication returns an error unless other coordinators can be authenticated,
+// as federation and cluster mode require: either by mutual TLS, or with the peer secret.
+func checkPeerAuthentication() error {
+	if peerTLS() {
+		return nil
+	}
+	if _, err := peerSecret.get(); err != nil {
+		return fmt.Errorf("coordinators must be authenticated by mutual TLS with tls.peer_names or by the %s secret: %v", secretPeer, err)
+	}
+	return nil
+}
+
+// messageDigest returns the SHA-256 of the request message in its deterministic wire encoding, as covered by peer signatures,
+// so a signed request cannot be replayed with another message. Requests without a message, as seen by stream interceptors,
+// digest as an empty message.
+func messageDigest(req interface{}) ([]byte, error) {
+	var data []byte
+	if msg, ok := req.(proto.Message); ok {
+		var err error
+		if data, err = (proto.MarshalOptions{Deterministic: true}).Marshal(msg); err != nil {
+			return nil, err
+		}
+	}
+	digest := sha256.Sum256(data)
+	return digest[:], nil
+}
+
+// peerSignature returns the HMAC-SHA256 of the method, timestamp, message digest and peer headers of a request,
+// keyed with the peer secret.
+func peerSignature(secret []byte, method, timestamp string, digest []byte, md metadata.MD) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%x\n", method, timestamp, digest)
+	for _, key := range signedPeerHeaders {
+		fmt.Fprintf(mac, "%s=%q\n", key, md.Get(key))
+	}
+	return mac.Sum(nil)
+}
+
+// fromPeer reports whether the request was made by another coordinator: over mutual TLS with a client certificate
+// named in tls.peer_names when so configured, and otherwise with a recent signature by the peer secret
+// covering the request message.
+func fromPeer(ctx context.Context, method string, req interface{}, md metadata.MD) bool {
+	if peerTLS() {
+		name, ok := clientCertIdentity(ctx)
+		return ok && slices.Contains(AppConfig.TLS.PeerNames, name)
+	}
+	timestamps, signatures := md.Get(peerTimestampHeader), md.Get(peerSignatureHeader)
+	if len(timestamps) != 1 || len(signatures) != 1 {
+		return false
+	}
+	signedAt, err := strconv.ParseInt(timestamps[0], 10, 64)
+	if err != nil || time.Since(time.Unix(signedAt, 0)).Abs() > peerSignatureMaxAge {
+		return false
+	}
+	signature, err := hex.DecodeString(signatures[0])
+	if err != nil {
+		return false
+	}
+	digest, err := messageDigest(req)
+	if err != nil {
+		return false
+	}
+	secrets, err := peerSecret.values(time.Now())
+	if err != nil {
+		return false
+	}
+	for _, secret := range secrets {
+		if hmac.Equal(signature, peerSignature(secret, method, timestamps[0], digest, md)) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPeerHeaders removes the peer headers from the request's metadata unless it was made by another coordinator,
+// so callers cannot pass their requests off as forwarded or routed, nor claim another client certificate identity.
+// Requests made by another coordinator are marked as such in the returned context.
+func stripPeerHeaders(ctx context.Context, method string, req interface{}) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || !slices.ContainsFunc(peerHeaders, func(key string) bool { return len(md.Get(key)) > 0 }) {
+		return ctx
+	}
+	if fromPeer(ctx, method, req, md) {
+		return context.WithValue(ctx, "peer", true)
+	}
+	md = md.Copy()
+	for _, key := range peerHeaders {
+		md.Delete(key)
+	}
+	log.Printf("Stripped coordinator headers from a request to %s not made by a coordinator", method)
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+// peerFromContext reports whether AuthenticatePeers authenticated the request as made by another coordinator.
+func peerFromContext(ctx context.Context) bool {
+	peer, _ := ctx.Value("peer").(bool)
+	return peer
+}
+
+// AuthenticatePeers is a gRPC unary interceptor stripping the headers only other coordinators may set
+// from requests not authenticated as coming from one. It must run before any interceptor reading them.
+func AuthenticatePeers(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(stripPeerHeaders(ctx, info.FullMethod, req), req)
+}
+
+// StreamAuthenticatePeers is the streaming counterpart of AuthenticatePeers. Streams are never forwarded, and their
+// messages are not received yet when it runs, so their signatures can only match an empty message.
+func StreamAuthenticatePeers(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &contextStream{ServerStream: ss, ctx: stripPeerHeaders(ss.Context(), info.FullMethod, nil)})
+}
+
+// hasHeader reports whether the incoming request carries the given metadata key.
+func hasHeader(ctx context.Context, header string) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return len(md.Get(header)) > 0
+}
+
+// newReply returns an empty response message for the given fully qualified gRPC method,
+// looked up in the registered protobuf descriptors.
+func newReply(fullMethod string) (proto.Message, error) {
+	service, method, found := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !found {
+		return nil, fmt.Errorf("malformed method name %q", fullMethod)
+	}
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, err
+	}
+	sd, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", service)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil, fmt.Errorf("unknown method %s", fullMethod)
+	}
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(md.Output().FullName())
+	if err != nil {
+		return nil, err
+	}
+	return mt.New().Interface(), nil
+}
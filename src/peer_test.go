@@ -0,0 +1,59 @@
+package tango
+
+import (
+	"context"
+	"encoding/hex"
+	"strconv"
+	pb "tango/tango/src/protobuff"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// TestStripPeerHeaders checks that the headers only coordinators may set are kept on requests signed
+// with the peer secret, and stripped from unsigned requests, from requests whose signature does not match,
+// and from signed requests replayed with another message.
+func TestStripPeerHeaders(t *testing.T) {
+	const method = "/tango.TangoService/SubmitTask"
+	secret, err := peerSecret.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &pb.TaskRequest{JobId: "job", Priority: 1}
+	signed := func(md metadata.MD, signedAt time.Time) metadata.MD {
+		digest, err := messageDigest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+		md.Set(peerTimestampHeader, timestamp)
+		md.Set(peerSignatureHeader, hex.EncodeToString(peerSignature(secret, method, timestamp, digest, md)))
+		return md
+	}
+	tampered := signed(metadata.Pairs(tokenHeader, "token", routedHeader, "coordinator-a"), time.Now())
+	tampered.Set(identityHeader, "someone-else")
+	tests := []struct {
+		name string
+		md   metadata.MD
+		req  *pb.TaskRequest
+		kept bool
+	}{
+		{"signed", signed(metadata.Pairs(tokenHeader, "token", routedHeader, "coordinator-a"), time.Now()), req, true},
+		{"unsigned", metadata.Pairs(tokenHeader, "token", routedHeader, "coordinator-a"), req, false},
+		{"tampered", tampered, req, false},
+		{"stale", signed(metadata.Pairs(tokenHeader, "token", routedHeader, "coordinator-a"), time.Now().Add(-time.Hour)), req, false},
+		{"other message", signed(metadata.Pairs(tokenHeader, "token", routedHeader, "coordinator-a"), time.Now()), &pb.TaskRequest{JobId: "job", Priority: 9}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := stripPeerHeaders(metadata.NewIncomingContext(context.Background(), tt.md), method, tt.req)
+			if kept := hasHeader(ctx, routedHeader); kept != tt.kept {
+				t.Errorf("routed header kept = %v, want %v", kept, tt.kept)
+			}
+			if !hasHeader(ctx, tokenHeader) {
+				t.Error("token header was stripped")
+			}
+		})
+	}
+}
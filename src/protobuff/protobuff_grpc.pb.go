@@ -19,10 +19,18 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	TangoService_SubmitTask_FullMethodName   = "/protobuff.TangoService/SubmitTask"
-	TangoService_FetchTask_FullMethodName    = "/protobuff.TangoService/FetchTask"
-	TangoService_ReportResult_FullMethodName = "/protobuff.TangoService/ReportResult"
-	TangoService_GetJobStatus_FullMethodName = "/protobuff.TangoService/GetJobStatus"
+	TangoService_SubmitTask_FullMethodName       = "/protobuff.TangoService/SubmitTask"
+	TangoService_FetchTask_FullMethodName        = "/protobuff.TangoService/FetchTask"
+	TangoService_ReportResult_FullMethodName     = "/protobuff.TangoService/ReportResult"
+	TangoService_GetJobStatus_FullMethodName     = "/protobuff.TangoService/GetJobStatus"
+	TangoService_RegisterDevice_FullMethodName   = "/protobuff.TangoService/RegisterDevice"
+	TangoService_GetQueueStats_FullMethodName    = "/protobuff.TangoService/GetQueueStats"
+	TangoService_GetQuota_FullMethodName         = "/protobuff.TangoService/GetQuota"
+	TangoService_RevokeToken_FullMethodName      = "/protobuff.TangoService/RevokeToken"
+	TangoService_GetTokenSessions_FullMethodName = "/protobuff.TangoService/GetTokenSessions"
+	TangoService_IssueToken_FullMethodName       = "/protobuff.TangoService/IssueToken"
+	TangoService_RefreshToken_FullMethodName     = "/protobuff.TangoService/RefreshToken"
+	TangoService_GetBillingReport_FullMethodName = "/protobuff.TangoService/GetBillingReport"
 )
 
 // TangoServiceClient is the client API for TangoService service.
@@ -33,6 +41,14 @@ type TangoServiceClient interface {
 	FetchTask(ctx context.Context, in *DeviceRequest, opts ...grpc.CallOption) (*TaskAssignment, error)
 	ReportResult(ctx context.Context, in *TaskResult, opts ...grpc.CallOption) (*ResultResponse, error)
 	GetJobStatus(ctx context.Context, in *JobStatusRequest, opts ...grpc.CallOption) (*JobStatusReply, error)
+	RegisterDevice(ctx context.Context, in *DeviceRegistration, opts ...grpc.CallOption) (*DeviceRegistrationReply, error)
+	GetQueueStats(ctx context.Context, in *QueueStatsRequest, opts ...grpc.CallOption) (*QueueStatsReply, error)
+	GetQuota(ctx context.Context, in *QuotaRequest, opts ...grpc.CallOption) (*QuotaReply, error)
+	RevokeToken(ctx context.Context, in *RevocationRequest, opts ...grpc.CallOption) (*RevocationReply, error)
+	GetTokenSessions(ctx context.Context, in *TokenSessionsRequest, opts ...grpc.CallOption) (*TokenSessionsReply, error)
+	IssueToken(ctx context.Context, in *TokenRequest, opts ...grpc.CallOption) (*TokenReply, error)
+	RefreshToken(ctx context.Context, in *RefreshRequest, opts ...grpc.CallOption) (*TokenReply, error)
+	GetBillingReport(ctx context.Context, in *BillingReportRequest, opts ...grpc.CallOption) (*BillingReport, error)
 }
 
 type tangoServiceClient struct {
@@ -83,6 +99,86 @@ func (c *tangoServiceClient) GetJobStatus(ctx context.Context, in *JobStatusRequ
 	return out, nil
 }
 
+func (c *tangoServiceClient) RegisterDevice(ctx context.Context, in *DeviceRegistration, opts ...grpc.CallOption) (*DeviceRegistrationReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeviceRegistrationReply)
+	err := c.cc.Invoke(ctx, TangoService_RegisterDevice_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tangoServiceClient) GetQueueStats(ctx context.Context, in *QueueStatsRequest, opts ...grpc.CallOption) (*QueueStatsReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QueueStatsReply)
+	err := c.cc.Invoke(ctx, TangoService_GetQueueStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tangoServiceClient) GetQuota(ctx context.Context, in *QuotaRequest, opts ...grpc.CallOption) (*QuotaReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QuotaReply)
+	err := c.cc.Invoke(ctx, TangoService_GetQuota_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tangoServiceClient) RevokeToken(ctx context.Context, in *RevocationRequest, opts ...grpc.CallOption) (*RevocationReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RevocationReply)
+	err := c.cc.Invoke(ctx, TangoService_RevokeToken_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tangoServiceClient) GetTokenSessions(ctx context.Context, in *TokenSessionsRequest, opts ...grpc.CallOption) (*TokenSessionsReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TokenSessionsReply)
+	err := c.cc.Invoke(ctx, TangoService_GetTokenSessions_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tangoServiceClient) IssueToken(ctx context.Context, in *TokenRequest, opts ...grpc.CallOption) (*TokenReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TokenReply)
+	err := c.cc.Invoke(ctx, TangoService_IssueToken_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tangoServiceClient) RefreshToken(ctx context.Context, in *RefreshRequest, opts ...grpc.CallOption) (*TokenReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TokenReply)
+	err := c.cc.Invoke(ctx, TangoService_RefreshToken_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tangoServiceClient) GetBillingReport(ctx context.Context, in *BillingReportRequest, opts ...grpc.CallOption) (*BillingReport, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BillingReport)
+	err := c.cc.Invoke(ctx, TangoService_GetBillingReport_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TangoServiceServer is the server API for TangoService service.
 // All implementations must embed UnimplementedTangoServiceServer
 // for forward compatibility.
@@ -91,6 +187,14 @@ type TangoServiceServer interface {
 	FetchTask(context.Context, *DeviceRequest) (*TaskAssignment, error)
 	ReportResult(context.Context, *TaskResult) (*ResultResponse, error)
 	GetJobStatus(context.Context, *JobStatusRequest) (*JobStatusReply, error)
+	RegisterDevice(context.Context, *DeviceRegistration) (*DeviceRegistrationReply, error)
+	GetQueueStats(context.Context, *QueueStatsRequest) (*QueueStatsReply, error)
+	GetQuota(context.Context, *QuotaRequest) (*QuotaReply, error)
+	RevokeToken(context.Context, *RevocationRequest) (*RevocationReply, error)
+	GetTokenSessions(context.Context, *TokenSessionsRequest) (*TokenSessionsReply, error)
+	IssueToken(context.Context, *TokenRequest) (*TokenReply, error)
+	RefreshToken(context.Context, *RefreshRequest) (*TokenReply, error)
+	GetBillingReport(context.Context, *BillingReportRequest) (*BillingReport, error)
 	mustEmbedUnimplementedTangoServiceServer()
 }
 
@@ -113,6 +217,30 @@ func (UnimplementedTangoServiceServer) ReportResult(context.Context, *TaskResult
 func (UnimplementedTangoServiceServer) GetJobStatus(context.Context, *JobStatusRequest) (*JobStatusReply, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetJobStatus not implemented")
 }
+func (UnimplementedTangoServiceServer) RegisterDevice(context.Context, *DeviceRegistration) (*DeviceRegistrationReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterDevice not implemented")
+}
+func (UnimplementedTangoServiceServer) GetQueueStats(context.Context, *QueueStatsRequest) (*QueueStatsReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetQueueStats not implemented")
+}
+func (UnimplementedTangoServiceServer) GetQuota(context.Context, *QuotaRequest) (*QuotaReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetQuota not implemented")
+}
+func (UnimplementedTangoServiceServer) RevokeToken(context.Context, *RevocationRequest) (*RevocationReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeToken not implemented")
+}
+func (UnimplementedTangoServiceServer) GetTokenSessions(context.Context, *TokenSessionsRequest) (*TokenSessionsReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTokenSessions not implemented")
+}
+func (UnimplementedTangoServiceServer) IssueToken(context.Context, *TokenRequest) (*TokenReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IssueToken not implemented")
+}
+func (UnimplementedTangoServiceServer) RefreshToken(context.Context, *RefreshRequest) (*TokenReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RefreshToken not implemented")
+}
+func (UnimplementedTangoServiceServer) GetBillingReport(context.Context, *BillingReportRequest) (*BillingReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBillingReport not implemented")
+}
 func (UnimplementedTangoServiceServer) mustEmbedUnimplementedTangoServiceServer() {}
 func (UnimplementedTangoServiceServer) testEmbeddedByValue()                      {}
 
@@ -206,6 +334,150 @@ func _TangoService_GetJobStatus_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _TangoService_RegisterDevice_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeviceRegistration)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TangoServiceServer).RegisterDevice(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TangoService_RegisterDevice_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TangoServiceServer).RegisterDevice(ctx, req.(*DeviceRegistration))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TangoService_GetQueueStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueueStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TangoServiceServer).GetQueueStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TangoService_GetQueueStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TangoServiceServer).GetQueueStats(ctx, req.(*QueueStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TangoService_GetQuota_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QuotaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TangoServiceServer).GetQuota(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TangoService_GetQuota_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TangoServiceServer).GetQuota(ctx, req.(*QuotaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TangoService_RevokeToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevocationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TangoServiceServer).RevokeToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TangoService_RevokeToken_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TangoServiceServer).RevokeToken(ctx, req.(*RevocationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TangoService_GetTokenSessions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TokenSessionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TangoServiceServer).GetTokenSessions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TangoService_GetTokenSessions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TangoServiceServer).GetTokenSessions(ctx, req.(*TokenSessionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TangoService_IssueToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TangoServiceServer).IssueToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TangoService_IssueToken_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TangoServiceServer).IssueToken(ctx, req.(*TokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TangoService_RefreshToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefreshRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TangoServiceServer).RefreshToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TangoService_RefreshToken_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TangoServiceServer).RefreshToken(ctx, req.(*RefreshRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TangoService_GetBillingReport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BillingReportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TangoServiceServer).GetBillingReport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TangoService_GetBillingReport_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TangoServiceServer).GetBillingReport(ctx, req.(*BillingReportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // TangoService_ServiceDesc is the grpc.ServiceDesc for TangoService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -229,6 +501,38 @@ var TangoService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetJobStatus",
 			Handler:    _TangoService_GetJobStatus_Handler,
 		},
+		{
+			MethodName: "RegisterDevice",
+			Handler:    _TangoService_RegisterDevice_Handler,
+		},
+		{
+			MethodName: "GetQueueStats",
+			Handler:    _TangoService_GetQueueStats_Handler,
+		},
+		{
+			MethodName: "GetQuota",
+			Handler:    _TangoService_GetQuota_Handler,
+		},
+		{
+			MethodName: "RevokeToken",
+			Handler:    _TangoService_RevokeToken_Handler,
+		},
+		{
+			MethodName: "GetTokenSessions",
+			Handler:    _TangoService_GetTokenSessions_Handler,
+		},
+		{
+			MethodName: "IssueToken",
+			Handler:    _TangoService_IssueToken_Handler,
+		},
+		{
+			MethodName: "RefreshToken",
+			Handler:    _TangoService_RefreshToken_Handler,
+		},
+		{
+			MethodName: "GetBillingReport",
+			Handler:    _TangoService_GetBillingReport_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "protobuff.proto",
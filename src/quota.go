@@ -0,0 +1,149 @@
+package tango
+
+import (
+	"context"
+	"sync"
+	pb "tango/tango/src/protobuff"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// quotaTracker tracks the FLOPs each consumer has submitted during the current UTC day.
+// Concurrent jobs and queued bytes are derived from the job queue itself, so only the
+// daily FLOP counters need to be kept here.
+type quotaTracker struct {
+	mu    sync.Mutex
+	day   string           // UTC day (YYYY-MM-DD) the counters belong to.
+	flops map[string]int64 // FLOPs submitted today, keyed by consumer ID.
+}
+
+// newQuotaTracker creates an empty quota tracker.
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{flops: make(map[string]int64)}
+}
+
+// quotaLimits returns the quota limits that apply to the consumer.
+// Consumers without an override use the default limits.
+func quotaLimits(consumerID string) QuotaLimits {
+	for _, cq := range AppConfig.Quotas.Consumers {
+		if cq.ConsumerID == consumerID {
+			return cq.QuotaLimits
+		}
+	}
+	return AppConfig.Quotas.Default
+}
+
+// quotaDay returns the UTC day (YYYY-MM-DD) the time falls in.
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// rollover resets the daily counters when the UTC day changes.
+// The caller must hold q.mu.
+func (q *quotaTracker) rollover(now time.Time) {
+	day := quotaDay(now)
+	if q.day != day {
+		q.day = day
+		q.flops = make(map[string]int64)
+	}
+}
+
+// flopsToday returns the FLOPs the consumer has submitted during the current UTC day.
+func (q *quotaTracker) flopsToday(consumerID string, now time.Time) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(now)
+	return q.flops[consumerID]
+}
+
+// addFlops charges the given FLOPs to the consumer's daily counter, and returns the UTC day they were charged to.
+func (q *quotaTracker) addFlops(consumerID string, flops int64, now time.Time) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(now)
+	q.flops[consumerID] += flops
+	return q.day
+}
+
+// refund takes FLOPs charged to the consumer's counter of the given UTC day back off it.
+// Once the day is over its counters are gone, so a refund arriving after the rollover is dropped
+// rather than taken off the next day's counter.
+func (q *quotaTracker) refund(consumerID string, flops int64, day string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.day == day {
+		q.flops[consumerID] -= flops
+	}
+}
+
+// restore rebuilds the daily counters from the stored jobs submitted during the current UTC day,
+// as after a restart or a cluster failover, when the counters of the previous coordinator are lost.
+func (q *quotaTracker) restore(jobs []*Job, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.day = quotaDay(now)
+	q.flops = make(map[string]int64)
+	for _, job := range jobs {
+		if quotaDay(time.Unix(0, job.SubmittedAt)) == q.day {
+			q.flops[job.ConsumerID] += job.estimatedFlops()
+		}
+	}
+}
+
+// consumerUsage returns the number of queued jobs and the queued input bytes of the consumer.
+func (s *server) consumerUsage(consumerID string) (int32, int64) {
+	var jobs int32
+	var queuedBytes int64
+	for _, job := range s.store.Queued() {
+		if job.ConsumerID != consumerID {
+			continue
+		}
+		jobs++
+		queuedBytes += job.InputBytes
+	}
+	return jobs, queuedBytes
+}
+
+// admit checks whether the job fits within its consumer's quota and, if so,
+// charges its FLOPs to the consumer's daily counter and returns the UTC day they were charged to,
+// for refunds. It returns a ResourceExhausted status error naming the exceeded limit otherwise.
+// The caller must hold s.submitMu, so that concurrent submissions cannot both fit the same headroom.
+func (s *server) admit(job *Job) (string, error) {
+	limits := quotaLimits(job.ConsumerID)
+	jobs, queuedBytes := s.consumerUsage(job.ConsumerID)
+	if limits.MaxConcurrentJobs > 0 && jobs+1 > limits.MaxConcurrentJobs {
+		return "", status.Errorf(codes.ResourceExhausted, "concurrent job quota exceeded: %d of %d jobs in progress", jobs, limits.MaxConcurrentJobs)
+	}
+	if limits.MaxQueuedBytes > 0 && queuedBytes+job.InputBytes > limits.MaxQueuedBytes {
+		return "", status.Errorf(codes.ResourceExhausted, "queued bytes quota exceeded: %d of %d bytes queued", queuedBytes, limits.MaxQueuedBytes)
+	}
+	now := time.Now()
+	flops := job.estimatedFlops()
+	if limits.MaxFlopsPerDay > 0 {
+		if used := s.quotas.flopsToday(job.ConsumerID, now); used+flops > limits.MaxFlopsPerDay {
+			return "", status.Errorf(codes.ResourceExhausted, "daily FLOP quota exceeded: %d of %d FLOPs used today", used, limits.MaxFlopsPerDay)
+		}
+	}
+	return s.quotas.addFlops(job.ConsumerID, flops, now), nil
+}
+
+// GetQuota reports the caller's quota limits alongside its current usage.
+// A zero limit means the limit is not enforced.
+func (s *server) GetQuota(ctx context.Context, req *pb.QuotaRequest) (*pb.QuotaReply, error) {
+	consumerID := consumerIDFromContext(ctx)
+	limits := quotaLimits(consumerID)
+
+	jobs, queuedBytes := s.consumerUsage(consumerID)
+
+	return &pb.QuotaReply{
+		ConsumerId:        consumerID,
+		MaxConcurrentJobs: limits.MaxConcurrentJobs,
+		ActiveJobs:        jobs,
+		MaxQueuedBytes:    limits.MaxQueuedBytes,
+		QueuedBytes:       queuedBytes,
+		MaxFlopsPerDay:    limits.MaxFlopsPerDay,
+		FlopsToday:        s.quotas.flopsToday(consumerID, time.Now()),
+	}, nil
+}
@@ -0,0 +1,100 @@
+package tango
+
+import (
+	"testing"
+	"time"
+
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestQuotaTrackerRestore checks that the daily FLOP counters are rebuilt from the jobs submitted during the current UTC day only.
+func TestQuotaTrackerRestore(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	jobs := []*Job{
+		{ConsumerID: "consumer", SubmittedAt: now.Add(-time.Hour).UnixNano(), m: 2, n: 2, d: 2},
+		{ConsumerID: "consumer", SubmittedAt: now.Add(-13 * time.Hour).UnixNano(), m: 2, n: 2, d: 2},
+		{ConsumerID: "other", SubmittedAt: now.UnixNano(), m: 1, n: 1, d: 1},
+	}
+	q := newQuotaTracker()
+	q.addFlops("consumer", 1000, now)
+	q.restore(jobs, now)
+	if got := q.flopsToday("consumer", now); got != 16 {
+		t.Errorf("FLOPs of consumer today = %d, want 16", got)
+	}
+	if got := q.flopsToday("other", now); got != 2 {
+		t.Errorf("FLOPs of other today = %d, want 2", got)
+	}
+}
+
+// TestQuotaTrackerRefund checks that refunds are taken off the counter of the day the FLOPs were charged to only.
+func TestQuotaTrackerRefund(t *testing.T) {
+	today := time.Date(2026, 10, 19, 23, 59, 59, 0, time.UTC)
+	tomorrow := today.Add(time.Second)
+	q := newQuotaTracker()
+	day := q.addFlops("consumer", 10, today)
+	q.refund("consumer", 4, day)
+	if got := q.flopsToday("consumer", today); got != 6 {
+		t.Errorf("FLOPs after a same-day refund = %d, want 6", got)
+	}
+	q.addFlops("consumer", 5, tomorrow)
+	q.refund("consumer", 6, day)
+	if got := q.flopsToday("consumer", tomorrow); got != 5 {
+		t.Errorf("FLOPs after refunding the previous day = %d, want the 5 charged today", got)
+	}
+}
+
+// TestSubmitTaskQuotas checks that a submission is refused with ResourceExhausted, without being charged,
+// once it would exceed any limit of its consumer's quota, and that overrides apply to their consumer only.
+func TestSubmitTaskQuotas(t *testing.T) {
+	saved := AppConfig.Quotas
+	defer func() { AppConfig.Quotas = saved }()
+	a, b := testMatrix(t, 2, 2), testMatrix(t, 2, 2)
+	size := int64(len(a) + len(b))
+	const flops = 2 * 2 * 2 * 2
+	tests := []struct {
+		name     string
+		quotas   QuotaConfig
+		accepted bool
+	}{
+		{"no limits", QuotaConfig{}, true},
+		{"concurrent jobs", QuotaConfig{Default: QuotaLimits{MaxConcurrentJobs: 1}}, false},
+		{"concurrent jobs within", QuotaConfig{Default: QuotaLimits{MaxConcurrentJobs: 2}}, true},
+		{"queued bytes", QuotaConfig{Default: QuotaLimits{MaxQueuedBytes: 2*size - 1}}, false},
+		{"queued bytes within", QuotaConfig{Default: QuotaLimits{MaxQueuedBytes: 2 * size}}, true},
+		{"daily FLOPs", QuotaConfig{Default: QuotaLimits{MaxFlopsPerDay: 2*flops - 1}}, false},
+		{"daily FLOPs within", QuotaConfig{Default: QuotaLimits{MaxFlopsPerDay: 2 * flops}}, true},
+		{"override of the consumer", QuotaConfig{Consumers: []ConsumerQuota{{ConsumerID: "alice", QuotaLimits: QuotaLimits{MaxConcurrentJobs: 1}}}}, false},
+		{"override of another consumer", QuotaConfig{Consumers: []ConsumerQuota{{ConsumerID: "bob", QuotaLimits: QuotaLimits{MaxConcurrentJobs: 1}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AppConfig.Quotas = tt.quotas
+			s := newServerWithStore(newMemoryStore())
+			defer s.Close()
+			submit := func(jobID string) error {
+				_, err := s.SubmitTask(testContext("alice", ""), &pb.TaskRequest{JobId: jobID, Operation: "matmul", AData: a, BData: b, RowSplits: 1, ColSplits: 1})
+				return err
+			}
+			if err := submit("existing"); err != nil {
+				t.Fatal(err)
+			}
+			err := submit("new")
+			if tt.accepted && err != nil {
+				t.Fatalf("SubmitTask = %v, want accepted", err)
+			}
+			if !tt.accepted && status.Code(err) != codes.ResourceExhausted {
+				t.Fatalf("SubmitTask = %v, want ResourceExhausted", err)
+			}
+			want := int64(flops)
+			if tt.accepted {
+				want *= 2
+			}
+			if got := s.quotas.flopsToday("alice", time.Now()); got != want {
+				t.Errorf("charged %d FLOPs today, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package tango
+
+import (
+	"context"
+	"slices"
+	"strings"
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Roles a token can grant through its "role" or "roles" claim.
+const (
+	roleConsumer = "consumer" // Submits jobs and retrieves their results.
+	roleDevice   = "device"   // Registers, fetches shards and reports their results.
+	roleAdmin    = "admin"    // Inspects every consumer's jobs, queues and quotas, and revokes tokens.
+)
+
+// rpcPolicy lists the roles allowed to call each RPC of the Tango service.
+// RPCs missing from the table are refused, so a new RPC must be added here before anyone can call it.
+var rpcPolicy = map[string][]string{
+	pb.TangoService_SubmitTask_FullMethodName:       {roleConsumer},
+	pb.TangoService_GetJobStatus_FullMethodName:     {roleConsumer, roleAdmin},
+	pb.TangoService_GetQueueStats_FullMethodName:    {roleConsumer, roleAdmin},
+	pb.TangoService_GetQuota_FullMethodName:         {roleConsumer, roleAdmin},
+	pb.TangoService_RegisterDevice_FullMethodName:   {roleDevice},
+	pb.TangoService_FetchTask_FullMethodName:        {roleDevice},
+	pb.TangoService_ReportResult_FullMethodName:     {roleDevice},
+	pb.TangoService_RevokeToken_FullMethodName:      {roleAdmin},
+	pb.TangoService_GetTokenSessions_FullMethodName: {roleAdmin},
+	pb.TangoService_GetBillingReport_FullMethodName: {roleAdmin},
+}
+
+// deviceBoundMethods are the RPCs a device may only call with a token bound to it by RegisterDevice.
+var deviceBoundMethods = map[string]bool{
+	pb.TangoService_FetchTask_FullMethodName:    true,
+	pb.TangoService_ReportResult_FullMethodName: true,
+}
+
+// rolesFromContext returns the roles injected into the context by TokenInterceptor.
+func rolesFromContext(ctx context.Context) []string {
+	roles, _ := ctx.Value("roles").([]string)
+	return roles
+}
+
+// hasRole reports whether the caller's token grants the given role.
+func hasRole(ctx context.Context, role string) bool {
+	return slices.Contains(rolesFromContext(ctx), role)
+}
+
+// grantedRoles returns the roles granted by the token: its roles list, its single role,
+// or the configured default roles for tokens issued before roles were introduced, none by default.
+// Tokens granting no role are refused.
+func (c *Claims) grantedRoles() []string {
+	if c.Roles != nil {
+		return c.Roles
+	}
+	if c.Role != "" {
+		return []string{c.Role}
+	}
+	return AppConfig.Tokens.DefaultRoles
+}
+
+// authorize checks the caller's roles against the policy of the RPC.
+// RPCs of other services, such as reflection, only require a valid token, and the RPCs issuing tokens none.
+func authorize(ctx context.Context, fullMethod string) error {
+	if publicMethods[fullMethod] || !strings.HasPrefix(fullMethod, "/"+pb.TangoService_ServiceDesc.ServiceName+"/") {
+		return nil
+	}
+	for _, role := range rpcPolicy[fullMethod] {
+		if hasRole(ctx, role) {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "token does not grant a role allowed to call %s", fullMethod)
+}
+
+// AuthorizeInterceptor is a gRPC unary interceptor that enforces the per-RPC role policy.
+// It must run after TokenInterceptor, which injects the caller's roles into the context.
+func AuthorizeInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	if scoped, ok := req.(deviceScoped); ok {
+		if err := checkDeviceClaim(ctx, info.FullMethod, scoped.GetDeviceId()); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
+
+// StreamAuthorizeInterceptor is the streaming counterpart of AuthorizeInterceptor.
+// It must run after StreamTokenInterceptor. Streams of deviceBoundMethods are refused when opened with a token
+// not bound to a device, and messages naming another device than the token's are refused as they are received.
+func StreamAuthorizeInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := ss.Context()
+	if err := authorize(ctx, info.FullMethod); err != nil {
+		return err
+	}
+	if err := checkDeviceClaim(ctx, info.FullMethod, ""); err != nil {
+		return err
+	}
+	return handler(srv, &checkedStream{ServerStream: ss, check: func(m interface{}) error {
+		if scoped, ok := m.(deviceScoped); ok {
+			return checkDeviceClaim(ctx, info.FullMethod, scoped.GetDeviceId())
+		}
+		return nil
+	}})
+}
+
+// checkDeviceClaim refuses requests naming a device other than the one the caller's token is bound to,
+// for tokens carrying a device_id claim. The RPCs of deviceBoundMethods also refuse tokens not bound to a device;
+// other requests without a device ID, such as first registrations, pass.
+func checkDeviceClaim(ctx context.Context, fullMethod, deviceID string) error {
+	bound, ok := ctx.Value("deviceID").(string)
+	if deviceBoundMethods[fullMethod] && !ok {
+		return status.Errorf(codes.PermissionDenied, "%s requires a token bound to the device, as issued by RegisterDevice", fullMethod)
+	}
+	if !ok || deviceID == "" || deviceID == bound {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "token is bound to another device than %s", deviceID)
+}
+
+// canAccessJob reports whether the caller may see the job's status and result:
+// admins may see every job, consumers only the jobs they submitted. Callers without a consumer ID see none.
+func canAccessJob(ctx context.Context, job *Job) bool {
+	if hasRole(ctx, roleAdmin) {
+		return true
+	}
+	consumerID := consumerIDFromContext(ctx)
+	return consumerID != "" && job.ConsumerID == consumerID
+}
@@ -0,0 +1,208 @@
+package tango
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestCheckDeviceClaim checks that fetching and reporting shards require a token bound to the device named,
+// while other requests only require the binding to match when there is one.
+func TestCheckDeviceClaim(t *testing.T) {
+	bound := context.WithValue(context.Background(), "deviceID", "device_a")
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		method   string
+		deviceID string
+		allowed  bool
+	}{
+		{"fetch with bound token", bound, pb.TangoService_FetchTask_FullMethodName, "device_a", true},
+		{"fetch for another device", bound, pb.TangoService_FetchTask_FullMethodName, "device_b", false},
+		{"fetch with unbound token", context.Background(), pb.TangoService_FetchTask_FullMethodName, "device_a", false},
+		{"report with unbound token", context.Background(), pb.TangoService_ReportResult_FullMethodName, "device_a", false},
+		{"register with unbound token", context.Background(), pb.TangoService_RegisterDevice_FullMethodName, "", true},
+		{"register another device", bound, pb.TangoService_RegisterDevice_FullMethodName, "device_b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDeviceClaim(tt.ctx, tt.method, tt.deviceID)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("allowed = %v (%v), want %v", allowed, err, tt.allowed)
+			}
+		})
+	}
+}
+
+// TestCanAccessJob checks that consumers only see their own jobs, and that callers without a consumer ID
+// see none, not even jobs submitted without one.
+func TestCanAccessJob(t *testing.T) {
+	admin := context.WithValue(context.Background(), "roles", []string{roleAdmin})
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		consumer string
+		allowed  bool
+	}{
+		{"owner", testContext("alice", ""), "alice", true},
+		{"other consumer", testContext("bob", ""), "alice", false},
+		{"no consumer ID", context.Background(), "", false},
+		{"admin", admin, "alice", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allowed := canAccessJob(tt.ctx, &Job{ConsumerID: tt.consumer}); allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+// TestSubmitTaskWithoutConsumer checks that jobs cannot be submitted by callers without a consumer ID.
+func TestSubmitTaskWithoutConsumer(t *testing.T) {
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	_, err := s.SubmitTask(context.Background(), &pb.TaskRequest{JobId: "anonymous", Operation: "matmul", AData: testMatrix(t, 2, 2), BData: testMatrix(t, 2, 2), RowSplits: 1, ColSplits: 1})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("SubmitTask without a consumer ID: %v, want PermissionDenied", err)
+	}
+}
+
+// fakeServerStream is a server stream receiving the given messages, then io.EOF.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv []proto.Message
+}
+
+// Context returns the context the stream was opened with.
+func (fs *fakeServerStream) Context() context.Context {
+	return fs.ctx
+}
+
+// RecvMsg receives the next message of the stream.
+func (fs *fakeServerStream) RecvMsg(m interface{}) error {
+	if len(fs.recv) == 0 {
+		return io.EOF
+	}
+	proto.Merge(m.(proto.Message), fs.recv[0])
+	fs.recv = fs.recv[1:]
+	return nil
+}
+
+// TestStreamInterceptors checks that streams opened through the server's chain of stream interceptors are authenticated,
+// authorized against the RPC policy and held to their token's device binding, message after message.
+func TestStreamInterceptors(t *testing.T) {
+	withTokenChecks(t, "", "", 0, 0)
+	secret, err := getTangoJWTSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+	consumer := signHS256(t, map[string]any{"consumerId": "alice", "roles": []string{roleConsumer}, "exp": exp}, secret)
+	unbound := signHS256(t, map[string]any{"sub": "device", "roles": []string{roleDevice}, "exp": exp}, secret)
+	bound := signHS256(t, map[string]any{"sub": "device", "roles": []string{roleDevice}, "device_id": "device_a", "exp": exp}, secret)
+	request := func(deviceID string) proto.Message { return &pb.DeviceRequest{DeviceId: deviceID} }
+	tests := []struct {
+		name     string
+		token    string // Empty to open the stream without one.
+		messages []proto.Message
+		code     codes.Code // Status of the stream, OK when every message is handled.
+		handled  int        // Messages received by the handler before the stream fails.
+	}{
+		{"no token", "", []proto.Message{request("device_a")}, codes.Unauthenticated, 0},
+		{"invalid token", "not.a-token", []proto.Message{request("device_a")}, codes.Unauthenticated, 0},
+		{"role not allowed", consumer, []proto.Message{request("device_a")}, codes.PermissionDenied, 0},
+		{"token not bound to a device", unbound, []proto.Message{request("device_a")}, codes.PermissionDenied, 0},
+		{"bound device", bound, []proto.Message{request("device_a"), request("device_a")}, codes.OK, 2},
+		{"another device mid-stream", bound, []proto.Message{request("device_a"), request("device_b")}, codes.PermissionDenied, 1},
+	}
+	interceptors := StreamInterceptors()
+	info := &grpc.StreamServerInfo{FullMethod: pb.TangoService_FetchTask_FullMethodName, IsClientStream: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := 0
+			handler := func(_ interface{}, ss grpc.ServerStream) error {
+				if got := ss.Context().Value("deviceID"); got != "device_a" {
+					t.Errorf("handler called with device %v in the context", got)
+				}
+				for {
+					var req pb.DeviceRequest
+					if err := ss.RecvMsg(&req); errors.Is(err, io.EOF) {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					handled++
+				}
+			}
+			for i := len(interceptors) - 1; i >= 0; i-- {
+				interceptor, next := interceptors[i], handler
+				handler = func(srv interface{}, ss grpc.ServerStream) error { return interceptor(srv, ss, info, next) }
+			}
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(tokenHeader, tt.token))
+			}
+			err := handler(nil, &fakeServerStream{ctx: ctx, recv: tt.messages})
+			if status.Code(err) != tt.code || handled != tt.handled {
+				t.Errorf("stream ended with %v after %d messages, want %v after %d", err, handled, tt.code, tt.handled)
+			}
+		})
+	}
+}
+
+// TestAuthenticateRoles checks that tokens are granted the roles of their claims, or the default roles
+// when they carry none, and that tokens granting no role are refused.
+func TestAuthenticateRoles(t *testing.T) {
+	withTokenChecks(t, "", "", 0, 0)
+	saved := AppConfig.Tokens.DefaultRoles
+	t.Cleanup(func() { AppConfig.Tokens.DefaultRoles = saved })
+	secret, err := getTangoJWTSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+	tests := []struct {
+		name     string
+		claims   map[string]any
+		defaults []string
+		roles    []string // Roles granted, or nil when the token must be refused.
+	}{
+		{"roles", map[string]any{"roles": []string{roleConsumer, roleAdmin}, "exp": exp}, nil, []string{roleConsumer, roleAdmin}},
+		{"single role", map[string]any{"role": roleDevice, "exp": exp}, nil, []string{roleDevice}},
+		{"no role", map[string]any{"exp": exp}, nil, nil},
+		{"empty roles", map[string]any{"roles": []string{}, "exp": exp}, []string{roleConsumer}, nil},
+		{"no role with default roles", map[string]any{"exp": exp}, []string{roleConsumer}, []string{roleConsumer}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AppConfig.Tokens.DefaultRoles = tt.defaults
+			token := signHS256(t, tt.claims, secret)
+			ctx, err := authenticate(metadata.NewIncomingContext(context.Background(), metadata.Pairs(tokenHeader, token)))
+			if tt.roles == nil {
+				if status.Code(err) != codes.PermissionDenied {
+					t.Errorf("authenticate = %v, want PermissionDenied", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rolesFromContext(ctx); !slices.Equal(got, tt.roles) {
+				t.Errorf("roles = %v, want %v", got, tt.roles)
+			}
+		})
+	}
+}
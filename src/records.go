@@ -1,78 +1,44 @@
 package tango
 
 import (
-	"context"
-	"fmt"
+	"encoding/csv"
 	"io"
-	"os"
-	"path/filepath"
-
-	"cloud.google.com/go/storage"
+	"strconv"
 )
 
-// AppendRecord appends a new transaction record to the local CSV file "files/transaction_cache.csv".
-// It records the device ID, consumer ID, and the number of floating-point operations (flops) performed.
-// If the file does not exist, it is created in the current working directory.
-func AppendRecord(deviceID string, consumerID string, flops int32) error {
-	cwd, err := os.Getwd()
-	if err != nil {
-		return err
-	}
-	filePath := filepath.Join(cwd, "files/transaction_cache.csv")
-
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	record := fmt.Sprintf("%s,%s,%d\n", deviceID, consumerID, flops)
-	_, err = f.WriteString(record)
-	return err
-}
-
-// UploadRecordsToGCS uploads the local "files/transaction_cache.csv" file to a Google Cloud Storage bucket.
-// The bucket name is taken from the application configuration. The file is uploaded with a name based on the provided jobID.
-// After a successful upload, the local CSV file is cleared.
-// Returns an error if any step in the process fails.
-func UploadRecordsToGCS(jobID string) error {
-	bucketName := AppConfig.GCP.RecordsBucket
-	if bucketName == "" {
-		return fmt.Errorf("record bucket not set in config")
-	}
-
-	cwd, err := os.Getwd()
-	if err != nil {
-		return err
-	}
-	filePath := filepath.Join(cwd, "files/transaction_cache.csv")
+// recordsHeader is the header row of exported ledger records.
+var recordsHeader = []string{"seq", "job_id", "shard", "device_id", "consumer_id", "operation", "priority", "flops", "reported_flops", "flops_anomaly", "lease_deadline", "reported_at", "verification", "price_per_gflop", "priority_tier", "tier_multiplier", "device_share"}
 
-	f, err := os.Open(filePath)
-	if err != nil {
+// writeRecordsCSV writes shard entries of the ledger as CSV, with a header row.
+func writeRecordsCSV(w io.Writer, entries []LedgerEntry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(recordsHeader); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to create storage client: %v", err)
-	}
-	defer client.Close()
-
-	objectName := fmt.Sprintf("%s.csv", jobID)
-	writer := client.Bucket(bucketName).Object(objectName).NewWriter(ctx)
-	if _, err := io.Copy(writer, f); err != nil {
-		writer.Close()
-		return fmt.Errorf("failed to copy file contents to GCS: %v", err)
-	}
-	if err := writer.Close(); err != nil {
-		return fmt.Errorf("failed to close GCS writer: %v", err)
-	}
-
-	// Clear the local CSV file after successful upload.
-	if err := os.WriteFile(filePath, []byte(""), 0644); err != nil {
-		return fmt.Errorf("failed to clear files/transaction_cache.csv: %v", err)
-	}
-	return nil
+	for _, e := range entries {
+		record := []string{
+			strconv.FormatUint(e.Seq, 10),
+			e.JobID,
+			strconv.Itoa(e.Shard),
+			e.DeviceID,
+			e.ConsumerID,
+			e.Operation,
+			strconv.FormatInt(int64(e.Priority), 10),
+			strconv.FormatInt(e.Flops, 10),
+			strconv.FormatInt(e.ReportedFlops, 10),
+			strconv.FormatBool(e.FlopsAnomaly),
+			strconv.FormatInt(e.LeaseDeadline, 10),
+			strconv.FormatInt(e.ReportedAt, 10),
+			e.Verification,
+			strconv.FormatFloat(e.PricePerGFLOP, 'f', -1, 64),
+			strconv.FormatInt(int64(e.PriorityTier), 10),
+			strconv.FormatFloat(e.TierMultiplier, 'f', -1, 64),
+			strconv.FormatFloat(e.DeviceShare, 'f', -1, 64),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
 }
@@ -2,72 +2,96 @@ package tango
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
 	pb "tango/tango/src/protobuff"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // ReportResult processes the result of a task reported by a device.
 // It retrieves the corresponding job, validates the task ID to extract the shard index,
-// and then updates the job's results. Once all expected results are received,
-// it reassembles the final result and uploads transaction records to GCS.
+// and then records the shard result in the job store, which refuses it unless the shard is leased to the reporting device
+// and consumes the lease. Once all expected results are received,
+// it reassembles the final result and completes the job in the store, which releases its inputs
+// and shard results and removes it from the queue. Every result stored is recorded in the billing ledger, once,
+// in the same step: a result that cannot be recorded is not stored either, and an Unavailable error asks the device
+// to report it again. The job's records are shipped to the records sink once it completes. Results are billed for the FLOPs
+// the coordinator computes from the shard's shape, at the prices in effect when the result is recorded;
+// the FLOPs the device reports are only checked against them.
 // A successful ResultResponse is returned to acknowledge the processed result.
 func (s *server) ReportResult(ctx context.Context, res *pb.TaskResult) (*pb.ResultResponse, error) {
-	s.jobsMu.RLock()
-	job, exists := s.jobs[res.JobId]
-	s.jobsMu.RUnlock()
+	job, exists := s.store.Lookup(res.JobId)
 	if !exists {
 		return &pb.ResultResponse{
 			Success: false,
 			Message: "Job not found.",
 		}, nil
 	}
-	job.mu.Lock()
 
 	shardIndex, err := extractShardIndex(res.TaskId)
 	if err != nil {
-		job.mu.Unlock()
 		return &pb.ResultResponse{
 			Success: false,
 			Message: fmt.Sprintf("Invalid task id format: %v", err),
 		}, nil
 	}
 
-	if job.Results == nil {
-		job.Results = make(map[int][]byte)
-	}
-
-	delete(job.PendingTasks, shardIndex)
-	job.Results[shardIndex] = []byte(res.ResultData)
-	job.ReceivedUpdates++
-
-	consumerID := ctx.Value("consumerID").(string)
-
-	if res.Flops > 0 && len(res.ResultData) > 0 {
-		if err := AppendRecord(res.DeviceId, consumerID, res.Flops); err != nil {
-			log.Printf("Failed to append record for job %s: %v", job.JobID, err)
+	flops := job.shardFlops(shardIndex)
+	record := func(lease TimeDeadline) error {
+		if flops == 0 || len(res.ResultData) == 0 {
+			return nil
 		}
-	}
-
-	var completedJobID string
-	if job.ReceivedUpdates == job.ExpectedSplits {
-		finalResult, err := reassembleCShards(job.Results, int(job.ColSplits))
-		if err != nil {
-			log.Printf("Job %s complete, but failed to reassemble C_shards: %v", job.JobID, err)
-		} else {
-			job.FinalResult = finalResult
-			completedJobID = job.JobID
+		entry := LedgerEntry{
+			JobID:         job.JobID,
+			Shard:         shardIndex,
+			DeviceID:      res.DeviceId,
+			ConsumerID:    job.ConsumerID,
+			Operation:     job.Operation,
+			Priority:      job.Priority,
+			Flops:         flops,
+			ReportedFlops: res.Flops,
+			FlopsAnomaly:  checkReportedFlops(res.DeviceId, res.TaskId, res.Flops, flops),
+			LeaseDeadline: lease.Deadline,
+			ReportedAt:    time.Now().UnixNano(),
 		}
+		if s.prices != nil {
+			s.prices.priceEntry(&entry)
+		}
+		if err := s.ledger.recordShard(entry); err != nil {
+			return fmt.Errorf("failed to record it in the billing ledger: %w", err)
+		}
+		return nil
+	}
+	ready, err := s.store.UpdateShard(job, shardIndex, res.DeviceId, res.ResultData, record)
+	if errors.Is(err, ErrJobCompleted) {
+		return &pb.ResultResponse{
+			Success: true,
+			Message: "Job is already complete.",
+		}, nil
+	}
+	if errors.Is(err, ErrShardNotLeased) {
+		return &pb.ResultResponse{
+			Success: false,
+			Message: fmt.Sprintf("Shard %d of job %s is not leased to device %s.", shardIndex, job.JobID, res.DeviceId),
+		}, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to store result: %v", err)
 	}
-	job.mu.Unlock()
 
-	if completedJobID != "" {
-		if err := UploadRecordsToGCS(completedJobID); err != nil {
-			log.Printf("Failed to upload records to GCS for job %s: %v", completedJobID, err)
-		}
+	if ready {
+		s.finishJob(job)
+	} else if job.completed() {
+		// The job completed while this result was being recorded, possibly after its records were shipped.
+		s.shipRecords(job.JobID)
 	}
+	s.refreshMemory(job)
 
 	return &pb.ResultResponse{
 		Success: true,
@@ -75,15 +99,39 @@ func (s *server) ReportResult(ctx context.Context, res *pb.TaskResult) (*pb.Resu
 	}, nil
 }
 
+// finishJob reassembles the final result of a job holding every shard result, completes the job in the store
+// and ships its records to the records sink. The records are shipped even if reassembly fails,
+// since the shards were computed all the same.
+func (s *server) finishJob(job *Job) {
+	defer s.shipRecords(job.JobID)
+	job.mu.Lock()
+	finalResult, err := reassembleCShards(job.Results, int(job.ColSplits))
+	job.mu.Unlock()
+	if err != nil {
+		log.Printf("Job %s complete, but failed to reassemble C_shards: %v", job.JobID, err)
+		return
+	}
+	if err := s.store.Complete(job, finalResult); err != nil {
+		log.Printf("Failed to persist completion of job %s: %v", job.JobID, err)
+	}
+}
+
+// completed reports whether the job's final result has been assembled.
+func (j *Job) completed() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.CompletedAt != 0
+}
+
 // extractShardIndex parses the task ID to extract the shard index.
-// The task ID is expected to be in the format "prefix_index" (e.g., "task_3").
+// The task ID is expected to be in the format "jobID_index" (e.g., "job_3"), where the job ID may contain '_' itself.
 // It returns the shard index as an integer, or an error if the format is invalid.
 func extractShardIndex(taskId string) (int, error) {
-	parts := strings.Split(taskId, "_")
-	if len(parts) != 2 {
+	sep := strings.LastIndex(taskId, "_")
+	if sep <= 0 {
 		return 0, fmt.Errorf("invalid task id format")
 	}
-	return strconv.Atoi(parts[1])
+	return strconv.Atoi(taskId[sep+1:])
 }
 
 // reassembleCShards reassembles the final result matrix from individual shard results.
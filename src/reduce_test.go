@@ -0,0 +1,117 @@
+package tango
+
+import (
+	"sync"
+	"testing"
+
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestReportResultConcurrentDuplicates reports the result of the same shard many times concurrently,
+// and checks that only one report is accepted and billed.
+func TestReportResultConcurrentDuplicates(t *testing.T) {
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	ctx := testContext("alice", "")
+	reg, err := s.RegisterDevice(ctx, &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9})
+	if err != nil || !reg.Accepted {
+		t.Fatalf("RegisterDevice: %v %v", reg, err)
+	}
+	ctx = testContext("alice", reg.DeviceId)
+	if r, err := s.SubmitTask(ctx, &pb.TaskRequest{JobId: "dup", Operation: "matmul", AData: testMatrix(t, 2, 2), BData: testMatrix(t, 2, 2), RowSplits: 2, ColSplits: 1}); err != nil || !r.Accepted {
+		t.Fatalf("SubmitTask: %v %v", r, err)
+	}
+	task, err := s.FetchTask(ctx, &pb.DeviceRequest{DeviceId: reg.DeviceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s.ReportResult(ctx, &pb.TaskResult{DeviceId: reg.DeviceId, JobId: "dup", TaskId: task.TaskId, ResultData: []byte("1 2")})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r.Success {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Errorf("%d reports accepted, want 1", accepted)
+	}
+	billed, err := s.ledger.entries(func(e *LedgerEntry) bool { return e.Kind == ledgerShard && e.JobID == "dup" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(billed) != 1 {
+		t.Errorf("%d shard entries in the ledger, want 1", len(billed))
+	}
+}
+
+// TestReportResultLedgerFailure checks that a result the billing ledger cannot record is refused with Unavailable
+// and not stored, with the shard's lease kept, so the device can report it again once the ledger recovers.
+func TestReportResultLedgerFailure(t *testing.T) {
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	dir := t.TempDir()
+	broken, err := openLedger(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.file.Close() // Every write now fails.
+	s.ledger = broken
+	ctx := testContext("alice", "")
+	reg, err := s.RegisterDevice(ctx, &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9})
+	if err != nil || !reg.Accepted {
+		t.Fatalf("RegisterDevice: %v %v", reg, err)
+	}
+	ctx = testContext("alice", reg.DeviceId)
+	if r, err := s.SubmitTask(ctx, &pb.TaskRequest{JobId: "unbilled", Operation: "matmul", AData: testMatrix(t, 2, 2), BData: testMatrix(t, 2, 2), RowSplits: 2, ColSplits: 1}); err != nil || !r.Accepted {
+		t.Fatalf("SubmitTask: %v %v", r, err)
+	}
+	task, err := s.FetchTask(ctx, &pb.DeviceRequest{DeviceId: reg.DeviceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &pb.TaskResult{DeviceId: reg.DeviceId, JobId: "unbilled", TaskId: task.TaskId, ResultData: []byte("1 2")}
+
+	if _, err := s.ReportResult(ctx, report); status.Code(err) != codes.Unavailable {
+		t.Fatalf("ReportResult with a failing ledger: %v, want Unavailable", err)
+	}
+	job, _ := s.store.Lookup("unbilled")
+	index, _ := extractShardIndex(task.TaskId)
+	job.mu.Lock()
+	_, stored := job.Results[index]
+	lease, leased := job.PendingTasks[index]
+	job.mu.Unlock()
+	if stored || !leased || lease.DeviceID != reg.DeviceId {
+		t.Fatalf("result stored %v, lease %+v kept %v, want the result refused and the lease kept", stored, lease, leased)
+	}
+
+	if s.ledger, err = openLedger(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.ReportResult(ctx, report); err != nil || !r.Success {
+		t.Fatalf("ReportResult once the ledger recovered: %v %v", r, err)
+	}
+	billed, err := s.ledger.entries(func(e *LedgerEntry) bool { return e.Kind == ledgerShard && e.JobID == "unbilled" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(billed) != 1 {
+		t.Errorf("%d shard entries in the ledger, want 1", len(billed))
+	}
+}
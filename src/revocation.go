@@ -0,0 +1,393 @@
+package tango
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	pb "tango/tango/src/protobuff"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kinds of revocation, by what they match in a token.
+const (
+	revokeJTI     = "jti"     // Matches the token's jti claim.
+	revokeSubject = "subject" // Matches the token's sub claim, or its consumerId when it has no sub.
+	revokeDevice  = "device"  // Matches the token's device_id claim and requests naming the device.
+)
+
+// sessionPruneInterval is how often sessions of expired tokens are dropped from the session tracker.
+const sessionPruneInterval = time.Minute
+
+// errTokenRevoked is returned when a token, its subject or its device has been revoked.
+var errTokenRevoked = errors.New("token has been revoked")
+
+// coordinatorLocal lists the RPCs that concern the coordinator receiving them, or that any coordinator
+// can serve on its own, rather than the jobs of its cluster, so ForwardToLeader serves them locally.
+var coordinatorLocal = map[string]bool{
+	pb.TangoService_GetTokenSessions_FullMethodName: true,
+	pb.TangoService_IssueToken_FullMethodName:       true,
+	pb.TangoService_GetBillingReport_FullMethodName: true,
+}
+
+// revocation is an entry of the deny list.
+type revocation struct {
+	Kind      string `json:"kind"`
+	Value     string `json:"value"`
+	Reason    string `json:"reason"`
+	RevokedAt int64  `json:"revoked_at"`           // Unix timestamp (nanoseconds) of the revocation.
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix timestamp (seconds) past which the revoked token is refused anyway, if any.
+}
+
+// denyList holds the revoked token IDs, subjects and devices, persisted to a local file
+// so revocations survive restarts.
+type denyList struct {
+	mu      sync.RWMutex
+	path    string                // File the deny list is persisted to, or empty to keep it in memory.
+	entries map[string]revocation // Revocations, keyed by kind and value.
+}
+
+// revocations is the deny list of this coordinator. In cluster mode it is replicated by the cluster's state machine.
+var revocations = &denyList{entries: make(map[string]revocation)}
+
+// LoadRevocations loads the deny list from the file configured under tokens.revocation_file.
+// A missing file is an empty deny list.
+func LoadRevocations() error {
+	return revocations.load(AppConfig.Tokens.RevocationFile)
+}
+
+// revocationKey returns the key of a revocation in the deny list.
+func revocationKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// load replaces the deny list with the one persisted at the given path, and persists later updates there.
+func (dl *denyList) load(path string) error {
+	entries := make(map[string]revocation)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read revocations: %v", err)
+		}
+		if err == nil {
+			var list []revocation
+			if err := json.Unmarshal(data, &list); err != nil {
+				return fmt.Errorf("invalid revocations file %s: %v", path, err)
+			}
+			for _, r := range list {
+				entries[revocationKey(r.Kind, r.Value)] = r
+			}
+		}
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.path = path
+	dl.entries = entries
+	return nil
+}
+
+// revoked reports whether the given value of the given kind has been revoked.
+func (dl *denyList) revoked(kind, value string) bool {
+	if value == "" {
+		return false
+	}
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	_, found := dl.entries[revocationKey(kind, value)]
+	return found
+}
+
+// check returns errTokenRevoked if the token's ID, subject or device has been revoked.
+func (dl *denyList) check(claims *Claims) error {
+	if dl.revoked(revokeJTI, claims.ID) || dl.revoked(revokeSubject, claims.subject()) || dl.revoked(revokeDevice, claims.DeviceID) {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// update adds the revocation to the deny list, or lifts it when restore is set, and persists the deny list.
+// Revocations of tokens that have since expired are dropped along the way. The deny list is left unchanged
+// if it cannot be persisted.
+func (dl *denyList) update(r revocation, restore bool) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.prune(time.Now())
+	key := revocationKey(r.Kind, r.Value)
+	previous, existed := dl.entries[key]
+	if restore {
+		delete(dl.entries, key)
+	} else {
+		dl.entries[key] = r
+	}
+	if err := dl.save(); err != nil {
+		delete(dl.entries, key)
+		if existed {
+			dl.entries[key] = previous
+		}
+		return err
+	}
+	return nil
+}
+
+// prune drops the revocations of tokens that have expired, allowing for clock skew. The caller must hold dl.mu.
+func (dl *denyList) prune(now time.Time) {
+	cutoff := now.Unix() - int64(AppConfig.Tokens.ClockSkewSeconds)
+	for key, r := range dl.entries {
+		if r.ExpiresAt != 0 && r.ExpiresAt < cutoff {
+			delete(dl.entries, key)
+		}
+	}
+}
+
+// replace replaces the deny list with the given revocations and persists it, as when a cluster node
+// restores a snapshot. The deny list is left unchanged if it cannot be persisted.
+func (dl *denyList) replace(list []revocation) error {
+	entries := make(map[string]revocation, len(list))
+	for _, r := range list {
+		entries[revocationKey(r.Kind, r.Value)] = r
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	previous := dl.entries
+	dl.entries = entries
+	if err := dl.save(); err != nil {
+		dl.entries = previous
+		return err
+	}
+	return nil
+}
+
+// save writes the deny list to its file, replacing the previous one atomically.
+// The caller must hold dl.mu.
+func (dl *denyList) save() error {
+	if dl.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(dl.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dl.path), 0o755); err != nil {
+		return err
+	}
+	tmp := dl.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dl.path)
+}
+
+// sorted returns the revocations, oldest first. The caller must hold dl.mu.
+func (dl *denyList) sorted() []revocation {
+	list := make([]revocation, 0, len(dl.entries))
+	for _, r := range dl.entries {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RevokedAt < list[j].RevokedAt })
+	return list
+}
+
+// list returns the revocations, oldest first.
+func (dl *denyList) list() []revocation {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	return dl.sorted()
+}
+
+// subject returns the subject of the token: its sub claim, or the consumer it acts for when it has none.
+func (c *Claims) subject() string {
+	if c.Subject != "" {
+		return c.Subject
+	}
+	return c.ConsumerID
+}
+
+// tokenSession records the use of a single token, for audits.
+type tokenSession struct {
+	subject    string
+	consumerID string
+	deviceID   string
+	roles      []string
+	expiresAt  int64 // Unix timestamp (seconds) of the token's expiry.
+	firstSeen  int64 // Unix timestamp (nanoseconds) of the token's first use.
+	lastSeen   int64 // Unix timestamp (nanoseconds) of the token's last use.
+	calls      int64
+}
+
+// sessionTracker tracks the use of every token seen by this coordinator until it expires.
+type sessionTracker struct {
+	mu         sync.Mutex
+	sessions   map[string]*tokenSession // Sessions, keyed by tokenKey.
+	lastPruned time.Time
+}
+
+// sessions tracks the tokens used with this coordinator.
+var sessions = &sessionTracker{sessions: make(map[string]*tokenSession)}
+
+// tokenKey identifies a token: by its jti claim, or by a hash of the token when it has none.
+func tokenKey(token string, claims *Claims) string {
+	if claims.ID != "" {
+		return revokeJTI + ":" + claims.ID
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:16])
+}
+
+// touch records a call made with the token.
+func (st *sessionTracker) touch(key string, claims *Claims, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if now.Sub(st.lastPruned) > sessionPruneInterval {
+		st.prune(now)
+	}
+	session, exists := st.sessions[key]
+	if !exists {
+		session = &tokenSession{
+			subject:    claims.subject(),
+			consumerID: claims.ConsumerID,
+			deviceID:   claims.DeviceID,
+			roles:      claims.grantedRoles(),
+			expiresAt:  int64(claims.ExpiresAt),
+			firstSeen:  now.UnixNano(),
+		}
+		st.sessions[key] = session
+	}
+	session.lastSeen = now.UnixNano()
+	session.calls++
+}
+
+// prune drops the sessions of expired tokens. The caller must hold st.mu.
+func (st *sessionTracker) prune(now time.Time) {
+	cutoff := now.Unix() - int64(AppConfig.Tokens.ClockSkewSeconds)
+	for key, session := range st.sessions {
+		if session.expiresAt < cutoff {
+			delete(st.sessions, key)
+		}
+	}
+	st.lastPruned = now
+}
+
+// list returns the sessions of tokens that have not expired, most recently used first.
+func (st *sessionTracker) list(now time.Time) []*pb.TokenSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.prune(now)
+	list := make([]*pb.TokenSession, 0, len(st.sessions))
+	for key, session := range st.sessions {
+		list = append(list, &pb.TokenSession{
+			Key:        key,
+			Subject:    session.subject,
+			ConsumerId: session.consumerID,
+			DeviceId:   session.deviceID,
+			Roles:      session.roles,
+			ExpiresAt:  session.expiresAt,
+			FirstSeen:  session.firstSeen,
+			LastSeen:   session.lastSeen,
+			Calls:      session.calls,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen > list[j].LastSeen })
+	return list
+}
+
+// RevokeToken adds a token ID, subject or device to the deny list of this coordinator, or lifts
+// such a revocation when the request sets restore. Revoked tokens are refused until they expire,
+// and revocations of subjects and devices apply to every token naming them. In cluster mode the revocation
+// is replicated to every coordinator of the cluster, so it holds whichever of them a token is presented to.
+// In federation mode it is also forwarded to every other member, as each keeps its own deny list.
+func (s *server) RevokeToken(ctx context.Context, req *pb.RevocationRequest) (*pb.RevocationReply, error) {
+	if req.Kind != revokeJTI && req.Kind != revokeSubject && req.Kind != revokeDevice {
+		return &pb.RevocationReply{
+			Accepted: false,
+			Message:  "Kind must be jti, subject or device.",
+		}, nil
+	}
+	if req.Value == "" {
+		return &pb.RevocationReply{
+			Accepted: false,
+			Message:  "A value to revoke is required.",
+		}, nil
+	}
+	now := time.Now()
+	r := revocation{Kind: req.Kind, Value: req.Value, Reason: req.Reason, RevokedAt: now.UnixNano()}
+	if req.Kind == revokeJTI {
+		r.ExpiresAt = jtiRevocationExpiry(now)
+	}
+	if err := s.revoke(r, req.Restore); err != nil {
+		return nil, err
+	}
+	if s.federation != nil && !hasHeader(ctx, routedHeader) {
+		if err := s.federation.revoke(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	message := fmt.Sprintf("Revoked %s %s.", req.Kind, req.Value)
+	if req.Restore {
+		message = fmt.Sprintf("Restored %s %s.", req.Kind, req.Value)
+	}
+	return &pb.RevocationReply{
+		Accepted: true,
+		Message:  message,
+	}, nil
+}
+
+// jtiRevocationExpiry returns when the revocation of a token ID made now can be dropped from the deny list:
+// once any token it can name has expired, as bounded by tokens.max_lifetime_seconds, or by the lifetime of refresh tokens,
+// which the cap does not apply to. It returns 0, keeping the revocation for good, when token lifetimes are not capped.
+func jtiRevocationExpiry(now time.Time) int64 {
+	cfg := AppConfig.Tokens
+	if cfg.MaxLifetimeSeconds <= 0 {
+		return 0
+	}
+	return now.Unix() + int64(max(cfg.MaxLifetimeSeconds, cfg.RefreshTTLSeconds))
+}
+
+// revoke adds the revocation to the deny list, or lifts it when restore is set, replicating it in cluster mode.
+func (s *server) revoke(r revocation, restore bool) error {
+	if s.cluster != nil {
+		if err := s.cluster.revoke(r, restore); err != nil {
+			return status.Errorf(codes.Unavailable, "failed to replicate revocation: %v", err)
+		}
+		return nil
+	}
+	if err := revocations.update(r, restore); err != nil {
+		return fmt.Errorf("failed to persist revocation: %w", err)
+	}
+	return nil
+}
+
+// GetTokenSessions reports the use of every unexpired token seen by this coordinator,
+// along with its deny list, for audits.
+func (s *server) GetTokenSessions(ctx context.Context, req *pb.TokenSessionsRequest) (*pb.TokenSessionsReply, error) {
+	reply := &pb.TokenSessionsReply{Sessions: sessions.list(time.Now())}
+	for _, r := range revocations.list() {
+		reply.Revocations = append(reply.Revocations, &pb.Revocation{
+			Kind:      r.Kind,
+			Value:     r.Value,
+			Reason:    r.Reason,
+			RevokedAt: r.RevokedAt,
+		})
+	}
+	return reply, nil
+}
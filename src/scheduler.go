@@ -0,0 +1,201 @@
+package tango
+
+import (
+	"context"
+	"sort"
+	"sync"
+	pb "tango/tango/src/protobuff"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fairShare implements weighted fair sharing of shards across consumers.
+// Each consumer accumulates a virtual time equal to the shards dispatched on its behalf
+// divided by its weight; consumers with the lowest virtual time are served first.
+type fairShare struct {
+	mu         sync.Mutex
+	virtual    map[string]float64 // Weighted service received, keyed by consumer ID.
+	dispatched map[string]int64   // Total shards dispatched, keyed by consumer ID.
+}
+
+// newFairShare creates an empty fair-share scheduler.
+func newFairShare() *fairShare {
+	return &fairShare{
+		virtual:    make(map[string]float64),
+		dispatched: make(map[string]int64),
+	}
+}
+
+// consumerWeight returns the configured fair-share weight of a consumer.
+// Consumers without an override use the default weight, which itself defaults to 1.
+func consumerWeight(consumerID string) float64 {
+	for _, cw := range AppConfig.Scheduler.ConsumerWeights {
+		if cw.ConsumerID == consumerID && cw.Weight > 0 {
+			return cw.Weight
+		}
+	}
+	if AppConfig.Scheduler.DefaultWeight > 0 {
+		return AppConfig.Scheduler.DefaultWeight
+	}
+	return 1
+}
+
+// activate is called when a consumer with no queued work submits a job.
+// It advances the consumer's virtual time to the minimum among the active consumers,
+// so an idle consumer cannot bank credit and then starve everyone else.
+func (f *fairShare) activate(consumerID string, active []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	floor, found := 0.0, false
+	for _, c := range active {
+		if c == consumerID {
+			continue
+		}
+		if v := f.virtual[c]; !found || v < floor {
+			floor, found = v, true
+		}
+	}
+	if found && f.virtual[consumerID] < floor {
+		f.virtual[consumerID] = floor
+	}
+}
+
+// charge records that a shard was dispatched on behalf of the consumer.
+func (f *fairShare) charge(consumerID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.virtual[consumerID] += 1 / consumerWeight(consumerID)
+	f.dispatched[consumerID]++
+}
+
+// order returns the consumers sorted by ascending virtual time.
+// Ties are broken by the order in which consumers first appear in the job queue.
+func (f *fairShare) order(consumers []string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sorted := make([]string, len(consumers))
+	copy(sorted, consumers)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return f.virtual[sorted[i]] < f.virtual[sorted[j]]
+	})
+	return sorted
+}
+
+// dispatchedShards returns the number of shards dispatched on behalf of the consumer.
+func (f *fairShare) dispatchedShards(consumerID string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dispatched[consumerID]
+}
+
+// queuedByConsumer groups the job queue by consumer, preserving FIFO order within each consumer.
+// It returns the grouped jobs along with the consumers in order of first appearance.
+func (s *server) queuedByConsumer() (map[string][]*Job, []string) {
+	return groupByConsumer(s.store.Queued())
+}
+
+// groupByConsumer groups the given jobs by consumer, preserving their order within each consumer.
+// It returns the grouped jobs along with the consumers in order of first appearance.
+func groupByConsumer(jobs []*Job) (map[string][]*Job, []string) {
+	byConsumer := make(map[string][]*Job)
+	var consumers []string
+	for _, job := range jobs {
+		if _, seen := byConsumer[job.ConsumerID]; !seen {
+			consumers = append(consumers, job.ConsumerID)
+		}
+		byConsumer[job.ConsumerID] = append(byConsumer[job.ConsumerID], job)
+	}
+	return byConsumer, consumers
+}
+
+// effectivePriority returns the job's priority after aging.
+// Every configured aging interval the job has spent in the queue raises its priority by one,
+// so low-priority jobs are never starved forever by a stream of higher-priority work.
+func (j *Job) effectivePriority(now int64) int64 {
+	priority := int64(j.Priority)
+	interval := int64(AppConfig.Scheduler.AgingIntervalSeconds) * int64(time.Second)
+	if interval > 0 && now > j.SubmittedAt {
+		priority += (now - j.SubmittedAt) / interval
+	}
+	return priority
+}
+
+// scheduleOrder returns the queued jobs in the order FetchTask should try them.
+// Jobs are visited by descending effective priority, so queued shards of lower-priority jobs
+// are preempted by newly submitted higher-priority jobs. Within a priority level, consumers are
+// visited by ascending weighted service, and each consumer's jobs in FIFO order.
+func (s *server) scheduleOrder() []*Job {
+	now := time.Now().UnixNano()
+	levels := make(map[int64][]*Job)
+	var priorities []int64
+
+	queue := s.store.Queued()
+	for _, job := range queue {
+		p := job.effectivePriority(now)
+		if _, seen := levels[p]; !seen {
+			priorities = append(priorities, p)
+		}
+		levels[p] = append(levels[p], job)
+	}
+
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] > priorities[j] })
+	ordered := make([]*Job, 0, len(queue))
+	for _, p := range priorities {
+		byConsumer, consumers := groupByConsumer(levels[p])
+		for _, consumerID := range s.fair.order(consumers) {
+			ordered = append(ordered, byConsumer[consumerID]...)
+		}
+	}
+	return ordered
+}
+
+// remainingShards returns the number of shards of the job that have not been received yet.
+// For adaptive jobs, rows that have not been cut into bands count as a single remaining shard,
+// so the value is a lower bound.
+// The caller must hold j.mu.
+func (j *Job) remainingShards() int {
+	if !j.Adaptive {
+		return j.ExpectedSplits - len(j.Results)
+	}
+	remaining := len(j.Bands) - len(j.Results)
+	if j.NextRow < int(j.m) {
+		remaining++
+	}
+	return remaining
+}
+
+// GetQueueStats reports the queue depth of every consumer with queued jobs,
+// or of a single consumer when one is specified in the request.
+// Callers other than admins only see their own queue.
+func (s *server) GetQueueStats(ctx context.Context, req *pb.QueueStatsRequest) (*pb.QueueStatsReply, error) {
+	if !hasRole(ctx, roleAdmin) {
+		consumerID := consumerIDFromContext(ctx)
+		if req.ConsumerId != nil && *req.ConsumerId != consumerID {
+			return nil, status.Error(codes.PermissionDenied, "only admins may see the queues of other consumers")
+		}
+		req = &pb.QueueStatsRequest{ConsumerId: &consumerID}
+	}
+	byConsumer, consumers := s.queuedByConsumer()
+
+	reply := &pb.QueueStatsReply{}
+	for _, consumerID := range consumers {
+		if req.ConsumerId != nil && *req.ConsumerId != consumerID {
+			continue
+		}
+		stats := &pb.ConsumerQueueStats{
+			ConsumerId:       consumerID,
+			Weight:           consumerWeight(consumerID),
+			QueuedJobs:       int32(len(byConsumer[consumerID])),
+			DispatchedShards: s.fair.dispatchedShards(consumerID),
+		}
+		for _, job := range byConsumer[consumerID] {
+			job.mu.Lock()
+			stats.RemainingShards += int32(job.remainingShards())
+			job.mu.Unlock()
+		}
+		reply.Consumers = append(reply.Consumers, stats)
+	}
+	return reply, nil
+}
@@ -0,0 +1,117 @@
+package tango
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "tango/tango/src/protobuff"
+)
+
+// withScheduler applies the scheduler configuration for the duration of the test.
+func withScheduler(t *testing.T, cfg SchedulerConfig) {
+	t.Helper()
+	saved := AppConfig.Scheduler
+	AppConfig.Scheduler = cfg
+	t.Cleanup(func() { AppConfig.Scheduler = saved })
+}
+
+// schedulerFixture is a server with a single registered device fetching shards of the jobs submitted to it.
+type schedulerFixture struct {
+	t        *testing.T
+	s        *server
+	deviceID string
+}
+
+// newSchedulerFixture creates a server with an in-memory store and registers a device with it.
+func newSchedulerFixture(t *testing.T) *schedulerFixture {
+	t.Helper()
+	s := newServerWithStore(newMemoryStore())
+	t.Cleanup(func() { s.Close() })
+	reg, err := s.RegisterDevice(testContext("device-owner", ""), &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9})
+	if err != nil || !reg.Accepted {
+		t.Fatalf("RegisterDevice: %v %v", reg, err)
+	}
+	return &schedulerFixture{t: t, s: s, deviceID: reg.DeviceId}
+}
+
+// submit submits a job of the given number of shards and priority on behalf of the consumer.
+func (f *schedulerFixture) submit(consumerID, jobID string, shards int, priority int32) {
+	f.t.Helper()
+	ctx := context.WithValue(testContext(consumerID, ""), "maxPriority", int32(10))
+	reply, err := f.s.SubmitTask(ctx, &pb.TaskRequest{
+		JobId:     jobID,
+		Operation: "matmul",
+		AData:     testMatrix(f.t, shards, 1),
+		BData:     testMatrix(f.t, 1, 1),
+		RowSplits: int32(shards),
+		ColSplits: 1,
+		Priority:  priority,
+	})
+	if err != nil || !reply.Accepted {
+		f.t.Fatalf("SubmitTask %s: %v %v", jobID, reply, err)
+	}
+}
+
+// fetch fetches the next shard for the device and returns the ID of the job it belongs to.
+func (f *schedulerFixture) fetch() string {
+	f.t.Helper()
+	assignment, err := f.s.FetchTask(testContext("device-owner", f.deviceID), &pb.DeviceRequest{DeviceId: f.deviceID})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return assignment.TaskId[:strings.LastIndex(assignment.TaskId, "_")]
+}
+
+// TestFairShareInterleaves checks that a consumer joining while another has already been served
+// is not handed credit for the time it was idle, and that shards are then interleaved by weight
+// instead of dispatched consumer by consumer.
+func TestFairShareInterleaves(t *testing.T) {
+	withScheduler(t, SchedulerConfig{ConsumerWeights: []ConsumerWeight{{ConsumerID: "bob", Weight: 2}}})
+	f := newSchedulerFixture(t)
+
+	f.submit("alice", "alice-job", 10, 0)
+	for range 3 {
+		if got := f.fetch(); got != "alice-job" {
+			t.Fatalf("dispatched %s while alice was alone", got)
+		}
+	}
+	f.submit("bob", "bob-job", 10, 0)
+	var got []string
+	for range 6 {
+		got = append(got, f.fetch())
+	}
+	want := "alice-job bob-job bob-job alice-job bob-job bob-job"
+	if strings.Join(got, " ") != want {
+		t.Errorf("dispatched %q, want %q", got, want)
+	}
+	if alice, bob := f.s.fair.dispatchedShards("alice"), f.s.fair.dispatchedShards("bob"); alice != 5 || bob != 4 {
+		t.Errorf("dispatched %d shards for alice and %d for bob, want 5 and 4", alice, bob)
+	}
+}
+
+// TestPriorityAging checks that queued jobs are served by descending priority, and that a low-priority job
+// waiting long enough outranks a high-priority job submitted after it.
+func TestPriorityAging(t *testing.T) {
+	withScheduler(t, SchedulerConfig{AgingIntervalSeconds: 60})
+	f := newSchedulerFixture(t)
+
+	f.submit("alice", "old-low", 4, 0)
+	f.submit("bob", "new-high", 4, 3)
+	if got := f.fetch(); got != "new-high" {
+		t.Fatalf("dispatched %s, want the higher-priority job first", got)
+	}
+
+	// Waiting 4 aging intervals raises the old job's priority from 0 to 4, above the new job's 3.
+	old, _ := f.s.store.Lookup("old-low")
+	old.mu.Lock()
+	old.SubmittedAt = time.Now().Add(-4*time.Minute - time.Second).UnixNano()
+	old.mu.Unlock()
+	if p := old.effectivePriority(old.SubmittedAt + int64(4*time.Minute)); p != 4 {
+		t.Errorf("effective priority after 4 aging intervals = %d, want 4", p)
+	}
+	if got := f.fetch(); got != "old-low" {
+		t.Errorf("dispatched %s, want the aged job first", got)
+	}
+}
@@ -0,0 +1,383 @@
+package tango
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Secret providers selectable under secrets.provider.
+const (
+	secretsProviderGCP  = "gcp"  // GCP Secret Manager, with the secret names of the gcp section.
+	secretsProviderEnv  = "env"  // Environment variables, named after the secret with the configured prefix.
+	secretsProviderFile = "file" // Files named after the secret, in the configured directory.
+)
+
+// Names of the secrets Tango reads through its secret provider.
+const (
+	secretJWT       = "jwt_secret"  // Shared secret of HS256 tokens.
+	secretTestToken = "test_token"  // Token used by the test clients.
+	secretServerCrt = "server_crt"  // PEM certificate of the server.
+	secretServerKey = "server_key"  // PEM private key of the server.
+	secretPeer      = "peer_secret" // Shared secret coordinators sign forwarded requests with.
+)
+
+// SecretProvider fetches the latest value of a secret by name.
+type SecretProvider interface {
+	Secret(name string) ([]byte, error)
+}
+
+// newSecretProvider returns the secret provider selected by the configuration. GCP Secret Manager is used
+// when none is selected, as it was the only provider before others were introduced.
+func newSecretProvider(cfg SecretsConfig) (SecretProvider, error) {
+	switch cfg.Provider {
+	case "", secretsProviderGCP:
+		return gcpSecrets{}, nil
+	case secretsProviderEnv:
+		prefix := cfg.EnvPrefix
+		if prefix == "" {
+			prefix = "TANGO_"
+		}
+		return envSecrets{prefix: prefix}, nil
+	case secretsProviderFile:
+		if cfg.Dir == "" {
+			return nil, fmt.Errorf("the file secret provider needs a secrets.dir")
+		}
+		return fileSecrets{dir: cfg.Dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret provider %q", cfg.Provider)
+	}
+}
+
+// The secret provider of the configuration, built by LoadSecretProvider at startup, or by the first fetch.
+var (
+	secretProviderMu sync.Mutex
+	secretProvider   SecretProvider
+)
+
+// LoadSecretProvider builds the secret provider selected by the configuration, so a misconfigured provider
+// stops the server at startup, and every secret is then read through the same provider.
+func LoadSecretProvider() error {
+	_, err := configuredSecretProvider()
+	return err
+}
+
+// configuredSecretProvider returns the secret provider selected by the configuration, building it on first use.
+func configuredSecretProvider() (SecretProvider, error) {
+	secretProviderMu.Lock()
+	defer secretProviderMu.Unlock()
+	if secretProvider == nil {
+		provider, err := newSecretProvider(AppConfig.Secrets)
+		if err != nil {
+			return nil, err
+		}
+		secretProvider = provider
+	}
+	return secretProvider, nil
+}
+
+// fetchSecret fetches the named secret from the configured secret provider.
+func fetchSecret(name string) ([]byte, error) {
+	provider, err := configuredSecretProvider()
+	if err != nil {
+		return nil, err
+	}
+	return provider.Secret(name)
+}
+
+// gcpSecrets reads secrets from GCP Secret Manager. Tango's secrets are mapped to the secret versions
+// configured in the gcp section; any other name is taken as the full name of a secret version.
+type gcpSecrets struct{}
+
+// Secret fetches the latest payload of the secret from GCP Secret Manager.
+func (gcpSecrets) Secret(name string) ([]byte, error) {
+	versions := map[string]string{
+		secretJWT:       AppConfig.GCP.JWTSecretName,
+		secretTestToken: AppConfig.GCP.TestTokenSecretName,
+		secretServerCrt: AppConfig.GCP.ServerCrt,
+		secretServerKey: AppConfig.GCP.ServerKey,
+	}
+	if version, known := versions[name]; known {
+		if version == "" {
+			return nil, fmt.Errorf("no GCP secret name configured for %s", name)
+		}
+		name = version
+	}
+	return accessSecret(name)
+}
+
+// envSecrets reads secrets from environment variables, named after the secret in upper case with a prefix,
+// such as TANGO_JWT_SECRET.
+type envSecrets struct {
+	prefix string
+}
+
+// Secret returns the value of the secret's environment variable, which must be set and not empty.
+func (p envSecrets) Secret(name string) ([]byte, error) {
+	variable := p.prefix + strings.ToUpper(name)
+	value := os.Getenv(variable)
+	if value == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", variable)
+	}
+	return []byte(value), nil
+}
+
+// fileSecrets reads secrets from files named after them in a directory, such as a mounted Kubernetes secret.
+type fileSecrets struct {
+	dir string
+}
+
+// Secret returns the content of the secret's file, without the trailing newline editors usually add.
+func (p fileSecrets) Secret(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(p.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %s: %v", name, err)
+	}
+	return []byte(strings.TrimRight(string(data), "\r\n")), nil
+}
+
+// minSecretBytes is the shortest JWT or peer secret accepted, as HMAC-SHA256 keys must be at least as long as its hash.
+const minSecretBytes = 32
+
+// Bounds of the backoff between attempts to fetch a secret after a failure.
+const (
+	secretRetryMin = time.Second
+	secretRetryMax = 5 * time.Minute
+)
+
+// Secret refresh metrics, published through expvar alongside the RPC metrics.
+var (
+	secretRefreshes           = expvar.NewMap("tango_secret_refreshes")            // Successful fetches, keyed by secret.
+	secretRefreshFailures     = expvar.NewMap("tango_secret_refresh_failures")     // Failed fetches, keyed by secret.
+	secretConsecutiveFailures = expvar.NewMap("tango_secret_consecutive_failures") // Failures since the last successful fetch, keyed by secret.
+	secretRotations           = expvar.NewMap("tango_secret_rotations")            // Changes of value picked up, keyed by secret.
+)
+
+// The secrets Tango uses, refreshed from the secret provider. The server certificate and key are reloaded
+// by the TLS credentials instead, along with the CAs.
+var (
+	jwtSecret       = &rotatingSecret{name: secretJWT, check: checkSecretLength}
+	testTokenSecret = &rotatingSecret{name: secretTestToken}
+	peerSecret      = &rotatingSecret{name: secretPeer, check: checkSecretLength}
+	rotatingSecrets = []*rotatingSecret{jwtSecret, testTokenSecret, peerSecret}
+)
+
+// rotatingSecret caches a secret fetched from the secret provider and refreshes it periodically,
+// so a rotated secret is picked up without a restart. A failed fetch is retried with exponential backoff,
+// and the last value fetched stays in use meanwhile. The value it replaced on rotation is kept for a grace window.
+type rotatingSecret struct {
+	name  string
+	check func([]byte) error // Validates fetched values, if set; invalid values are refused like failed fetches.
+
+	refreshMu sync.Mutex // Serializes fetches.
+
+	requested atomic.Bool // Whether the secret has been asked for; secrets never used are not refreshed.
+
+	mu            sync.RWMutex
+	value         []byte    // Last value fetched, or nil before the first successful fetch.
+	previous      []byte    // Value replaced by the last rotation.
+	previousUntil time.Time // End of the grace window of the previous value.
+	err           error     // Error of the last fetch, if it failed.
+	failures      int       // Failed fetches since the last successful one.
+	nextRefresh   time.Time // Time the secret is due to be fetched again.
+}
+
+// due reports whether the secret should be fetched. The caller must hold rs.mu.
+func (rs *rotatingSecret) due(now time.Time) bool {
+	return rs.value == nil && rs.err == nil || !now.Before(rs.nextRefresh)
+}
+
+// get returns the secret, fetching it first if it is due. Once fetched, the secret is returned
+// even when refreshing it fails. Before that, the error of the last fetch is returned,
+// and the fetch is retried once its backoff has elapsed.
+func (rs *rotatingSecret) get() ([]byte, error) {
+	return rs.getAt(time.Now())
+}
+
+// getAt returns the secret like get, as of the given time.
+func (rs *rotatingSecret) getAt(now time.Time) ([]byte, error) {
+	rs.requested.Store(true)
+	rs.mu.RLock()
+	due := rs.due(now)
+	rs.mu.RUnlock()
+	if due {
+		rs.refresh(now)
+	}
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	if rs.value == nil {
+		return nil, rs.err
+	}
+	return rs.value, nil
+}
+
+// refresh fetches the secret from the secret provider if it is still due, and records the outcome in the metrics.
+// On rotation, the value replaced remains valid for secrets.grace_seconds.
+func (rs *rotatingSecret) refresh(now time.Time) error {
+	rs.refreshMu.Lock()
+	defer rs.refreshMu.Unlock()
+	rs.mu.RLock()
+	due := rs.due(now)
+	rs.mu.RUnlock()
+	if !due {
+		return nil
+	}
+
+	value, err := fetchSecret(rs.name)
+	if err == nil && len(value) == 0 {
+		err = errors.New("secret is empty")
+	}
+	if err == nil && rs.check != nil {
+		err = rs.check(value)
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err != nil {
+		rs.failures++
+		rs.err = fmt.Errorf("failed to fetch %s: %v", rs.name, err)
+		rs.nextRefresh = now.Add(backoff(rs.failures, secretRetryMin, secretRetryMax))
+		secretRefreshFailures.Add(rs.name, 1)
+		setSecretMetric(secretConsecutiveFailures, rs.name, int64(rs.failures))
+		return rs.err
+	}
+	if rs.value != nil && !bytes.Equal(rs.value, value) {
+		rs.previous = rs.value
+		rs.previousUntil = now.Add(time.Duration(AppConfig.Secrets.GraceSeconds) * time.Second)
+		secretRotations.Add(rs.name, 1)
+		log.Printf("Secret %s rotated", rs.name)
+	}
+	rs.value, rs.err, rs.failures = value, nil, 0
+	rs.nextRefresh = now.Add(secretRefreshInterval())
+	secretRefreshes.Add(rs.name, 1)
+	setSecretMetric(secretConsecutiveFailures, rs.name, 0)
+	return nil
+}
+
+// values returns the current value of the secret, followed by the value it replaced while within its grace window.
+func (rs *rotatingSecret) values(now time.Time) ([][]byte, error) {
+	current, err := rs.getAt(now)
+	if err != nil {
+		return nil, err
+	}
+	values := [][]byte{current}
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	if rs.previous != nil && now.Before(rs.previousUntil) {
+		values = append(values, rs.previous)
+	}
+	return values, nil
+}
+
+// secretRefreshInterval returns how often secrets are refreshed, every five minutes unless configured.
+func secretRefreshInterval() time.Duration {
+	if AppConfig.Secrets.RefreshSeconds > 0 {
+		return time.Duration(AppConfig.Secrets.RefreshSeconds) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// backoff returns the delay before trying again after the given number of consecutive failures:
+// the minimum delay, doubled after every failure but the first, up to the maximum delay.
+func backoff(failures int, minDelay, maxDelay time.Duration) time.Duration {
+	delay := minDelay
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
+
+// setSecretMetric sets the gauge of the secret in the metric map.
+func setSecretMetric(m *expvar.Map, name string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	m.Set(name, v)
+}
+
+// refreshSecrets refreshes the secrets Tango has used as they come due, so rotated secrets are picked up
+// and failed fetches retried without waiting for a request to need them. It returns once stop is closed.
+func refreshSecrets(stop <-chan struct{}) {
+	ticker := time.NewTicker(secretRetryMin)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-stop:
+			return
+		case now = <-ticker.C:
+		}
+		for _, rs := range rotatingSecrets {
+			if !rs.requested.Load() {
+				continue
+			}
+			rs.mu.RLock()
+			due := rs.due(now)
+			rs.mu.RUnlock()
+			if !due {
+				continue
+			}
+			if err := rs.refresh(now); err != nil {
+				log.Printf("Failed to refresh secret, retrying with backoff: %v", err)
+			}
+		}
+	}
+}
+
+// checkSecretLength refuses secrets too short to key HMAC-SHA256 securely, as HS256 tokens and peer signatures are.
+func checkSecretLength(secret []byte) error {
+	if len(secret) < minSecretBytes {
+		return fmt.Errorf("secret is %d bytes long, at least %d are required", len(secret), minSecretBytes)
+	}
+	return nil
+}
+
+// LoadJWTSecret fetches the JWT secret at startup, so the server refuses to start rather than serve without
+// a usable key. A server verifying tokens with a JWKS, or signing them with its own private key,
+// may start without a JWT secret; HS256 tokens are then refused until the secret can be fetched.
+func LoadJWTSecret() error {
+	if _, err := jwtSecret.get(); err != nil {
+		if AppConfig.Tokens.JWKS == "" && AppConfig.Tokens.SigningKey == "" {
+			return err
+		}
+		log.Printf("Starting without a JWT secret, HS256 tokens are refused until it can be fetched: %v", err)
+	}
+	return nil
+}
+
+// getTangoJWTSecret returns the current Tango JWT secret, which new HS256 tokens are signed with,
+// fetching it from the secret provider when it is due. Returns an error if it has never been fetched successfully.
+func getTangoJWTSecret() (string, error) {
+	secret, err := jwtSecret.get()
+	return string(secret), err
+}
+
+// jwtVerificationSecrets returns the JWT secrets HS256 tokens are verified with: the current one,
+// and the one it replaced while within the grace window, so tokens signed before a rotation stay valid.
+func jwtVerificationSecrets() ([]string, error) {
+	values, err := jwtSecret.values(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]string, len(values))
+	for i, value := range values {
+		secrets[i] = string(value)
+	}
+	return secrets, nil
+}
+
+// GetTestToken returns the test token from the secret provider, refreshed periodically.
+// Returns the test token as a string or an error if it has never been fetched successfully.
+func GetTestToken() (string, error) {
+	token, err := testTokenSecret.get()
+	return string(token), err
+}
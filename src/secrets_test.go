@@ -0,0 +1,231 @@
+package tango
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// withSecrets reads secrets through the provider of the configuration for the duration of the test,
+// with JWT and peer secrets never fetched before.
+func withSecrets(t *testing.T, cfg SecretsConfig) {
+	t.Helper()
+	provider, err := newSecretProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretProviderMu.Lock()
+	savedConfig, savedProvider, savedJWT, savedPeer := AppConfig.Secrets, secretProvider, jwtSecret, peerSecret
+	AppConfig.Secrets, secretProvider = cfg, provider
+	secretProviderMu.Unlock()
+	jwtSecret = &rotatingSecret{name: secretJWT, check: checkSecretLength}
+	peerSecret = &rotatingSecret{name: secretPeer, check: checkSecretLength}
+	t.Cleanup(func() {
+		secretProviderMu.Lock()
+		AppConfig.Secrets, secretProvider = savedConfig, savedProvider
+		secretProviderMu.Unlock()
+		jwtSecret, peerSecret = savedJWT, savedPeer
+	})
+}
+
+// TestNewSecretProvider checks that the secret provider is selected by the configuration,
+// and that unknown or incomplete configurations are refused.
+func TestNewSecretProvider(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  SecretsConfig
+		want SecretProvider // Nil when the configuration must be refused.
+	}{
+		{"default", SecretsConfig{}, gcpSecrets{}},
+		{"gcp", SecretsConfig{Provider: secretsProviderGCP}, gcpSecrets{}},
+		{"env", SecretsConfig{Provider: secretsProviderEnv, EnvPrefix: "APP_"}, envSecrets{prefix: "APP_"}},
+		{"env with the default prefix", SecretsConfig{Provider: secretsProviderEnv}, envSecrets{prefix: "TANGO_"}},
+		{"file", SecretsConfig{Provider: secretsProviderFile, Dir: "/run/secrets"}, fileSecrets{dir: "/run/secrets"}},
+		{"file without a dir", SecretsConfig{Provider: secretsProviderFile}, nil},
+		{"unknown", SecretsConfig{Provider: "vault"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newSecretProvider(tt.cfg)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("newSecretProvider = %#v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("newSecretProvider = %#v, %v, want %#v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoadSecretProvider checks that the secret provider is built once, and that a misconfigured one fails at startup.
+func TestLoadSecretProvider(t *testing.T) {
+	secretProviderMu.Lock()
+	savedConfig, savedProvider := AppConfig.Secrets, secretProvider
+	AppConfig.Secrets, secretProvider = SecretsConfig{Provider: "vault"}, nil
+	secretProviderMu.Unlock()
+	t.Cleanup(func() { AppConfig.Secrets, secretProvider = savedConfig, savedProvider })
+
+	if err := LoadSecretProvider(); err == nil {
+		t.Error("loaded an unknown secret provider")
+	}
+	AppConfig.Secrets = SecretsConfig{Provider: secretsProviderEnv, EnvPrefix: "TANGO_TEST_"}
+	if err := LoadSecretProvider(); err != nil {
+		t.Fatal(err)
+	}
+	AppConfig.Secrets = SecretsConfig{Provider: secretsProviderFile, Dir: t.TempDir()}
+	if _, err := fetchSecret(secretJWT); err != nil {
+		t.Errorf("secret not read through the provider loaded at startup: %v", err)
+	}
+}
+
+// TestAuthenticationFailsClosed checks that HS256 tokens are refused with Unavailable, and the server refuses to start
+// without a JWKS, when the JWT secret is missing, empty, too short or cannot be fetched; and that coordinators
+// cannot authenticate one another with such a peer secret.
+func TestAuthenticationFailsClosed(t *testing.T) {
+	withTokenChecks(t, "", "", 0, 0)
+	const secret = "0123456789abcdef0123456789abcdef"
+	token := signHS256(t, map[string]any{"consumerId": "alice", "roles": []string{roleConsumer}, "exp": time.Now().Add(time.Minute).Unix()}, secret)
+	dir := t.TempDir()
+	write := func(name, value string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		cfg     SecretsConfig
+		secrets map[string]string
+		valid   bool
+	}{
+		{"valid", SecretsConfig{Provider: secretsProviderFile, Dir: dir}, map[string]string{secretJWT: secret, secretPeer: secret}, true},
+		{"missing", SecretsConfig{Provider: secretsProviderFile, Dir: dir}, nil, false},
+		{"empty", SecretsConfig{Provider: secretsProviderFile, Dir: dir}, map[string]string{secretJWT: "", secretPeer: ""}, false},
+		{"too short", SecretsConfig{Provider: secretsProviderFile, Dir: dir}, map[string]string{secretJWT: secret[:31], secretPeer: secret[:31]}, false},
+		{"unfetchable", SecretsConfig{Provider: secretsProviderEnv, EnvPrefix: "TANGO_UNSET_"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, secretJWT))
+			os.Remove(filepath.Join(dir, secretPeer))
+			for name, value := range tt.secrets {
+				write(name, value)
+			}
+			withSecrets(t, tt.cfg)
+
+			_, err := authenticate(metadata.NewIncomingContext(context.Background(), metadata.Pairs(tokenHeader, token)))
+			if tt.valid && err != nil {
+				t.Errorf("authenticate = %v, want success", err)
+			}
+			if !tt.valid && status.Code(err) != codes.Unavailable {
+				t.Errorf("authenticate = %v, want Unavailable", err)
+			}
+			if err := LoadJWTSecret(); (err == nil) != tt.valid {
+				t.Errorf("LoadJWTSecret = %v, want valid %v", err, tt.valid)
+			}
+			if err := checkPeerAuthentication(); (err == nil) != tt.valid {
+				t.Errorf("checkPeerAuthentication = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+// TestRotatingSecret checks, on a fake clock, that a secret is refreshed as it comes due, that a failed fetch
+// is retried with exponential backoff while the last value fetched stays in use, and that the value replaced
+// by a rotation is served for the grace window only.
+func TestRotatingSecret(t *testing.T) {
+	dir := t.TempDir()
+	withSecrets(t, SecretsConfig{Provider: secretsProviderFile, Dir: dir, RefreshSeconds: 10, GraceSeconds: 60})
+	path := filepath.Join(dir, secretJWT)
+	write := func(value string) {
+		if err := os.WriteFile(path, []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const a, b = "secret a, 0123456789abcdef012345", "secret b, 0123456789abcdef012345"
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	rs := &rotatingSecret{name: secretJWT, check: checkSecretLength}
+	at := func(seconds float64) time.Time { return start.Add(time.Duration(seconds * float64(time.Second))) }
+	expect := func(now time.Time, want ...string) {
+		t.Helper()
+		values, err := rs.values(now)
+		if err != nil {
+			t.Fatalf("values at %v: %v", now.Sub(start), err)
+		}
+		var got []string
+		for _, value := range values {
+			got = append(got, string(value))
+		}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("values at %v = %q, want %q", now.Sub(start), got, want)
+		}
+	}
+	expectRetry := func(failures int, next time.Time) {
+		t.Helper()
+		rs.mu.RLock()
+		defer rs.mu.RUnlock()
+		if rs.failures != failures || !rs.nextRefresh.Equal(next) {
+			t.Errorf("failures %d, next refresh at %v, want %d at %v", rs.failures, rs.nextRefresh.Sub(start), failures, next.Sub(start))
+		}
+	}
+
+	// Before the first successful fetch, failures are returned, and retried only once their backoff has elapsed.
+	if _, err := rs.getAt(at(0)); err == nil {
+		t.Fatal("got a secret that does not exist")
+	}
+	expectRetry(1, at(1))
+	write(a)
+	if _, err := rs.getAt(at(0.5)); err == nil {
+		t.Error("fetched the secret again before its backoff elapsed")
+	}
+	expect(at(1), a)
+	expectRetry(0, at(11))
+
+	// A rotation is picked up once due, and the previous value is served alongside for the grace window.
+	write(b)
+	expect(at(10), a)
+	expect(at(11), b, a)
+
+	// Failed fetches keep the current value in use, and are retried after 1s, then 2s, then 4s.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expect(at(21), b, a)
+	expectRetry(1, at(22))
+	expect(at(21.5), b, a)
+	expectRetry(1, at(22))
+	expect(at(22), b, a)
+	expectRetry(2, at(24))
+	write(a[:31])
+	expect(at(24), b, a)
+	expectRetry(3, at(28))
+
+	// The previous value is refused once the grace window has elapsed.
+	write(b)
+	expect(at(70), b, a)
+	expect(at(71), b)
+}
+
+// TestRefreshSecretsStops checks that the background refresh of secrets returns once stopped.
+func TestRefreshSecretsStops(t *testing.T) {
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		refreshSecrets(stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("secret refresh still running after stop")
+	}
+}
@@ -1,61 +1,284 @@
 package tango
 
 import (
+	"context"
+	"errors"
+	"log"
 	"sync"
+	"sync/atomic"
 	pb "tango/tango/src/protobuff"
 	"time"
 )
 
 // server implements the TangoServiceServer interface and manages job processing.
-// It maintains a map of active jobs, a job queue, and a read-write mutex for safe concurrent access.
+// Jobs and the job queue are kept in a JobStore; the server itself maintains a registry of devices
+// and the scheduling, quota and memory bookkeeping built on top of the store.
 type server struct {
 	pb.UnimplementedTangoServiceServer
-	jobsMu   sync.RWMutex
-	jobs     map[string]*Job
-	jobQueue []string
+	store      JobStore
+	submitMu   sync.Mutex // Serializes quota admission with job creation.
+	refreshMu  sync.Mutex // Serializes token refreshes, so each refresh token is used at most once.
+	devicesMu  sync.RWMutex
+	devices    map[string]*Device
+	fair       *fairShare
+	quotas     *quotaTracker
+	memory     *memoryBudget
+	ledger     *ledger       // Billing ledger of the shards computed on this coordinator.
+	sink       RecordsSink   // Where the records of the ledger are shipped.
+	prices     *priceTable   // Prices the ledger's shards for billing reports.
+	cluster    *raftStore    // The replicated store in cluster mode, nil otherwise.
+	federation *federation   // The federation members in federation mode, nil otherwise.
+	draining   atomic.Bool   // Set once the server stops handing out shards and accepting jobs.
+	stop       chan struct{} // Closed by Close to stop background goroutines.
+	background sync.WaitGroup
+	closeOnce  sync.Once
 }
 
 // NewServer creates and initializes a new server instance.
-// It sets up an empty jobs map and job queue, and starts a background goroutine to reap expired tasks.
-func NewServer() *server {
+// It opens the configured job store, which rebuilds jobs, the job queue and devices from the
+// write-ahead log when persistence is enabled, and sets up the device registry, fair-share scheduler,
+// quota tracker and memory budget, opens the billing ledger in the configured records directory,
+// and loads the price tables of billing reports. Jobs recovered with every shard result are then completed.
+// In cluster mode, devices and memory accounting are restored and such jobs completed again whenever
+// this coordinator becomes the leader, since the replicated state changed underneath it while it was a follower.
+// In federation and cluster mode, other coordinators must be authenticated, by mutual TLS or the peer secret;
+// in federation mode, it also sets up routing to the other members. Finally it starts background goroutines
+// to reap expired tasks, to retry the uploads of records left in the ledger's outbox, to refresh secrets
+// and to reload the JWKS and TLS certificate.
+func NewServer() (*server, error) {
+	if AppConfig.Federation.Enabled || AppConfig.Cluster.Enabled {
+		if err := checkPeerAuthentication(); err != nil {
+			return nil, err
+		}
+	}
+	fed, err := newFederation(AppConfig.Federation)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newJobStore()
+	if err != nil {
+		return nil, err
+	}
+	s := newServerWithStore(store)
+	s.federation = fed
+	if dir := AppConfig.Records.Dir; dir != "" {
+		ledger, err := openLedger(dir, AppConfig.Records.Fsync)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.ledger = ledger
+	} else {
+		log.Printf("Keeping the billing ledger in memory, as records.dir is not set: it grows until the server stops and is lost then")
+	}
+	if s.sink, err = newRecordsSink(AppConfig.Records); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.prices, err = newPriceTable(AppConfig.Billing); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.finishRecoveredJobs()
+	if s.cluster != nil {
+		s.cluster.onPromoted(func() {
+			s.loadFromStore()
+			s.finishRecoveredJobs()
+		})
+	}
+	s.background.Add(2)
+	go s.shipOutbox()
+	go func() {
+		defer s.background.Done()
+		refreshSecrets(s.stop)
+	}()
+	if ks, interval := activeKeySet.Load(), time.Duration(AppConfig.Tokens.JWKSRefreshSeconds)*time.Second; ks != nil && interval > 0 {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			ks.reloadEvery(interval, s.stop)
+		}()
+	}
+	if r := activeTLS.Load(); r != nil && r.cfg.ReloadIntervalSeconds > 0 {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			r.reloadEvery(time.Duration(r.cfg.ReloadIntervalSeconds)*time.Second, s.stop)
+		}()
+	}
+	return s, nil
+}
+
+// newServerWithStore creates a server backed by the given job store,
+// restoring the devices and memory accounting of any jobs already in it.
+func newServerWithStore(store JobStore) *server {
 	s := &server{
-		jobs:     make(map[string]*Job),
-		jobQueue: make([]string, 0),
+		store:   store,
+		devices: make(map[string]*Device),
+		fair:    newFairShare(),
+		quotas:  newQuotaTracker(),
+		memory:  newMemoryBudget(),
+		ledger:  newMemoryLedger(),
+		stop:    make(chan struct{}),
+	}
+	s.loadFromStore()
+	if cluster, ok := store.(*raftStore); ok {
+		s.cluster = cluster
 	}
+	s.background.Add(1)
 	go s.reapExpiredTasks()
 	return s
 }
 
-// reapExpiredTasks periodically scans through all jobs to remove pending tasks that have exceeded their deadlines.
-// The interval between scans is defined by the application's configuration.
+// loadFromStore refreshes the device registry, memory accounting and daily FLOP quota counters from the job store.
+func (s *server) loadFromStore() {
+	s.devicesMu.Lock()
+	for _, device := range s.store.Devices() {
+		s.devices[device.DeviceID] = device
+	}
+	s.devicesMu.Unlock()
+	jobs := s.store.List()
+	for _, job := range jobs {
+		s.refreshMemory(job)
+	}
+	s.quotas.restore(jobs, time.Now())
+}
+
+// finishRecoveredJobs completes the jobs of the store that hold every shard result but were never completed,
+// as happens when the coordinator crashed between storing a job's last result and completing it,
+// or when the leader of a cluster failed over in between. Such jobs would otherwise never complete,
+// since they have no shard left to hand out. Followers of a cluster leave them to the leader.
+func (s *server) finishRecoveredJobs() {
+	if s.cluster != nil && !s.cluster.isReady() {
+		return
+	}
+	for _, job := range s.store.Queued() {
+		job.mu.Lock()
+		stuck := job.CompletedAt == 0 && job.isComplete()
+		job.mu.Unlock()
+		if stuck {
+			log.Printf("Completing job %s, recovered with every shard result", job.JobID)
+			s.finishJob(job)
+			s.refreshMemory(job)
+		}
+	}
+}
+
+// reapExpiredTasks periodically scans through all jobs to remove pending tasks that have exceeded their deadlines,
+// prunes completed jobs past their retention, and spills cold job data to disk if memory usage is above the high watermark.
+// The interval between scans is defined by the application's configuration. It returns once the server is closed.
 func (s *server) reapExpiredTasks() {
+	defer s.background.Done()
 	interval := time.Duration(AppConfig.Task.ReaperIntervalMilliseconds) * time.Millisecond
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
 		now := time.Now().UnixNano()
-		s.jobsMu.Lock()
-		for _, job := range s.jobs {
+		for _, job := range s.store.Queued() {
+			job.mu.Lock()
 			for shard, td := range job.PendingTasks {
 				if now > td.Deadline {
 					delete(job.PendingTasks, shard)
 				}
 			}
+			job.mu.Unlock()
+		}
+		s.pruneCompletedJobs(now)
+		if limit := highWatermark(); limit > 0 {
+			s.relieveMemoryPressure(limit)
+		}
+	}
+}
+
+// pruneCompletedJobs removes the jobs completed longer than store.completed_retention_seconds ago from the store,
+// along with their final results. Jobs submitted during the current UTC day are kept until it ends, since
+// the daily FLOP quotas are rebuilt from them after a restart or failover. Followers of a cluster leave them to the leader.
+func (s *server) pruneCompletedJobs(now int64) {
+	retention := int64(AppConfig.Store.CompletedRetentionSeconds) * int64(time.Second)
+	if retention <= 0 || (s.cluster != nil && !s.cluster.isReady()) {
+		return
+	}
+	for _, job := range s.store.List() {
+		job.mu.Lock()
+		expired := job.CompletedAt != 0 && now-job.CompletedAt > retention && quotaDay(time.Unix(0, job.SubmittedAt)) != quotaDay(time.Unix(0, now))
+		job.mu.Unlock()
+		if !expired {
+			continue
+		}
+		if err := s.store.Delete(job.JobID); err != nil {
+			log.Printf("Failed to prune completed job %s: %v", job.JobID, err)
+			continue
 		}
-		s.jobsMu.Unlock()
+		s.memory.set(job.JobID, 0)
 	}
 }
 
 // RemoveDevicePendingTasks removes all pending tasks associated with the specified deviceID from all jobs.
-// It ensures thread-safe access by locking the jobs map during the operation.
 func (s *server) RemoveDevicePendingTasks(deviceID string) {
-	s.jobsMu.Lock()
-	defer s.jobsMu.Unlock()
-	for _, job := range s.jobs {
+	for _, job := range s.store.Queued() {
+		job.mu.Lock()
 		for shard, td := range job.PendingTasks {
 			if td.DeviceID == deviceID {
 				delete(job.PendingTasks, shard)
 			}
 		}
+		job.mu.Unlock()
+	}
+}
+
+// Drain puts the server in drain mode: FetchTask stops handing out shards and SubmitTask stops accepting jobs,
+// both with an Unavailable error so clients move to another coordinator, while results of shards
+// already leased are still accepted.
+func (s *server) Drain() {
+	if !s.draining.Swap(true) {
+		log.Printf("Draining: no new shards or jobs will be accepted")
 	}
 }
+
+// outstandingLeases returns the number of leased shards whose deadline has not passed yet.
+func (s *server) outstandingLeases() int {
+	now := time.Now().UnixNano()
+	leases := 0
+	for _, job := range s.store.Queued() {
+		job.mu.Lock()
+		for _, td := range job.PendingTasks {
+			if td.Deadline > now {
+				leases++
+			}
+		}
+		job.mu.Unlock()
+	}
+	return leases
+}
+
+// WaitForDrain blocks until every outstanding lease has been reported or has expired,
+// or until the context is done, in which case it returns the context's error.
+func (s *server) WaitForDrain(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for s.outstandingLeases() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Close stops the server's background goroutines, syncs the billing ledger to disk and closes the job store,
+// persisting its state. It must only be called once no RPCs are in flight. Calling Close again is a no-op.
+func (s *server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.background.Wait()
+		err = errors.Join(s.ledger.close(), s.store.Close())
+	})
+	return err
+}
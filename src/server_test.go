@@ -0,0 +1,132 @@
+package tango
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMain points every path of the configuration at a temporary directory and keeps all state in memory
+// unless a test enables persistence, so tests neither read nor leave files in the working directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "tango-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("TANGO_TEST_JWT_SECRET", "test-secret-0123456789abcdef-0123456789")
+	os.Setenv("TANGO_TEST_PEER_SECRET", "test-peer-secret-0123456789abcdef-0123")
+	AppConfig.Secrets = SecretsConfig{Provider: "env", EnvPrefix: "TANGO_TEST_"}
+	AppConfig.Store = StoreConfig{Dir: filepath.Join(dir, "store")}
+	AppConfig.Records = RecordsConfig{Sink: recordsSinkLocal, ExportDir: filepath.Join(dir, "records")}
+	AppConfig.Memory.SpillDir = filepath.Join(dir, "spill")
+	AppConfig.Tokens.RevocationFile = filepath.Join(dir, "revocations.json")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testContext returns the context of a request authenticated as the consumer, on behalf of the device if one is given.
+func testContext(consumerID, deviceID string) context.Context {
+	ctx := context.WithValue(context.Background(), "consumerID", consumerID)
+	if deviceID != "" {
+		ctx = context.WithValue(ctx, "deviceID", deviceID)
+	}
+	return ctx
+}
+
+// testMatrix returns a rows×cols matrix serialized as JSON, as submitted by clients.
+func testMatrix(t *testing.T, rows, cols int) []byte {
+	t.Helper()
+	matrix := make([][]float32, rows)
+	for i := range matrix {
+		matrix[i] = make([]float32, cols)
+		for j := range matrix[i] {
+			matrix[i][j] = float32(i + j)
+		}
+	}
+	data, err := json.Marshal(matrix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestDrainAndClose checks that a draining server refuses new jobs and shards with Unavailable while still accepting
+// the results of leased shards, that WaitForDrain returns once those are reported, and that Close then stops
+// the background goroutines.
+func TestDrainAndClose(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := testContext("alice", "")
+	reg, err := s.RegisterDevice(ctx, &pb.DeviceRegistration{Operations: []string{"matmul"}, MemoryBytes: 1 << 30, FlopsPerSecond: 1e9})
+	if err != nil || !reg.Accepted {
+		t.Fatalf("RegisterDevice: %v %v", reg, err)
+	}
+	ctx = testContext("alice", reg.DeviceId)
+	job := &pb.TaskRequest{JobId: "in-flight", Operation: "matmul", AData: testMatrix(t, 2, 1), BData: testMatrix(t, 1, 2), RowSplits: 2, ColSplits: 1}
+	if submitted, err := s.SubmitTask(ctx, job); err != nil || !submitted.Accepted {
+		t.Fatalf("SubmitTask: %v %v", submitted, err)
+	}
+	leased, err := s.FetchTask(ctx, &pb.DeviceRequest{DeviceId: reg.DeviceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Drain()
+	job.JobId = "late"
+	if _, err := s.SubmitTask(ctx, job); status.Code(err) != codes.Unavailable {
+		t.Errorf("SubmitTask while draining = %v, want Unavailable", err)
+	}
+	if _, err := s.FetchTask(ctx, &pb.DeviceRequest{DeviceId: reg.DeviceId}); status.Code(err) != codes.Unavailable {
+		t.Errorf("FetchTask while draining = %v, want Unavailable", err)
+	}
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.WaitForDrain(short); err != context.DeadlineExceeded {
+		t.Errorf("WaitForDrain with a shard leased = %v, want the deadline exceeded", err)
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		wait, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		drained <- s.WaitForDrain(wait)
+	}()
+	index, _ := extractShardIndex(leased.TaskId)
+	results := map[int]string{1: "0 1", 2: "1 2"}
+	if _, err := s.ReportResult(ctx, &pb.TaskResult{DeviceId: reg.DeviceId, JobId: "in-flight", TaskId: leased.TaskId, ResultData: []byte(results[index])}); err != nil {
+		t.Fatalf("ReportResult while draining: %v", err)
+	}
+	if err := <-drained; err != nil {
+		t.Errorf("WaitForDrain after the leased shard was reported = %v", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return: background goroutines still running")
+	}
+	select {
+	case <-s.stop:
+	default:
+		t.Error("background goroutines not signalled to stop")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close = %v, want a no-op", err)
+	}
+}
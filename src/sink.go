@@ -0,0 +1,312 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Records sinks selectable under records.sink.
+const (
+	recordsSinkLocal = "local" // Files in a local directory.
+	recordsSinkGCS   = "gcs"   // Objects in the GCS bucket named by gcp.records_bucket.
+	recordsSinkS3    = "s3"    // Objects in a bucket of an S3-compatible object store.
+)
+
+// Names of the secrets holding the credentials of the S3-compatible object store.
+const (
+	secretS3AccessKeyID     = "s3_access_key_id"
+	secretS3SecretAccessKey = "s3_secret_access_key"
+)
+
+// Bounds of the backoff between attempts to upload a batch of the outbox after a failure.
+const (
+	recordsRetryMin = time.Second
+	recordsRetryMax = 5 * time.Minute
+)
+
+// recordsUploadTimeout bounds the time an upload may take.
+const recordsUploadTimeout = time.Minute
+
+// Records metrics, published through expvar alongside the RPC metrics.
+var (
+	recordsUploaded       = expvar.NewInt("tango_records_uploaded")        // Ledger entries uploaded.
+	recordsUploadFailures = expvar.NewMap("tango_records_upload_failures") // Failed uploads, keyed by sink.
+	recordsOutbox         = expvar.NewInt("tango_records_outbox")          // Batches staged in the outbox, awaiting upload.
+)
+
+// RecordsSink stores exported ledger records as named objects. Putting an object that exists replaces it,
+// so a batch uploaded again after a failure does not duplicate records.
+type RecordsSink interface {
+	Put(ctx context.Context, object string, data []byte) error
+}
+
+// sinkName returns the name of the records sink, as selected under records.sink, to key its metrics by.
+func sinkName(sink RecordsSink) string {
+	switch sink.(type) {
+	case localSink:
+		return recordsSinkLocal
+	case gcsSink:
+		return recordsSinkGCS
+	case *s3Sink:
+		return recordsSinkS3
+	default:
+		return "other"
+	}
+}
+
+// newRecordsSink returns the records sink selected by the configuration.
+// GCS is used when none is selected, as it was the only sink before others were introduced.
+func newRecordsSink(cfg RecordsConfig) (RecordsSink, error) {
+	switch cfg.Sink {
+	case "", recordsSinkGCS:
+		if AppConfig.GCP.RecordsBucket == "" {
+			return nil, fmt.Errorf("record bucket not set in config")
+		}
+		return gcsSink{bucket: AppConfig.GCP.RecordsBucket}, nil
+	case recordsSinkLocal:
+		if cfg.ExportDir == "" {
+			return nil, fmt.Errorf("the local records sink needs a records.export_dir")
+		}
+		return localSink{dir: cfg.ExportDir}, nil
+	case recordsSinkS3:
+		if cfg.S3.Endpoint == "" || cfg.S3.Bucket == "" {
+			return nil, fmt.Errorf("the s3 records sink needs records.s3.endpoint and records.s3.bucket")
+		}
+		region := cfg.S3.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &s3Sink{endpoint: strings.TrimSuffix(cfg.S3.Endpoint, "/"), bucket: cfg.S3.Bucket, region: region}, nil
+	default:
+		return nil, fmt.Errorf("unknown records sink %q", cfg.Sink)
+	}
+}
+
+// localSink writes records to files in a local directory, for local runs and tests.
+type localSink struct {
+	dir string
+}
+
+// Put writes the object to a file of the same name, replacing any previous one atomically.
+// Names that are not plain file names, or that start with a dot, are refused rather than rewritten,
+// so distinct objects never end up in the same file.
+func (ls localSink) Put(ctx context.Context, object string, data []byte) error {
+	if object != filepath.Base(object) || strings.HasPrefix(object, ".") {
+		return fmt.Errorf("invalid object name %q", object)
+	}
+	if err := os.MkdirAll(ls.dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(ls.dir, object)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// gcsSink uploads records to a Google Cloud Storage bucket.
+type gcsSink struct {
+	bucket string
+}
+
+// Put uploads the object to the bucket.
+func (gs gcsSink) Put(ctx context.Context, object string, data []byte) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+
+	writer := client.Bucket(gs.bucket).Object(object).NewWriter(ctx)
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write records to GCS: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close GCS writer: %v", err)
+	}
+	return nil
+}
+
+// s3Sink uploads records to a bucket of an S3-compatible object store, such as MinIO, addressing it
+// by path. Requests are signed with AWS Signature Version 4, with credentials read from the secret provider.
+type s3Sink struct {
+	endpoint string // Base URL of the object store, such as "http://localhost:9000".
+	bucket   string
+	region   string
+	client   http.Client
+}
+
+// Put uploads the object to the bucket with a signed PUT request.
+func (ss *s3Sink) Put(ctx context.Context, object string, data []byte) error {
+	accessKeyID, err := fetchSecret(secretS3AccessKeyID)
+	if err != nil {
+		return err
+	}
+	secretAccessKey, err := fetchSecret(secretS3SecretAccessKey)
+	if err != nil {
+		return err
+	}
+	target, err := url.Parse(ss.endpoint + "/" + s3Escape(ss.bucket) + "/" + s3Escape(object))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/csv")
+	signS3Request(req, data, string(accessKeyID), string(secretAccessKey), ss.region, time.Now().UTC())
+
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// signS3Request signs the request with AWS Signature Version 4, over its host, payload hash and date.
+func signS3Request(req *http.Request, payload []byte, accessKeyID, secretAccessKey, region string, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	hashHex := hex.EncodeToString(payloadHash[:])
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Content-Sha256", hashHex)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + hashHex,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		hashHex,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = generateHmacSha256Signature(part, string(key))
+	}
+	signature := hex.EncodeToString(generateHmacSha256Signature(stringToSign, string(key)))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// s3Escape escapes a bucket or object name for use in a request path, as AWS Signature Version 4 expects:
+// every byte but unreserved characters and slashes is percent-encoded.
+func s3Escape(name string) string {
+	var b strings.Builder
+	for _, c := range []byte(name) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', strings.IndexByte("-._~/", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// shipRecords uploads the records of the job's results not yet shipped from the ledger to the records sink.
+// Records that fail to upload stay in the ledger's outbox, and are retried in the background by shipOutbox.
+func (s *server) shipRecords(jobID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), recordsUploadTimeout)
+	defer cancel()
+	if err := s.ledger.ship(ctx, jobID, s.sink); err != nil {
+		log.Printf("Failed to ship records of job %s, will retry: %v", jobID, err)
+	}
+}
+
+// recordsDue reports whether the records of the job should be shipped: whether the job expects no more results,
+// having every shard result or having been removed from the store.
+func (s *server) recordsDue(jobID string) bool {
+	job, exists := s.store.Lookup(jobID)
+	if !exists {
+		return true
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.isComplete()
+}
+
+// shipOutbox periodically retries the uploads of the batches left in the ledger's outbox, including those
+// staged before a restart, backing off exponentially per job after each failure. It also ships the entries never staged
+// of jobs expecting no more results, as left when the coordinator crashed before shipping them, or when a job's
+// final result could not be reassembled. It returns once the server is closed.
+func (s *server) shipOutbox() {
+	defer s.background.Done()
+	ticker := time.NewTicker(recordsRetryMin)
+	defer ticker.Stop()
+	failures := make(map[string]int)
+	nextAttempt := make(map[string]time.Time)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		jobs := s.ledger.outboxJobs()
+		for _, jobID := range s.ledger.unshippedJobs() {
+			if !slices.Contains(jobs, jobID) && s.recordsDue(jobID) {
+				jobs = append(jobs, jobID)
+			}
+		}
+		for _, jobID := range jobs {
+			if now.Before(nextAttempt[jobID]) {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), recordsUploadTimeout)
+			err := s.ledger.ship(ctx, jobID, s.sink)
+			cancel()
+			if err != nil {
+				failures[jobID]++
+				nextAttempt[jobID] = now.Add(backoff(failures[jobID], recordsRetryMin, recordsRetryMax))
+				log.Printf("Failed to ship records of job %s (attempt %d): %v", jobID, failures[jobID], err)
+				continue
+			}
+			delete(failures, jobID)
+			delete(nextAttempt, jobID)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package tango
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrJobExists is returned by JobStore.Create when a job with the same ID is already stored.
+var ErrJobExists = errors.New("job already exists")
+
+// ErrJobCompleted is returned by JobStore.UpdateShard when the job's final result has already been assembled.
+var ErrJobCompleted = errors.New("job is already complete")
+
+// ErrShardNotLeased is returned by JobStore.UpdateShard when the shard is not leased to the reporting device,
+// including when its result was already stored.
+var ErrShardNotLeased = errors.New("shard is not leased to the device")
+
+// JobStore abstracts where the server keeps its jobs, job queue and device registry,
+// so that persistence, testing and replication can plug in without touching the RPC handlers.
+// Implementations must be safe for concurrent use. The mutable state of each job is still
+// guarded by its own mutex, which the store takes when it updates the job.
+type JobStore interface {
+	// Create adds a new job to the store and appends it to the job queue.
+	// It returns ErrJobExists if a job with the same ID is already stored.
+	Create(job *Job) error
+	// Lookup returns the job with the given ID, queued or completed.
+	Lookup(jobID string) (*Job, bool)
+	// List returns every stored job, queued or completed.
+	List() []*Job
+	// Queued returns the jobs in the job queue, in submission order.
+	Queued() []*Job
+	// ReserveShard leases an available shard of the job to the device and returns its index.
+	ReserveShard(job *Job, now int64, device *Device) (int, bool)
+	// UpdateShard records the result of a shard reported by a device, consuming the shard's lease.
+	// It reports whether this result was the last one the job was waiting for, i.e. whether the job
+	// is now ready to be reassembled. It returns ErrJobCompleted if the job's final result has already
+	// been assembled, and ErrShardNotLeased if the shard is not leased to the device. The lease is checked
+	// and consumed atomically, so of concurrent reports of the same shard only one is stored.
+	// Unless nil, record is called with the lease once checked, before the result is stored, to bill it in the same step:
+	// if record fails, its error is returned, the result is not stored and the lease is kept, so the device can report again.
+	UpdateShard(job *Job, index int, deviceID string, data []byte, record func(lease TimeDeadline) error) (bool, error)
+	// Complete records the job's final result, releases its inputs and removes it from the job queue.
+	// Completing a job twice is a no-op.
+	Complete(job *Job, finalResult []byte) error
+	// Delete removes the job from the store along with any of its data spilled to disk.
+	Delete(jobID string) error
+	// SaveDevice records a registered device.
+	SaveDevice(device *Device) error
+	// Devices returns the devices recorded in the store.
+	Devices() []*Device
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// newJobStore returns the job store selected by the configuration: a replicated store in cluster mode,
+// a disk-backed store when persistence is enabled, and an in-memory one otherwise.
+// Spill files left by a previous run are removed first whatever the store, since no store restores jobs from them.
+func newJobStore() (JobStore, error) {
+	removeStaleSpills()
+	if AppConfig.Cluster.Enabled {
+		return openRaftStore(AppConfig.Cluster)
+	}
+	if AppConfig.Store.Enabled {
+		return openDiskStore(AppConfig.Store.Dir, AppConfig.Store.Fsync)
+	}
+	return newMemoryStore(), nil
+}
+
+// memoryStore is a JobStore that keeps everything in memory and loses it on restart.
+type memoryStore struct {
+	mu    sync.RWMutex
+	jobs  map[string]*Job // All jobs, keyed by job ID.
+	queue []string        // IDs of jobs not completed yet, in submission order.
+}
+
+// newMemoryStore creates an empty in-memory job store.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		jobs:  make(map[string]*Job),
+		queue: make([]string, 0),
+	}
+}
+
+// Create adds a new job to the store and appends it to the job queue.
+func (ms *memoryStore) Create(job *Job) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, exists := ms.jobs[job.JobID]; exists {
+		return ErrJobExists
+	}
+	ms.jobs[job.JobID] = job
+	ms.queue = append(ms.queue, job.JobID)
+	return nil
+}
+
+// Lookup returns the job with the given ID.
+func (ms *memoryStore) Lookup(jobID string) (*Job, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	job, exists := ms.jobs[jobID]
+	return job, exists
+}
+
+// List returns every stored job, in no particular order.
+func (ms *memoryStore) List() []*Job {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	jobs := make([]*Job, 0, len(ms.jobs))
+	for _, job := range ms.jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// Queued returns the jobs in the job queue, in submission order.
+func (ms *memoryStore) Queued() []*Job {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	jobs := make([]*Job, 0, len(ms.queue))
+	for _, jobID := range ms.queue {
+		if job, exists := ms.jobs[jobID]; exists {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// ReserveShard leases an available shard of the job to the device.
+func (ms *memoryStore) ReserveShard(job *Job, now int64, device *Device) (int, bool) {
+	return getAvailableTaskIndex(job, now, device)
+}
+
+// UpdateShard records the result of a shard leased to the device and reports whether the job is now ready to be reassembled.
+func (ms *memoryStore) UpdateShard(job *Job, index int, deviceID string, data []byte, record func(lease TimeDeadline) error) (bool, error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if err := job.checkLease(index, deviceID); err != nil {
+		return false, err
+	}
+	if record != nil {
+		if err := record(job.PendingTasks[index]); err != nil {
+			return false, err
+		}
+	}
+	wasComplete := job.isComplete()
+	job.applyResult(index, data)
+	return !wasComplete && job.isComplete(), nil
+}
+
+// Complete records the job's final result and removes it from the job queue.
+func (ms *memoryStore) Complete(job *Job, finalResult []byte) error {
+	job.mu.Lock()
+	if job.CompletedAt != 0 {
+		job.mu.Unlock()
+		return nil
+	}
+	job.applyComplete(finalResult, time.Now().UnixNano())
+	job.mu.Unlock()
+	ms.dequeue(job.JobID)
+	return nil
+}
+
+// dequeue removes a job from the job queue. The job itself stays in the store
+// so its result can still be retrieved.
+func (ms *memoryStore) dequeue(jobID string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, id := range ms.queue {
+		if id == jobID {
+			ms.queue = append(ms.queue[:i], ms.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Delete removes the job from the store and deletes any of its spilled data.
+func (ms *memoryStore) Delete(jobID string) error {
+	ms.dequeue(jobID)
+	ms.mu.Lock()
+	delete(ms.jobs, jobID)
+	ms.mu.Unlock()
+	for _, part := range []string{"a", "b", "final"} {
+		removeSpill(jobID, part)
+	}
+	return nil
+}
+
+// apply replays a journal entry against the store's jobs and job queue.
+// Submissions of jobs already in the store are ignored, so that entries already reflected
+// in a snapshot can be applied again safely. Register entries are left to the caller.
+func (ms *memoryStore) apply(entry *journalEntry) {
+	switch entry.Type {
+	case entrySubmit:
+		if entry.Job == nil {
+			return
+		}
+		ms.Create(entry.Job.restore())
+	case entryAssign, entryResult, entryComplete:
+		job, exists := ms.Lookup(entry.JobID)
+		if !exists {
+			return
+		}
+		job.mu.Lock()
+		switch entry.Type {
+		case entryAssign:
+			job.applyAssign(entry)
+		case entryResult:
+			job.applyResult(entry.Index, entry.Data)
+		case entryComplete:
+			job.applyComplete(entry.Data, entry.Time)
+		}
+		job.mu.Unlock()
+		if entry.Type == entryComplete {
+			ms.dequeue(entry.JobID)
+		}
+	case entryDelete:
+		ms.Delete(entry.JobID)
+	}
+}
+
+// checkLease returns ErrJobCompleted if the job's final result has been assembled,
+// and ErrShardNotLeased unless the shard is leased to the device. The caller must hold j.mu.
+func (j *Job) checkLease(index int, deviceID string) error {
+	if j.CompletedAt != 0 {
+		return ErrJobCompleted
+	}
+	if lease, leased := j.PendingTasks[index]; !leased || lease.DeviceID != deviceID {
+		return ErrShardNotLeased
+	}
+	return nil
+}
+
+// applyAssign leases the shard named by an assign entry, cutting its row band first if needed.
+// The caller must hold j.mu.
+func (j *Job) applyAssign(entry *journalEntry) {
+	if entry.Band != nil {
+		if _, cut := j.Bands[entry.Index]; !cut {
+			j.Bands[entry.Index] = *entry.Band
+			j.NextRow = max(j.NextRow, entry.Band.End)
+		}
+	}
+	if entry.DeviceID != "" {
+		if _, pending := j.PendingTasks[entry.Index]; !pending {
+			j.AssignedSplits++
+		}
+		j.PendingTasks[entry.Index] = TimeDeadline{Deadline: entry.Deadline, DeviceID: entry.DeviceID}
+	}
+}
+
+// applyResult stores the result of a shard. A repeated result for the same shard,
+// as sent when an expired lease was re-dispatched, replaces the first one without being counted twice.
+// The caller must hold j.mu.
+func (j *Job) applyResult(index int, data []byte) {
+	if j.Results == nil {
+		j.Results = make(map[int][]byte)
+	}
+	delete(j.PendingTasks, index)
+	if _, seen := j.Results[index]; !seen {
+		j.ReceivedUpdates++
+	}
+	j.Results[index] = data
+}
+
+// applyComplete records the job's final result and releases its inputs.
+// The caller must hold j.mu.
+func (j *Job) applyComplete(finalResult []byte, completedAt int64) {
+	j.FinalResult = finalResult
+	j.CompletedAt = completedAt
+	j.PendingTasks = make(map[int]TimeDeadline)
+	j.releaseInputs()
+}
+
+// deviceRegistry is the set of registered devices recorded by a persistent store.
+type deviceRegistry struct {
+	mu      sync.Mutex
+	devices map[string]*Device // Registered devices, keyed by device ID.
+}
+
+// save records a registered device.
+func (dr *deviceRegistry) save(device *Device) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if dr.devices == nil {
+		dr.devices = make(map[string]*Device)
+	}
+	dr.devices[device.DeviceID] = device
+}
+
+// list returns the recorded devices.
+func (dr *deviceRegistry) list() []*Device {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	devices := make([]*Device, 0, len(dr.devices))
+	for _, device := range dr.devices {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// SaveDevice is a no-op, since the server's device registry already holds the device in memory.
+func (ms *memoryStore) SaveDevice(device *Device) error {
+	return nil
+}
+
+// Devices returns nil, since an in-memory store has nothing to restore across restarts.
+func (ms *memoryStore) Devices() []*Device {
+	return nil
+}
+
+// Close is a no-op for the in-memory store.
+func (ms *memoryStore) Close() error {
+	return nil
+}
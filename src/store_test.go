@@ -0,0 +1,108 @@
+package tango
+
+import (
+	"errors"
+	"testing"
+
+	pb "tango/tango/src/protobuff"
+)
+
+// TestJobStore runs the same sequence of changes against every local JobStore implementation and checks
+// they honour the interface's contract: duplicate jobs are refused, results are stored only under a lease
+// held by the reporting device and only if they are recorded, the last result is reported once,
+// and completed jobs leave the queue but can still be looked up until deleted.
+func TestJobStore(t *testing.T) {
+	stores := []struct {
+		name    string
+		open    func(t *testing.T) JobStore
+		devices int // Devices returned once one is saved; the in-memory store keeps none.
+	}{
+		{"memory", func(t *testing.T) JobStore { return newMemoryStore() }, 0},
+		{"disk", func(t *testing.T) JobStore {
+			ds, err := openDiskStore(t.TempDir(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ds
+		}, 1},
+	}
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			store := tt.open(t)
+			defer store.Close()
+			device := &Device{DeviceID: "device_1"}
+			if err := store.SaveDevice(device); err != nil {
+				t.Fatal(err)
+			}
+			if devices := store.Devices(); len(devices) != tt.devices {
+				t.Errorf("Devices = %v, want %d", devices, tt.devices)
+			}
+
+			first := createJob(&pb.TaskRequest{JobId: "first", RowSplits: 2, ColSplits: 1})
+			second := createJob(&pb.TaskRequest{JobId: "second", RowSplits: 1, ColSplits: 1})
+			for _, job := range []*Job{first, second} {
+				if err := store.Create(job); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Create(createJob(&pb.TaskRequest{JobId: "first", RowSplits: 1, ColSplits: 1})); !errors.Is(err, ErrJobExists) {
+				t.Errorf("Create of a duplicate job = %v, want ErrJobExists", err)
+			}
+			if queued := store.Queued(); len(queued) != 2 || queued[0] != first || queued[1] != second {
+				t.Fatalf("Queued = %v, want first then second", queued)
+			}
+
+			index, ok := store.ReserveShard(first, 0, device)
+			if !ok || index != 1 {
+				t.Fatalf("ReserveShard = %d, %v, want shard 1", index, ok)
+			}
+			if _, err := store.UpdateShard(first, index, "device_2", []byte("1"), nil); !errors.Is(err, ErrShardNotLeased) {
+				t.Errorf("UpdateShard by another device = %v, want ErrShardNotLeased", err)
+			}
+			failed := errors.New("ledger unavailable")
+			if _, err := store.UpdateShard(first, index, device.DeviceID, []byte("1"), func(TimeDeadline) error { return failed }); !errors.Is(err, failed) {
+				t.Errorf("UpdateShard failing to record = %v, want the record error", err)
+			}
+			var recorded TimeDeadline
+			last, err := store.UpdateShard(first, index, device.DeviceID, []byte("1"), func(lease TimeDeadline) error {
+				recorded = lease
+				return nil
+			})
+			if err != nil || last {
+				t.Fatalf("UpdateShard of shard 1 = %v, %v, want stored and not last", last, err)
+			}
+			if recorded.DeviceID != device.DeviceID {
+				t.Errorf("recorded lease of %q, want the reporting device's", recorded.DeviceID)
+			}
+			if _, err := store.UpdateShard(first, index, device.DeviceID, []byte("1"), nil); !errors.Is(err, ErrShardNotLeased) {
+				t.Errorf("UpdateShard reported twice = %v, want ErrShardNotLeased", err)
+			}
+			index, _ = store.ReserveShard(first, 0, device)
+			if last, err := store.UpdateShard(first, index, device.DeviceID, []byte("2"), nil); err != nil || !last {
+				t.Fatalf("UpdateShard of shard %d = %v, %v, want the last result", index, last, err)
+			}
+
+			for range 2 {
+				if err := store.Complete(first, []byte("1\n2")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if queued := store.Queued(); len(queued) != 1 || queued[0] != second {
+				t.Errorf("Queued = %v, want only second", queued)
+			}
+			if job, ok := store.Lookup("first"); !ok || job.CompletedAt == 0 || string(job.FinalResult) != "1\n2" {
+				t.Errorf("Lookup of the completed job = %+v, %v", job, ok)
+			}
+			if _, err := store.UpdateShard(first, 1, device.DeviceID, []byte("1"), nil); !errors.Is(err, ErrJobCompleted) {
+				t.Errorf("UpdateShard of a completed job = %v, want ErrJobCompleted", err)
+			}
+
+			if err := store.Delete("first"); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := store.Lookup("first"); ok || len(store.List()) != 1 {
+				t.Errorf("deleted job still stored, %d jobs listed", len(store.List()))
+			}
+		})
+	}
+}
@@ -3,119 +3,317 @@ package tango
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"sync"
 	pb "tango/tango/src/protobuff"
 	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // createJob constructs and returns a new Job instance based on the provided TaskRequest.
 // It initializes the job fields with data from the request, including the matrices,
-// expected splits, scale factor, and pending tasks map.
+// expected splits, scale factor, and pending tasks map. When the request carries a target
+// shard duration, the job is created in adaptive mode and its splits are ignored.
 func createJob(req *pb.TaskRequest) *Job {
-	return &Job{
-		JobID:           req.JobId,
-		Operation:       req.Operation,
-		AData:           req.AData,
-		BData:           req.BData,
-		m:               req.M,
-		n:               req.N,
-		d:               req.D,
-		ExpectedSplits:  int(req.RowSplits * req.ColSplits),
-		RowSplits:       req.RowSplits,
-		ColSplits:       req.ColSplits,
-		AssignedSplits:  0,
-		ReceivedUpdates: 0,
-		Results:         make(map[int][]byte),
-		ScaleBytes:      req.ScaleBytes,
-		ScaleScalar: func() float32 {
-			if req.ScaleScalar != nil {
-				return *req.ScaleScalar
-			}
-			return 0
-		}(),
-		PendingTasks: make(map[int]TimeDeadline),
-		mu:           sync.Mutex{},
+	job := &Job{
+		JobID:          req.JobId,
+		Operation:      req.Operation,
+		DType:          defaultDType,
+		AData:          req.AData,
+		BData:          req.BData,
+		InputBytes:     int64(len(req.AData) + len(req.BData) + len(req.ScaleBytes)),
+		m:              req.M,
+		n:              req.N,
+		d:              req.D,
+		ExpectedSplits: int(req.RowSplits) * int(req.ColSplits),
+		RowSplits:      req.RowSplits,
+		ColSplits:      req.ColSplits,
+		Results:        make(map[int][]byte),
+		ScaleBytes:     req.ScaleBytes,
+		ScaleScalar:    req.GetScaleScalar(),
+		PendingTasks:   make(map[int]TimeDeadline),
+	}
+	if req.GetTargetShardMillis() > 0 {
+		job.Adaptive = true
+		job.TargetShardMs = req.GetTargetShardMillis()
+		job.ExpectedSplits, job.RowSplits, job.ColSplits = 0, 0, 1
+		job.Bands = make(map[int]RowBand)
+	}
+	return job
+}
+
+// maxJobIDLength is the longest job ID accepted.
+const maxJobIDLength = 128
+
+// validJobID reports whether the job ID is accepted: job IDs name the objects records are shipped as,
+// so they are restricted to characters safe in object names and file names. Task IDs append "_<shard>" to them,
+// which extractShardIndex finds after the last '_'.
+func validJobID(id string) bool {
+	if id == "" || len(id) > maxJobIDLength || id[0] == '.' {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
 	}
+	return true
 }
 
 // SubmitTask handles the submission of a new task by a consumer.
-// It creates a new job using the provided TaskRequest, adds it to the jobs map and job queue,
-// and returns a TaskResponse indicating successful submission.
+// It creates a new job using the provided TaskRequest, attributes it to the consumer from the JWT,
+// adds it to the job store and returns a TaskResponse indicating successful submission.
+// Callers whose token carries no consumer ID are refused with a PermissionDenied error.
+// Job IDs must be unique; resubmitting an existing ID fails with an AlreadyExists error.
+// They are restricted to letters, digits, '-', '_' and '.', as checked by validJobID.
+// Jobs with fixed splits need positive splits no larger than the result's dimensions, so no shard is empty.
+// Adaptive jobs must declare their matrix dimensions, since shards are sized from them,
+// and the requested priority must not exceed what the consumer's token allows.
+// The job's dimensions are taken from the submitted matrices, which must be well formed and match
+// any dimensions declared, so that quotas and billing never rely on the consumer's word.
+// Jobs that would exceed the consumer's quota or the coordinator's memory budget
+// are rejected with a ResourceExhausted error, and all jobs are rejected with an Unavailable error while draining.
 func (s *server) SubmitTask(ctx context.Context, req *pb.TaskRequest) (*pb.TaskResponse, error) {
+	if s.draining.Load() {
+		return nil, status.Error(codes.Unavailable, "coordinator is draining, submit to another coordinator")
+	}
+	if consumerIDFromContext(ctx) == "" {
+		return nil, status.Error(codes.PermissionDenied, "token carries no consumer ID to submit jobs for")
+	}
+	if maxPriority := maxPriorityFromContext(ctx); req.Priority < 0 || req.Priority > maxPriority {
+		return &pb.TaskResponse{
+			Accepted: false,
+			Message:  fmt.Sprintf("Priority must be between 0 and %d.", maxPriority),
+		}, nil
+	}
+	if !validJobID(req.JobId) {
+		return &pb.TaskResponse{
+			Accepted: false,
+			Message:  fmt.Sprintf("Job IDs must be 1 to %d letters, digits, '-' or '.', and must not start with '.'.", maxJobIDLength),
+		}, nil
+	}
+	if req.GetTargetShardMillis() > 0 && (req.M <= 0 || req.N <= 0 || req.D <= 0) {
+		return &pb.TaskResponse{
+			Accepted: false,
+			Message:  "Adaptive jobs require positive m, n and d.",
+		}, nil
+	}
+	m, n, d, err := matrixShape(req.AData, req.BData)
+	if err != nil {
+		return &pb.TaskResponse{
+			Accepted: false,
+			Message:  fmt.Sprintf("Invalid matrices: %v.", err),
+		}, nil
+	}
+	if (req.M != 0 && req.M != m) || (req.N != 0 && req.N != n) || (req.D != 0 && req.D != d) {
+		return &pb.TaskResponse{
+			Accepted: false,
+			Message:  fmt.Sprintf("Declared dimensions m=%d, n=%d, d=%d do not match the submitted matrices (m=%d, n=%d, d=%d).", req.M, req.N, req.D, m, n, d),
+		}, nil
+	}
+	if req.GetTargetShardMillis() <= 0 {
+		if req.RowSplits <= 0 || req.ColSplits <= 0 {
+			return &pb.TaskResponse{
+				Accepted: false,
+				Message:  "Row and column splits must be positive.",
+			}, nil
+		}
+		if req.RowSplits > m || req.ColSplits > n {
+			return &pb.TaskResponse{
+				Accepted: false,
+				Message:  fmt.Sprintf("Splits of %dx%d exceed the %dx%d result, every shard must hold at least one row and one column.", req.RowSplits, req.ColSplits, m, n),
+			}, nil
+		}
+	}
 	job := createJob(req)
-	s.jobsMu.Lock()
-	s.jobs[req.JobId] = job
-	s.jobQueue = append(s.jobQueue, req.JobId)
-	s.jobsMu.Unlock()
+	job.m, job.n, job.d = m, n, d
+	job.ConsumerID = consumerIDFromContext(ctx)
+	job.Priority = req.Priority
+	job.SubmittedAt = time.Now().UnixNano()
+	if err := s.checkMemory(job.InputBytes); err != nil {
+		return nil, err
+	}
+	s.submitMu.Lock()
+	if _, exists := s.store.Lookup(job.JobID); exists {
+		s.submitMu.Unlock()
+		return nil, status.Errorf(codes.AlreadyExists, "job %s already exists", job.JobID)
+	}
+	day, err := s.admit(job)
+	if err != nil {
+		s.submitMu.Unlock()
+		return nil, err
+	}
+	byConsumer, active := s.queuedByConsumer()
+	if len(byConsumer[job.ConsumerID]) == 0 {
+		s.fair.activate(job.ConsumerID, active)
+	}
+	err = s.store.Create(job)
+	s.submitMu.Unlock()
+	if err != nil {
+		s.quotas.refund(job.ConsumerID, job.estimatedFlops(), day)
+		if errors.Is(err, ErrJobExists) {
+			return nil, status.Errorf(codes.AlreadyExists, "job %s already exists", job.JobID)
+		}
+		return nil, status.Errorf(codes.Unavailable, "failed to store job: %v", err)
+	}
+	s.memory.set(job.JobID, job.InputBytes)
 
 	return &pb.TaskResponse{
-		Accepted: true,
-		Message:  "Job submitted successfully.",
+		Accepted:       true,
+		Message:        "Job submitted successfully.",
+		MemoryPressure: s.memory.pressure(),
 	}, nil
 }
 
 // getAvailableTaskIndex searches for an available task (shard) index within a job that is either unassigned
 // or whose assignment deadline has expired. It reserves the task for the requesting device by updating
 // the PendingTasks map with a new deadline and returns the task index along with a boolean indicating success.
-func getAvailableTaskIndex(job *Job, now int64, deviceID string) (int, bool) {
+func getAvailableTaskIndex(job *Job, now int64, device *Device) (int, bool) {
 	job.mu.Lock()
 	defer job.mu.Unlock()
-	var taskIndex int
-	found := false
-	for idx := 1; idx <= job.ExpectedSplits; idx++ {
+	entry := planShard(job, now, device)
+	if entry == nil {
+		return 0, false
+	}
+	job.applyAssign(entry)
+	return entry.Index, true
+}
+
+// planShard picks the shard of the job to lease to the device next, without reserving it,
+// and returns the assign entry that reserves it, or nil if no shard is available.
+// For adaptive jobs, expired bands are only reused if they fit the device; otherwise a new band
+// sized for the device is cut from the remaining rows.
+// The caller must hold job.mu.
+func planShard(job *Job, now int64, device *Device) *journalEntry {
+	total := job.ExpectedSplits
+	if job.Adaptive {
+		total = len(job.Bands)
+	}
+	limit := device.shardLimit()
+	entry := &journalEntry{
+		Type:     entryAssign,
+		JobID:    job.JobID,
+		DeviceID: device.DeviceID,
+		Deadline: time.Now().Add(time.Second).UnixNano(),
+	}
+	for idx := 1; idx <= total; idx++ {
 		if _, done := job.Results[idx]; done {
 			continue
 		}
-		if td, pending := job.PendingTasks[idx]; !pending || now > td.Deadline {
-			taskIndex = idx
-			found = true
-			job.PendingTasks[idx] = TimeDeadline{
-				Deadline: time.Now().Add(time.Second).UnixNano(),
-				DeviceID: deviceID,
+		if job.Adaptive && limit > 0 {
+			band := job.Bands[idx]
+			if job.bandBytes(band.End-band.Start) > limit {
+				continue
 			}
-			if !pending {
-				job.AssignedSplits++
-			}
-			break
 		}
+		if td, pending := job.PendingTasks[idx]; !pending || now > td.Deadline {
+			entry.Index = idx
+			return entry
+		}
+	}
+	if job.Adaptive && job.NextRow < int(job.m) {
+		rows := adaptiveBandRows(job, device)
+		entry.Index = len(job.Bands) + 1
+		entry.Band = &RowBand{Start: job.NextRow, End: job.NextRow + rows}
+		return entry
+	}
+	return nil
+}
+
+// adaptiveBandRows returns how many rows of matrix A the device should receive so that
+// its shard takes roughly the job's target duration at the device's measured throughput.
+// The band is capped by the device's shard limit and the rows left to cut, and always holds at least one row.
+// The caller must hold job.mu.
+func adaptiveBandRows(job *Job, device *Device) int {
+	d, n := int64(job.d), int64(job.n)
+	flopsPerRow := float64(2 * d * n)
+	rows := int64(device.FlopsPerSecond * float64(job.TargetShardMs) / 1000 / flopsPerRow)
+	if limit := device.shardLimit(); limit > 0 {
+		if fit := (limit - 4*d*n) / (4 * (d + n)); rows > fit {
+			rows = fit
+		}
+	}
+	if remaining := int64(int(job.m) - job.NextRow); rows > remaining {
+		rows = remaining
+	}
+	if rows < 1 {
+		rows = 1
 	}
-	return taskIndex, found
+	return int(rows)
+}
+
+// blockBounds splits total elements into the given number of blocks and returns the
+// [start, end) range of the requested block. Leading blocks absorb the remainder, one extra element each.
+func blockBounds(total, blocks, block int) (int, int) {
+	perBlock := total / blocks
+	extra := total % blocks
+	start := block*perBlock + min(block, extra)
+	end := start + perBlock
+	if block < extra {
+		end++
+	}
+	return start, end
+}
+
+// matrixShape returns the dimensions of the product of the serialized matrices A (m×d) and B (d×n),
+// checking that both are non-empty, rectangular and compatible.
+func matrixShape(aData, bData []byte) (m, n, d int32, err error) {
+	var a, b [][]float32
+	if err := json.Unmarshal(aData, &a); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to unmarshal AData: %w", err)
+	}
+	if err := json.Unmarshal(bData, &b); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to unmarshal BData: %w", err)
+	}
+	if len(a) == 0 || len(b) == 0 || len(b[0]) == 0 {
+		return 0, 0, 0, fmt.Errorf("matrices must not be empty")
+	}
+	for i, row := range a {
+		if len(row) != len(b) {
+			return 0, 0, 0, fmt.Errorf("row %d of A has %d columns, but B has %d rows", i, len(row), len(b))
+		}
+	}
+	for i, row := range b {
+		if len(row) != len(b[0]) {
+			return 0, 0, 0, fmt.Errorf("row %d of B has %d columns, but row 0 has %d", i, len(row), len(b[0]))
+		}
+	}
+	return int32(len(a)), int32(len(b[0])), int32(len(b)), nil
 }
 
 // prepareTaskAssignment generates a TaskAssignment for the given job and task index.
-// It unmarshals the full matrix data from the job, calculates the appropriate block (shard)
-// based on the task index and grid dimensions, and returns the shard data as a TaskAssignment.
-func prepareTaskAssignment(job *Job, taskIndex, gridRows, gridCols int) (*pb.TaskAssignment, error) {
+// It unmarshals the job's full matrix data, calculates the appropriate block (shard)
+// based on the task index and grid dimensions (or the reserved row band for adaptive jobs),
+// and returns the shard data as a TaskAssignment.
+func prepareTaskAssignment(job *Job, aData, bData []byte, taskIndex, gridRows, gridCols int) (*pb.TaskAssignment, error) {
 	var fullA, fullB [][]float32
-	if err := json.Unmarshal(job.AData, &fullA); err != nil {
+	if err := json.Unmarshal(aData, &fullA); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal AData: %w", err)
 	}
-	if err := json.Unmarshal(job.BData, &fullB); err != nil {
+	if err := json.Unmarshal(bData, &fullB); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal BData: %w", err)
 	}
 
 	rowBlock := (taskIndex - 1) / gridCols
 	colBlock := (taskIndex - 1) % gridCols
 
-	totalRows := len(fullA)
-	rowsPerBlock := totalRows / gridRows
-	extraRows := totalRows % gridRows
-	startRow := rowBlock*rowsPerBlock + min(rowBlock, extraRows)
-	endRow := startRow + rowsPerBlock
-	if rowBlock < extraRows {
-		endRow++
+	var startRow, endRow int
+	if job.Adaptive {
+		job.mu.Lock()
+		band := job.Bands[taskIndex]
+		job.mu.Unlock()
+		startRow, endRow = band.Start, band.End
+	} else {
+		startRow, endRow = blockBounds(len(fullA), gridRows, rowBlock)
+	}
+	if endRow > len(fullA) || len(fullB) == 0 {
+		return nil, fmt.Errorf("shard %d exceeds the submitted matrices", taskIndex)
 	}
 	shardA := fullA[startRow:endRow]
 
-	totalCols := len(fullB[0])
-	colsPerBlock := totalCols / gridCols
-	extraCols := totalCols % gridCols
-	startCol := colBlock*colsPerBlock + min(colBlock, extraCols)
-	endCol := startCol + colsPerBlock
-	if colBlock < extraCols {
-		endCol++
-	}
+	startCol, endCol := blockBounds(len(fullB[0]), gridCols, colBlock)
 	shardB := make([][]float32, len(fullB))
 	for i := range fullB {
 		shardB[i] = fullB[i][startCol:endCol]
@@ -147,34 +345,43 @@ func prepareTaskAssignment(job *Job, taskIndex, gridRows, gridCols int) (*pb.Tas
 	return assignment, nil
 }
 
-// FetchTask is invoked by a device to retrieve an available task assignment.
-// It iterates over the job queue and for each job, attempts to find an unassigned or expired task.
-// If an available task is found, it prepares the assignment and returns it. If no tasks are available,
-// an error is returned.
+// FetchTask is invoked by a registered device to retrieve an available task assignment.
+// It iterates over the job queue in priority and fair-share order and for each job the device is capable of handling,
+// attempts to find an unassigned or expired task. If an available task is found,
+// it prepares the assignment and returns it. In federation mode, a device with no local work
+// is offered a task from another member instead. If no tasks are available, an error is returned.
+// While draining, no tasks are handed out.
 func (s *server) FetchTask(ctx context.Context, req *pb.DeviceRequest) (*pb.TaskAssignment, error) {
+	if s.draining.Load() {
+		return nil, status.Error(codes.Unavailable, "coordinator is draining")
+	}
+	device, registered := s.lookupDevice(req.DeviceId)
+	if !registered {
+		return nil, fmt.Errorf("device %s is not registered", req.DeviceId)
+	}
 	now := time.Now().UnixNano()
 
-	s.jobsMu.RLock()
-	jobIDs := make([]string, len(s.jobQueue))
-	copy(jobIDs, s.jobQueue)
-	s.jobsMu.RUnlock()
-
-	for _, jobID := range jobIDs {
-		s.jobsMu.RLock()
-		job, exists := s.jobs[jobID]
-		s.jobsMu.RUnlock()
-		if !exists {
+	for _, job := range s.scheduleOrder() {
+		if !device.canHandle(job) {
 			continue
 		}
 
-		taskIndex, found := getAvailableTaskIndex(job, now, req.DeviceId)
+		taskIndex, found := s.store.ReserveShard(job, now, device)
 		if !found {
 			continue
 		}
+		s.fair.charge(job.ConsumerID)
 
+		aData, bData, err := s.loadInputs(job)
+		if err != nil {
+			return nil, err
+		}
 		gridRows := int(job.RowSplits)
 		gridCols := int(job.ColSplits)
-		return prepareTaskAssignment(job, taskIndex, gridRows, gridCols)
+		return prepareTaskAssignment(job, aData, bData, taskIndex, gridRows, gridCols)
+	}
+	if s.federation != nil && !hasHeader(ctx, routedHeader) {
+		return s.federation.fetchFromPeers(ctx, device)
 	}
 	return nil, fmt.Errorf("no available tasks")
 }
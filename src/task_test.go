@@ -0,0 +1,131 @@
+package tango
+
+import (
+	"strings"
+	pb "tango/tango/src/protobuff"
+	"testing"
+)
+
+// TestSubmitTaskSplits checks that fixed splits must be positive and no larger than the result's dimensions.
+func TestSubmitTaskSplits(t *testing.T) {
+	s := newServerWithStore(newMemoryStore())
+	defer s.Close()
+	for _, tt := range []struct {
+		rowSplits, colSplits int32
+		accepted             bool
+	}{
+		{0, 1, false},
+		{1, -1, false},
+		{4, 1, false},
+		{1, 3, false},
+		{3, 2, true},
+	} {
+		reply, err := s.SubmitTask(testContext("consumer", ""), &pb.TaskRequest{
+			JobId:     "splits",
+			Operation: "matmul",
+			AData:     testMatrix(t, 3, 4),
+			BData:     testMatrix(t, 4, 2),
+			RowSplits: tt.rowSplits,
+			ColSplits: tt.colSplits,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Accepted != tt.accepted {
+			t.Errorf("%dx%d splits of a 3x2 result: accepted = %v (%s), want %v", tt.rowSplits, tt.colSplits, reply.Accepted, reply.Message, tt.accepted)
+		}
+	}
+}
+
+// TestValidJobID checks which job IDs are accepted.
+func TestValidJobID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"Job1":                   true,
+		"job-1.v2":               true,
+		"job_1":                  true,
+		"":                       false,
+		".hidden":                false,
+		"a/x":                    false,
+		"a x":                    false,
+		strings.Repeat("j", 128): true,
+		strings.Repeat("j", 129): false,
+	} {
+		if got := validJobID(id); got != want {
+			t.Errorf("validJobID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+// TestExtractShardIndex checks that shard indexes are parsed from task IDs, including those of job IDs containing '_'.
+func TestExtractShardIndex(t *testing.T) {
+	tests := []struct {
+		taskID string
+		index  int
+		valid  bool
+	}{
+		{"job_3", 3, true},
+		{"my_job_12", 12, true},
+		{"job_", 0, false},
+		{"_3", 0, false},
+		{"job", 0, false},
+		{"job_x", 0, false},
+	}
+	for _, tt := range tests {
+		index, err := extractShardIndex(tt.taskID)
+		if (err == nil) != tt.valid || index != tt.index {
+			t.Errorf("extractShardIndex(%q) = %d, %v, want %d, valid %v", tt.taskID, index, err, tt.index, tt.valid)
+		}
+	}
+}
+
+// TestAdaptiveSizing checks that a request with a target shard duration creates an adaptive job, and that its bands
+// are sized for the device's throughput, capped by the device's shard limit and the rows left, and hold at least one row.
+func TestAdaptiveSizing(t *testing.T) {
+	target := int32(1000)
+	scale := float32(2)
+	job := createJob(&pb.TaskRequest{JobId: "adaptive", M: 100, N: 10, D: 5, RowSplits: 4, ColSplits: 4, TargetShardMillis: &target, ScaleScalar: &scale})
+	if !job.Adaptive || job.TargetShardMs != target || job.ExpectedSplits != 0 || job.ColSplits != 1 || job.Bands == nil || job.ScaleScalar != scale {
+		t.Fatalf("createJob = %+v, want an adaptive job ignoring its splits", job)
+	}
+	if fixed := createJob(&pb.TaskRequest{JobId: "fixed", RowSplits: 2, ColSplits: 3}); fixed.Adaptive || fixed.ExpectedSplits != 6 || fixed.ScaleScalar != 0 {
+		t.Fatalf("createJob = %+v, want a fixed 2x3 job", fixed)
+	}
+
+	// A row costs 2*d*n = 100 flops and, in a band of r rows, 4*(r*d + d*n + r*n) = 60r + 200 bytes.
+	tests := []struct {
+		name    string
+		nextRow int
+		device  Device
+		rows    int
+	}{
+		{"throughput", 0, Device{FlopsPerSecond: 2000}, 20},
+		{"shard limit", 0, Device{FlopsPerSecond: 2000, MaxShardBytes: 800}, 10},
+		{"memory", 0, Device{FlopsPerSecond: 2000, MemoryBytes: 500, MaxShardBytes: 800}, 5},
+		{"rows left", 90, Device{FlopsPerSecond: 2000}, 10},
+		{"slow device", 0, Device{FlopsPerSecond: 1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job.NextRow = tt.nextRow
+			rows := adaptiveBandRows(job, &tt.device)
+			if rows != tt.rows {
+				t.Errorf("adaptiveBandRows = %d, want %d", rows, tt.rows)
+			}
+			if limit := tt.device.shardLimit(); limit > 0 && job.bandBytes(rows) > limit {
+				t.Errorf("band of %d rows takes %d bytes, over the device's %d", rows, job.bandBytes(rows), limit)
+			}
+		})
+	}
+
+	// An expired band too large for the device is left for another one, and a band sized for the device is cut instead.
+	job.NextRow = 20
+	job.Bands[1] = RowBand{Start: 0, End: 20}
+	job.PendingTasks[1] = TimeDeadline{Deadline: 1}
+	entry := planShard(job, 2, &Device{DeviceID: "small", FlopsPerSecond: 2000, MaxShardBytes: 800})
+	if entry == nil || entry.Index != 2 || entry.Band == nil || *entry.Band != (RowBand{Start: 20, End: 30}) {
+		t.Errorf("planShard = %+v, want band 2 over rows [20, 30)", entry)
+	}
+	if entry := planShard(job, 2, &Device{DeviceID: "large", FlopsPerSecond: 2000}); entry == nil || entry.Index != 1 || entry.Band != nil {
+		t.Errorf("planShard = %+v, want the expired band 1 reused", entry)
+	}
+}
@@ -0,0 +1,277 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	pb "tango/tango/src/protobuff"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Sources TLS material can be read from.
+const (
+	tlsSourceFile    = "file"    // Cert, key and CAs are paths to PEM files.
+	tlsSourceSecrets = "secrets" // Cert, key and CAs are names of secrets holding PEM data, read through the secret provider.
+)
+
+// identityHeader carries the client certificate identity of the original caller across coordinators.
+const identityHeader = "tango-client-identity"
+
+// activeTLS is the TLS material of the running server, or nil when it serves without TLS.
+// Connections to other coordinators present the same certificate.
+var activeTLS atomic.Pointer[certReloader]
+
+// certReloader holds the server's certificate and CA pools, and reloads them from their source
+// periodically so rotated certificates are picked up by new connections without a restart.
+type certReloader struct {
+	cfg       TLSConfig
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool] // Verifies client certificates; nil when mutual TLS is off.
+	peerCAs   atomic.Pointer[x509.CertPool] // Verifies other coordinators; nil to use the system roots.
+
+	mu      sync.Mutex
+	certPEM []byte // Certificate last loaded, used to log rotations.
+}
+
+// NewTLSCredentials returns the transport credentials of the gRPC server as configured,
+// or nil when TLS is disabled. The server reloads the certificate periodically once started.
+func NewTLSCredentials() (credentials.TransportCredentials, error) {
+	if !AppConfig.TLS.Enabled {
+		return nil, nil
+	}
+	r, err := newCertReloader(AppConfig.TLS)
+	if err != nil {
+		return nil, err
+	}
+	activeTLS.Store(r)
+	return credentials.NewTLS(r.serverConfig()), nil
+}
+
+// newCertReloader validates the configuration and loads the TLS material for the first time.
+func newCertReloader(cfg TLSConfig) (*certReloader, error) {
+	switch cfg.Source {
+	case "", tlsSourceFile:
+		cfg.Source = tlsSourceFile
+	case tlsSourceSecrets:
+		if cfg.Cert == "" {
+			cfg.Cert = secretServerCrt
+		}
+		if cfg.Key == "" {
+			cfg.Key = secretServerKey
+		}
+	default:
+		return nil, fmt.Errorf("unknown TLS source %q", cfg.Source)
+	}
+	if cfg.RequireClientCert && cfg.ClientCA == "" {
+		return nil, fmt.Errorf("require_client_cert needs a client_ca to verify client certificates")
+	}
+	r := &certReloader{cfg: cfg}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// read returns the PEM data referenced by the configuration: a file path or a secret name, depending on the source.
+func (r *certReloader) read(ref string) ([]byte, error) {
+	if r.cfg.Source == tlsSourceSecrets {
+		return fetchSecret(ref)
+	}
+	return os.ReadFile(ref)
+}
+
+// readPool returns a pool of the CA certificates referenced by the configuration, or nil if none is configured.
+func (r *certReloader) readPool(ref string) (*x509.CertPool, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	data, err := r.read(ref)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", ref)
+	}
+	return pool, nil
+}
+
+// load reads the certificate, key and CA pools and swaps them in at once. On error, the material
+// previously loaded stays in use.
+func (r *certReloader) load() error {
+	certPEM, err := r.read(r.cfg.Cert)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	keyPEM, err := r.read(r.cfg.Key)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS key: %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid TLS key pair: %v", err)
+	}
+	clientCAs, err := r.readPool(r.cfg.ClientCA)
+	if err != nil {
+		return fmt.Errorf("failed to read client CA: %v", err)
+	}
+	peerCAs, err := r.readPool(r.cfg.PeerCA)
+	if err != nil {
+		return fmt.Errorf("failed to read peer CA: %v", err)
+	}
+
+	r.cert.Store(&cert)
+	r.clientCAs.Store(clientCAs)
+	r.peerCAs.Store(peerCAs)
+	r.mu.Lock()
+	rotated := r.certPEM != nil && !bytes.Equal(r.certPEM, certPEM)
+	r.certPEM = certPEM
+	r.mu.Unlock()
+	if rotated {
+		log.Printf("Reloaded rotated TLS certificate")
+	}
+	return nil
+}
+
+// reloadEvery reloads the TLS material at the given interval. It returns once stop is closed.
+func (r *certReloader) reloadEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := r.load(); err != nil {
+			log.Printf("Failed to reload TLS certificate, keeping the current one: %v", err)
+		}
+	}
+}
+
+// clientAuth returns how client certificates are handled. Without a client CA, none are requested;
+// with one, certificates are verified when presented, and required if so configured.
+func (r *certReloader) clientAuth() tls.ClientAuthType {
+	switch {
+	case r.cfg.ClientCA == "":
+		return tls.NoClientCert
+	case r.cfg.RequireClientCert:
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.VerifyClientCertIfGiven
+	}
+}
+
+// serverConfig returns the TLS configuration of the gRPC server. Every handshake uses the most recently
+// loaded certificate and client CA pool.
+func (r *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert.Load()},
+				ClientAuth:   r.clientAuth(),
+				ClientCAs:    r.clientCAs.Load(),
+				NextProtos:   []string{"h2"},
+			}, nil
+		},
+	}
+}
+
+// clientConfig returns the TLS configuration used to connect to other coordinators.
+// The server's own certificate is presented as a client certificate, so the receiving coordinator
+// can tell forwarded requests from requests of devices and consumers.
+func (r *certReloader) clientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    r.peerCAs.Load(),
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.cert.Load(), nil
+		},
+	}
+}
+
+// clientCertIdentity returns the identity of the verified client certificate the caller presented:
+// its subject common name, or the SHA-256 fingerprint of the certificate when it has none.
+func clientCertIdentity(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	leaf := info.State.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName, true
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	return "sha256:" + hex.EncodeToString(sum[:]), true
+}
+
+// requestCertIdentity returns the client certificate identity of the original caller of the request,
+// when mutual TLS is configured. Requests made directly take it from the TLS connection; requests forwarded
+// by another coordinator take it from the identity header, which AuthenticatePeers strips from other requests.
+func requestCertIdentity(ctx context.Context) (string, bool) {
+	if !AppConfig.TLS.Enabled || AppConfig.TLS.ClientCA == "" {
+		return "", false
+	}
+	if hasHeader(ctx, forwardedHeader) || hasHeader(ctx, routedHeader) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(identityHeader); len(values) > 0 {
+			return values[0], true
+		}
+		return "", false
+	}
+	return clientCertIdentity(ctx)
+}
+
+// deviceScoped is implemented by requests made on behalf of a registered device.
+type deviceScoped interface {
+	GetDeviceId() string
+}
+
+// deviceCertIdentity returns the client certificate identity bound to the device at registration, if any.
+func (s *server) deviceCertIdentity(deviceID string) string {
+	if device, exists := s.findDevice(deviceID); exists {
+		return device.CertIdentity
+	}
+	return ""
+}
+
+// VerifyClientIdentity is a gRPC unary interceptor enforcing mutual TLS identities when a client CA is configured.
+// A device that registered over mutual TLS is bound to the identity of its client certificate, and its later
+// requests must present a certificate with the same identity. Requests forwarded by another coordinator
+// carry the original caller's identity in a header, which AuthenticatePeers strips from requests not made by a peer.
+func (s *server) VerifyClientIdentity(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !AppConfig.TLS.Enabled || AppConfig.TLS.ClientCA == "" || !strings.HasPrefix(info.FullMethod, "/"+pb.TangoService_ServiceDesc.ServiceName+"/") {
+		return handler(ctx, req)
+	}
+	identity, verified := requestCertIdentity(ctx)
+	scoped, ok := req.(deviceScoped)
+	if !ok || info.FullMethod == pb.TangoService_RegisterDevice_FullMethodName {
+		return handler(ctx, req)
+	}
+	if bound := s.deviceCertIdentity(scoped.GetDeviceId()); bound != "" && (!verified || identity != bound) {
+		return nil, status.Errorf(codes.PermissionDenied, "device %s must present the client certificate it registered with", scoped.GetDeviceId())
+	}
+	return handler(ctx, req)
+}
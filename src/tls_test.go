@@ -0,0 +1,254 @@
+package tango
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "tango/tango/src/protobuff"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// testPKI is a certificate authority issuing certificates into a temporary directory.
+type testPKI struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string // Path of the CA certificate.
+}
+
+// newTestPKI generates a certificate authority.
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	ca := &testPKI{dir: t.TempDir()}
+	ca.cert, ca.key, ca.pem = ca.issue(t, "ca", nil)
+	return ca
+}
+
+// issue generates a key and a certificate for the common name, signed by the CA, or self-signed as the CA itself
+// when the CA is not generated yet, and writes them as PEM files named after the common name. It returns
+// the certificate, its key and the path of the certificate; the key is written next to it with a .key extension.
+func (ca *testPKI) issue(t *testing.T, name string, dnsNames []string) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca.cert == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(ca.dir, name+".crt")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(ca.dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, path
+}
+
+// TestCertReloaderReloadEvery checks that a rotated certificate is picked up periodically, until the reload is stopped.
+func TestCertReloaderReloadEvery(t *testing.T) {
+	ca := newTestPKI(t)
+	_, _, first := ca.issue(t, "server", []string{"localhost"})
+	r, err := newCertReloader(TLSConfig{Cert: first, Key: filepath.Join(ca.dir, "server.key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() *big.Int {
+		leaf, err := x509.ParseCertificate(r.cert.Load().Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber
+	}
+
+	rotated, _, _ := ca.issue(t, "server", []string{"localhost"})
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		r.reloadEvery(5*time.Millisecond, stop)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); serial().Cmp(rotated.SerialNumber) != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated certificate not reloaded")
+		}
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("certificate reload still running after stop")
+	}
+}
+
+// identityMethod is served by the test server of TestMutualTLS, replying with the caller's client certificate identity
+// as job ID, and with priority 1 when the caller is recognized as another coordinator.
+const identityMethod = "/tango.Test/Identify"
+
+// serveIdentities starts a gRPC server with the TLS credentials, serving identityMethod.
+func serveIdentities(t *testing.T, r *certReloader) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(r.serverConfig())), grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		var req pb.TaskRequest
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		identity, _ := clientCertIdentity(stream.Context())
+		reply := &pb.TaskRequest{JobId: identity}
+		if fromPeer, _ := stripPeerHeaders(stream.Context(), identityMethod, nil).Value("peer").(bool); fromPeer {
+			reply.Priority = 1
+		}
+		return stream.SendMsg(reply)
+	}))
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+// TestMutualTLS checks, over real handshakes with certificates generated in process, that client certificates
+// are required and verified against the client CA, that callers are identified by their certificate's common name
+// or fingerprint, and that only the names listed in peer_names are recognized as other coordinators.
+func TestMutualTLS(t *testing.T) {
+	ca, rogue := newTestPKI(t), newTestPKI(t)
+	_, _, serverCrt := ca.issue(t, "server", []string{"localhost"})
+	r, err := newCertReloader(TLSConfig{Cert: serverCrt, Key: filepath.Join(ca.dir, "server.key"), ClientCA: ca.pem, RequireClientCert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := AppConfig.TLS
+	AppConfig.TLS = TLSConfig{Enabled: true, ClientCA: ca.pem, PeerNames: []string{"coordinator-b"}}
+	t.Cleanup(func() { AppConfig.TLS = saved })
+	addr := serveIdentities(t, r)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	_, _, listed := ca.issue(t, "coordinator-b", nil)
+	_, _, unlisted := ca.issue(t, "mallory", nil)
+	unnamed, _, unnamedCrt := ca.issue(t, "", nil)
+	fingerprint := sha256.Sum256(unnamed.Raw)
+	_, _, untrusted := rogue.issue(t, "coordinator-b", nil)
+	tests := []struct {
+		name     string
+		crt      string // Path of the client certificate, empty to present none.
+		identity string // Identity the server sees; empty when the handshake must fail.
+		peer     bool
+	}{
+		{"listed coordinator", listed, "coordinator-b", true},
+		{"unlisted name", unlisted, "mallory", false},
+		{"no common name", unnamedCrt, "sha256:" + hex.EncodeToString(fingerprint[:]), false},
+		{"untrusted CA", untrusted, "", false},
+		{"no certificate", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if tt.crt != "" {
+				pair, err := tls.LoadX509KeyPair(tt.crt, strings.TrimSuffix(tt.crt, ".crt")+".key")
+				if err != nil {
+					t.Fatal(err)
+				}
+				config.Certificates = []tls.Certificate{pair}
+			}
+			conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ctx = metadata.AppendToOutgoingContext(ctx, forwardedHeader, "true")
+			var reply pb.TaskRequest
+			err = conn.Invoke(ctx, identityMethod, &pb.TaskRequest{}, &reply)
+			if tt.identity == "" {
+				if err == nil {
+					t.Errorf("handshake succeeded as %q, want it refused", reply.JobId)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.JobId != tt.identity || (reply.Priority == 1) != tt.peer {
+				t.Errorf("identified as %q, peer %v, want %q, peer %v", reply.JobId, reply.Priority == 1, tt.identity, tt.peer)
+			}
+		})
+	}
+}
+
+// TestCertReloaderSources checks that TLS material is read from files or through the secret provider,
+// and that other sources are refused.
+func TestCertReloaderSources(t *testing.T) {
+	ca := newTestPKI(t)
+	ca.issue(t, "server", []string{"localhost"})
+	withSecrets(t, SecretsConfig{Provider: secretsProviderFile, Dir: ca.dir})
+	tests := []struct {
+		name  string
+		cfg   TLSConfig
+		valid bool
+	}{
+		{"file", TLSConfig{Cert: filepath.Join(ca.dir, "server.crt"), Key: filepath.Join(ca.dir, "server.key"), ClientCA: ca.pem}, true},
+		{"secrets", TLSConfig{Source: tlsSourceSecrets, Cert: "server.crt", Key: "server.key", ClientCA: "ca.crt"}, true},
+		{"missing secret", TLSConfig{Source: tlsSourceSecrets}, false},
+		{"gcp", TLSConfig{Source: "gcp", Cert: "server.crt", Key: "server.key"}, false},
+		{"client cert required without a client CA", TLSConfig{Cert: filepath.Join(ca.dir, "server.crt"), Key: filepath.Join(ca.dir, "server.key"), RequireClientCert: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newCertReloader(tt.cfg); (err == nil) != tt.valid {
+				t.Errorf("newCertReloader = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -4,24 +4,69 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
-// ValidateJWT validates a JSON Web Token (JWT) using the provided secret key.
+// joseHeader is the JOSE header of a token.
+type joseHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Claims are the claims of a Tango token: the registered JWT claims Tango validates,
+// and the claims describing what the caller may do.
+type Claims struct {
+	Subject     string   `json:"sub,omitempty"`
+	Issuer      string   `json:"iss,omitempty"`
+	Audience    audience `json:"aud,omitempty"`
+	ExpiresAt   float64  `json:"exp,omitempty"`
+	NotBefore   float64  `json:"nbf,omitempty"`
+	IssuedAt    float64  `json:"iat,omitempty"`
+	ID          string   `json:"jti,omitempty"`
+	ConsumerID  string   `json:"consumerId,omitempty"`   // Consumer the token acts for.
+	DeviceID    string   `json:"device_id,omitempty"`    // Device the token is bound to, if any.
+	MaxPriority *int32   `json:"max_priority,omitempty"` // Highest job priority the token allows, if limited.
+	Role        string   `json:"role,omitempty"`         // Single role granted by the token.
+	Roles       []string `json:"roles,omitempty"`        // Roles granted by the token, taking precedence over Role.
+	TokenUse    string   `json:"token_use,omitempty"`    // "refresh" for refresh tokens, which cannot authenticate requests.
+	APIKey      bool     `json:"api_key,omitempty"`      // Whether Tango issued the token for the API key named by its subject.
+}
+
+// audience is the "aud" claim, which JWT allows to be either a single string or an array of strings.
+type audience []string
+
+// UnmarshalJSON decodes an audience given as a string or as an array of strings.
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("aud must be a string or an array of strings")
+	}
+	*a = list
+	return nil
+}
+
+// ValidateJWT validates a JSON Web Token (JWT) using the provided secret keys.
 // It checks the token format, decodes the header, payload, and signature,
-// verifies the algorithm (HS256), compares the expected and provided signatures,
-// and ensures the token has not expired.
-// Returns the payload as a map if the token is valid, otherwise an error.
-func ValidateJWT(token, secretKey string) (map[string]interface{}, error) {
+// verifies the signature with any of the secret keys (HS256) or with the JWKS key named by the token's kid
+// (RS256, ES256, EdDSA), and validates the claims with validateClaims.
+// Returns the token's claims if the token is valid, otherwise an error.
+func ValidateJWT(token string, secretKeys ...string) (*Claims, error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
 		return nil, errors.New("invalid token format")
@@ -46,38 +91,64 @@ func ValidateJWT(token, secretKey string) (map[string]interface{}, error) {
 		return nil, errors.New("invalid signature encoding")
 	}
 
-	var header map[string]interface{}
+	var header joseHeader
 	if err := json.Unmarshal(headerBytes, &header); err != nil {
 		return nil, errors.New("invalid header JSON")
 	}
 
-	var payload map[string]interface{}
-	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+	var claims Claims
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
 		return nil, errors.New("invalid payload JSON")
 	}
 
-	if header["alg"] != "HS256" {
-		return nil, errors.New("invalid algorithm")
-	}
-
 	signatureInput := fmt.Sprintf("%s.%s", encodedHeader, encodedPayload)
-	expectedSignature := generateHmacSha256Signature(signatureInput, secretKey)
+	if err := verifyTokenSignature(header.Alg, header.Kid, signatureInput, signature, secretKeys); err != nil {
+		return nil, err
+	}
 
-	if subtle.ConstantTimeCompare(expectedSignature, signature) != 1 {
-		return nil, errors.New("invalid signature")
+	if err := validateClaims(&claims, time.Now()); err != nil {
+		return nil, err
 	}
+	return &claims, nil
+}
+
+// validateClaims checks the time-based claims of a token, allowing for the configured clock skew:
+// the token must expire, must not be expired or used before its nbf, must not be issued in the future,
+// and must not live longer than the configured maximum lifetime. It also enforces the configured
+// issuer and audience, when set. Refresh tokens are exempt from the maximum lifetime, which bounds access tokens.
+func validateClaims(claims *Claims, now time.Time) error {
+	cfg := AppConfig.Tokens
+	skew := float64(cfg.ClockSkewSeconds)
+	unix := float64(now.Unix())
 
-	if exp, ok := payload["exp"].(float64); ok {
-		if time.Now().Unix() > int64(exp) {
-			return nil, errors.New("token expired")
+	if claims.ExpiresAt == 0 {
+		return errors.New("token has no expiry")
+	}
+	if unix > claims.ExpiresAt+skew {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && unix+skew < claims.NotBefore {
+		return errors.New("token not valid yet")
+	}
+	if claims.IssuedAt != 0 && unix+skew < claims.IssuedAt {
+		return errors.New("token issued in the future")
+	}
+	if cfg.MaxLifetimeSeconds > 0 && claims.TokenUse != tokenUseRefresh {
+		issued := claims.IssuedAt
+		if issued == 0 {
+			issued = unix
+		}
+		if claims.ExpiresAt-issued > float64(cfg.MaxLifetimeSeconds) {
+			return errors.New("token lifetime exceeds the allowed maximum")
 		}
 	}
-
-	if consumerID, ok := payload["consumerId"].(string); ok {
-		payload["consumerID"] = consumerID
+	if cfg.Issuer != "" && claims.Issuer != cfg.Issuer {
+		return errors.New("invalid issuer")
 	}
-
-	return payload, nil
+	if cfg.Audience != "" && !slices.Contains(claims.Audience, cfg.Audience) {
+		return errors.New("invalid audience")
+	}
+	return nil
 }
 
 // generateHmacSha256Signature generates an HMAC-SHA256 signature for the given data
@@ -89,29 +160,148 @@ func generateHmacSha256Signature(data, secretKey string) []byte {
 }
 
 // TokenInterceptor is a gRPC unary interceptor that validates the JWT provided in the request metadata.
-// It retrieves the "tango-token" from the incoming metadata, fetches the expected JWT secret,
-// validates the token using ValidateJWT, and only allows the request to proceed if the token is valid.
-// Returns an error if the token is missing or invalid.
+// It authenticates the request with authenticate and only allows it to proceed if the token is valid,
+// passing the caller's identity on to the handler in the context. Requests naming a revoked device are refused.
+// The RPCs issuing tokens are let through without one.
+// Returns an Unauthenticated error if the token is missing or invalid, and an Unavailable error
+// if it cannot be verified because the JWT secret is unavailable.
 func TokenInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if publicMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+	ctx, err := authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRevokedDevice(req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// checkRevokedDevice refuses requests made on behalf of a revoked device.
+func checkRevokedDevice(req interface{}) error {
+	if scoped, ok := req.(deviceScoped); ok && revocations.revoked(revokeDevice, scoped.GetDeviceId()) {
+		return status.Errorf(codes.PermissionDenied, "device %s has been revoked", scoped.GetDeviceId())
+	}
+	return nil
+}
+
+// StreamTokenInterceptor is the streaming counterpart of TokenInterceptor. It validates the JWT sent
+// when the stream is opened and exposes the caller's identity through the stream's context.
+// Messages naming a revoked device are refused as they are received.
+func StreamTokenInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &checkedStream{ServerStream: &contextStream{ServerStream: ss, ctx: ctx}, check: checkRevokedDevice})
+}
+
+// StreamInterceptors returns the chain of stream interceptors of the gRPC server, in order: peer authentication,
+// logging, metrics, token authentication and authorization.
+func StreamInterceptors() []grpc.StreamServerInterceptor {
+	return []grpc.StreamServerInterceptor{
+		StreamAuthenticatePeers,
+		StreamLoggingInterceptor,
+		StreamMetricsInterceptor,
+		StreamTokenInterceptor,
+		StreamAuthorizeInterceptor,
+	}
+}
+
+// checkedStream is a server stream checking every message it receives, so messages streamed
+// after the stream was opened are held to the checks of unary requests.
+type checkedStream struct {
+	grpc.ServerStream
+	check func(m interface{}) error
+}
+
+// RecvMsg receives the next message, and returns the error of its check if it fails.
+func (cs *checkedStream) RecvMsg(m interface{}) error {
+	if err := cs.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return cs.check(m)
+}
+
+// contextStream is a server stream whose context has been replaced, so that values injected
+// by an interceptor are visible to the stream handler.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the stream's replaced context.
+func (cs *contextStream) Context() context.Context {
+	return cs.ctx
+}
+
+// authenticate retrieves the "tango-token" from the incoming metadata, fetches the expected JWT secrets,
+// validates the token using ValidateJWT, refuses it if revoked, and records its use. It returns a context carrying the caller's consumer ID,
+// the highest job priority the token allows, its subject, roles and bound device, or a gRPC status error if the token is missing,
+// invalid, grants no role or cannot be verified.
+func authenticate(ctx context.Context) (context.Context, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return nil, errors.New("missing metadata")
+		return nil, status.Error(codes.Unauthenticated, "missing metadata")
 	}
-	tokens := md["tango-token"]
+	tokens := md[tokenHeader]
 	if len(tokens) == 0 {
-		return nil, errors.New("missing tango_TOKEN")
+		return nil, status.Error(codes.Unauthenticated, "missing tango_TOKEN")
+	}
+	JWTSecrets, secretErr := jwtVerificationSecrets()
+	claims, err := ValidateJWT(tokens[0], JWTSecrets...)
+	if errors.Is(err, errNoJWTSecret) {
+		return nil, status.Errorf(codes.Unavailable, "cannot verify HS256 tokens: %v", secretErr)
 	}
-	JWTSecret, _ := getTangoJWTSecret()
-	payload, err := ValidateJWT(tokens[0], JWTSecret)
 	if err != nil {
-		return nil, fmt.Errorf("invalid JWT: %v", err)
+		return nil, status.Errorf(codes.Unauthenticated, "invalid JWT: %v", err)
+	}
+	if claims.TokenUse == tokenUseRefresh {
+		return nil, status.Error(codes.Unauthenticated, "refresh tokens cannot authenticate requests")
 	}
+	if len(claims.grantedRoles()) == 0 {
+		return nil, status.Error(codes.PermissionDenied, "token grants no role")
+	}
+	if err := revocations.check(claims); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	sessions.touch(tokenKey(tokens[0], claims), claims, time.Now())
 
-	// Extract consumerID from the payload
-	if consumerID, ok := payload["consumerID"].(string); ok {
-		// Create a new context with the consumerID
-		ctx = context.WithValue(ctx, "consumerID", consumerID)
+	if claims.ConsumerID != "" {
+		ctx = context.WithValue(ctx, "consumerID", claims.ConsumerID)
+	}
+	if claims.MaxPriority != nil {
+		ctx = context.WithValue(ctx, "maxPriority", *claims.MaxPriority)
+	}
+	ctx = context.WithValue(ctx, "subject", claims.subject())
+	ctx = context.WithValue(ctx, "roles", claims.grantedRoles())
+	if claims.DeviceID != "" {
+		ctx = context.WithValue(ctx, "deviceID", claims.DeviceID)
 	}
+	return ctx, nil
+}
 
-	return handler(ctx, req)
+// consumerIDFromContext returns the consumer ID injected into the context by TokenInterceptor,
+// or an empty string if the token carried no consumer ID.
+func consumerIDFromContext(ctx context.Context) string {
+	consumerID, _ := ctx.Value("consumerID").(string)
+	return consumerID
+}
+
+// subjectFromContext returns the subject of the caller's token injected into the context by TokenInterceptor:
+// its sub claim, or its consumer ID when it has none.
+func subjectFromContext(ctx context.Context) string {
+	subject, _ := ctx.Value("subject").(string)
+	return subject
+}
+
+// maxPriorityFromContext returns the highest job priority the caller's token allows.
+// Tokens without a max_priority claim fall back to the configured default.
+func maxPriorityFromContext(ctx context.Context) int32 {
+	if maxPriority, ok := ctx.Value("maxPriority").(int32); ok {
+		return maxPriority
+	}
+	return AppConfig.Scheduler.DefaultMaxPriority
 }
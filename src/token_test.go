@@ -0,0 +1,102 @@
+package tango
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// withTokenChecks sets the issuer, audience, clock skew and maximum lifetime tokens are checked against
+// for the duration of the test.
+func withTokenChecks(t *testing.T, issuer, audience string, skewSeconds, maxLifetimeSeconds int) {
+	t.Helper()
+	saved := AppConfig.Tokens
+	AppConfig.Tokens.Issuer = issuer
+	AppConfig.Tokens.Audience = audience
+	AppConfig.Tokens.ClockSkewSeconds = skewSeconds
+	AppConfig.Tokens.MaxLifetimeSeconds = maxLifetimeSeconds
+	t.Cleanup(func() { AppConfig.Tokens = saved })
+}
+
+// signHS256 returns a token of the claims signed with HS256 under the secret.
+func signHS256(t *testing.T, claims any, secret string) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(generateHmacSha256Signature(input, secret))
+}
+
+// TestValidateClaims checks the time-based, issuer and audience checks of token claims, and the clock skew they allow.
+func TestValidateClaims(t *testing.T) {
+	withTokenChecks(t, "https://issuer.example", "tango", 30, 3600)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	unix := float64(now.Unix())
+	valid := func(edit func(c *Claims)) Claims {
+		c := Claims{Issuer: "https://issuer.example", Audience: audience{"other", "tango"}, IssuedAt: unix - 60, ExpiresAt: unix + 600}
+		if edit != nil {
+			edit(&c)
+		}
+		return c
+	}
+	tests := []struct {
+		name   string
+		claims Claims
+		valid  bool
+	}{
+		{"valid", valid(nil), true},
+		{"no expiry", valid(func(c *Claims) { c.ExpiresAt = 0 }), false},
+		{"expired", valid(func(c *Claims) { c.ExpiresAt = unix - 31 }), false},
+		{"expired within skew", valid(func(c *Claims) { c.ExpiresAt = unix - 29 }), true},
+		{"not valid yet", valid(func(c *Claims) { c.NotBefore = unix + 31 }), false},
+		{"not valid yet within skew", valid(func(c *Claims) { c.NotBefore = unix + 29 }), true},
+		{"issued in the future", valid(func(c *Claims) { c.IssuedAt = unix + 31 }), false},
+		{"issued in the future within skew", valid(func(c *Claims) { c.IssuedAt = unix + 29 }), true},
+		{"wrong issuer", valid(func(c *Claims) { c.Issuer = "https://attacker.example" }), false},
+		{"no issuer", valid(func(c *Claims) { c.Issuer = "" }), false},
+		{"wrong audience", valid(func(c *Claims) { c.Audience = audience{"other"} }), false},
+		{"lifetime over the cap", valid(func(c *Claims) { c.ExpiresAt = c.IssuedAt + 3601 }), false},
+		{"lifetime at the cap", valid(func(c *Claims) { c.ExpiresAt = c.IssuedAt + 3600 }), true},
+		{"lifetime over the cap without iat", valid(func(c *Claims) { c.IssuedAt = 0; c.ExpiresAt = unix + 3601 }), false},
+		{"refresh token over the cap", valid(func(c *Claims) { c.TokenUse = tokenUseRefresh; c.ExpiresAt = c.IssuedAt + 86400 }), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateClaims(&tt.claims, now)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateClaims = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+// TestValidateJWT checks that ValidateJWT verifies the signature and validates the claims of a token,
+// including an audience given as a single string.
+func TestValidateJWT(t *testing.T) {
+	withTokenChecks(t, "", "tango", 0, 0)
+	const secret = "0123456789abcdef0123456789abcdef"
+	exp := time.Now().Add(time.Minute).Unix()
+	tests := []struct {
+		name   string
+		token  string
+		secret string
+		valid  bool
+	}{
+		{"valid", signHS256(t, map[string]any{"aud": "tango", "exp": exp}, secret), secret, true},
+		{"wrong secret", signHS256(t, map[string]any{"aud": "tango", "exp": exp}, secret), "another secret, just as long as one", false},
+		{"wrong audience", signHS256(t, map[string]any{"aud": []string{"other"}, "exp": exp}, secret), secret, false},
+		{"expired", signHS256(t, map[string]any{"aud": "tango", "exp": time.Now().Add(-time.Minute).Unix()}, secret), secret, false},
+		{"malformed", "not.a-token", secret, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateJWT(tt.token, tt.secret)
+			if (err == nil) != tt.valid {
+				t.Errorf("ValidateJWT = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
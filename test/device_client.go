@@ -19,6 +19,7 @@ import (
 )
 
 var serverAddr string
+var registrationSecret string
 
 // multiplyMatrices multiplies two matrices A and B and scales the resulting matrix by the given scale factor.
 // It returns the product matrix or an error if the matrix dimensions are incompatible.
@@ -72,12 +73,66 @@ func initDeviceClient(deviceID string) (pb.TangoServiceClient, *grpc.ClientConn)
 	return pb.NewTangoServiceClient(conn), conn
 }
 
-// createAuthCtx creates an authenticated context for the device using a test token.
-func createAuthCtx(deviceID string) (context.Context, context.CancelFunc) {
+// deviceAuth holds the tokens of a simulated device. Until the device registers, calls use the shared test token,
+// or an access token the registration secret is exchanged for when one is given. Registering returns tokens
+// bound to the device, and the access token is renewed with the refresh token shortly before it expires.
+type deviceAuth struct {
+	mu           sync.Mutex
+	client       pb.TangoServiceClient
+	accessToken  string
+	refreshToken string
+	expiresAt    int64 // Unix timestamp (seconds) at which the access token expires.
+}
+
+// token returns a valid access token, issuing or refreshing one if needed.
+func (a *deviceAuth) token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.accessToken != "" && time.Now().Unix() < a.expiresAt-30 {
+		return a.accessToken, nil
+	}
+	if a.refreshToken == "" && registrationSecret == "" {
+		return tango.GetTestToken()
+	}
+	var reply *pb.TokenReply
+	var err error
+	if a.refreshToken != "" {
+		reply, err = a.client.RefreshToken(ctx, &pb.RefreshRequest{RefreshToken: a.refreshToken})
+	} else {
+		reply, err = a.client.IssueToken(ctx, &pb.TokenRequest{ApiKey: registrationSecret})
+	}
+	if err != nil {
+		return "", err
+	}
+	return a.accept(reply)
+}
+
+// bind switches to the tokens bound to the device, returned when it registered.
+func (a *deviceAuth) bind(reply *pb.TokenReply) error {
+	if reply == nil {
+		return errors.New("no device tokens issued")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := a.accept(reply)
+	return err
+}
+
+// accept stores the tokens of a reply. The caller must hold a.mu.
+func (a *deviceAuth) accept(reply *pb.TokenReply) (string, error) {
+	if !reply.Accepted {
+		return "", errors.New(reply.Message)
+	}
+	a.accessToken, a.refreshToken, a.expiresAt = reply.AccessToken, reply.RefreshToken, reply.ExpiresAt
+	return a.accessToken, nil
+}
+
+// createAuthCtx creates an authenticated context for the device.
+func createAuthCtx(deviceID string, auth *deviceAuth) (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	token, err := tango.GetTestToken()
+	token, err := auth.token(ctx)
 	if err != nil {
-		log.Printf("Device %s: failed to get test token: %v", deviceID, err)
+		log.Printf("Device %s: failed to get token: %v", deviceID, err)
 		return ctx, cancel
 	}
 	md := metadata.New(map[string]string{"tango-token": token})
@@ -85,9 +140,59 @@ func createAuthCtx(deviceID string) (context.Context, context.CancelFunc) {
 	return ctx, cancel
 }
 
+// measureFlops estimates the throughput of this device in FLOP/s
+// by timing a small matrix multiplication.
+func measureFlops() float64 {
+	const size = 64
+	A := make([][]float32, size)
+	B := make([][]float32, size)
+	for i := 0; i < size; i++ {
+		A[i] = make([]float32, size)
+		B[i] = make([]float32, size)
+		for j := 0; j < size; j++ {
+			A[i][j] = float32(i + j)
+			B[i][j] = float32(i - j)
+		}
+	}
+	start := time.Now()
+	if _, err := multiplyMatrices(A, B, 1.0); err != nil {
+		return 0
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1e-9
+	}
+	return 2 * size * size * size / elapsed
+}
+
+// registerDevice announces the simulated device's capabilities to Tango, switches to the tokens bound to
+// the device and returns the server-issued device ID.
+func registerDevice(name string, client pb.TangoServiceClient, auth *deviceAuth) (string, error) {
+	ctx, cancel := createAuthCtx(name, auth)
+	defer cancel()
+	reg := &pb.DeviceRegistration{
+		Operations:     []string{"scaled_matmul"},
+		Dtypes:         []string{"float32"},
+		MemoryBytes:    512 * 1024 * 1024,
+		FlopsPerSecond: measureFlops(),
+		MaxShardBytes:  64 * 1024 * 1024,
+	}
+	reply, err := client.RegisterDevice(ctx, reg)
+	if err != nil {
+		return "", err
+	}
+	if !reply.Accepted {
+		return "", errors.New(reply.Message)
+	}
+	if err := auth.bind(reply.Tokens); err != nil {
+		return "", fmt.Errorf("failed to bind tokens: %w", err)
+	}
+	return reply.DeviceId, nil
+}
+
 // processTask fetches and processes a task for the specified device.
-func processTask(deviceID string, client pb.TangoServiceClient) {
-	ctx, cancel := createAuthCtx(deviceID)
+func processTask(deviceID string, client pb.TangoServiceClient, auth *deviceAuth) {
+	ctx, cancel := createAuthCtx(deviceID, auth)
 	req := &pb.DeviceRequest{DeviceId: deviceID}
 	task, err := client.FetchTask(ctx, req)
 	cancel()
@@ -96,6 +201,7 @@ func processTask(deviceID string, client pb.TangoServiceClient) {
 		return
 	}
 	var resultData []byte
+	var flops int64
 	if task.Operation == "scaled_matmul" {
 		var A, B [][]float32
 		if err := json.Unmarshal(task.AData, &A); err != nil {
@@ -116,6 +222,9 @@ func processTask(deviceID string, client pb.TangoServiceClient) {
 			return
 		}
 		resultData = []byte(matrixToString(C))
+		// Rows of A, columns of B and the shared dimension: a multiply-add per term, then one scaling per element.
+		rows, cols, d := int64(len(A)), int64(len(B[0])), int64(len(B))
+		flops = 2*rows*cols*d + rows*cols
 	} else {
 		resultData = []byte("unsupported operation")
 	}
@@ -125,9 +234,9 @@ func processTask(deviceID string, client pb.TangoServiceClient) {
 		JobId:      task.JobId,
 		TaskId:     task.TaskId,
 		ResultData: resultData,
-		Flops:      2 * task.M * task.N * task.D,
+		Flops:      flops,
 	}
-	ctx, cancel = createAuthCtx(deviceID)
+	ctx, cancel = createAuthCtx(deviceID, auth)
 	report, err := client.ReportResult(ctx, taskRes)
 	cancel()
 	if err != nil {
@@ -139,16 +248,23 @@ func processTask(deviceID string, client pb.TangoServiceClient) {
 	}
 }
 
-// processDevice continuously processes tasks for the given device.
-func processDevice(deviceID string) {
-	client, conn := initDeviceClient(deviceID)
+// processDevice registers the given device and continuously processes tasks for it.
+func processDevice(name string) {
+	client, conn := initDeviceClient(name)
 	if client == nil || conn == nil {
-		log.Printf("Device %s: Unable to initialize client", deviceID)
+		log.Printf("Device %s: Unable to initialize client", name)
 		return
 	}
 	defer conn.Close()
+	auth := &deviceAuth{client: client}
+	deviceID, err := registerDevice(name, client, auth)
+	if err != nil {
+		log.Printf("Device %s: registration failed: %v", name, err)
+		return
+	}
+	log.Printf("Device %s registered as %s", name, deviceID)
 	for {
-		processTask(deviceID, client)
+		processTask(deviceID, client, auth)
 		time.Sleep(100 * time.Millisecond)
 	}
 }
@@ -158,6 +274,7 @@ func main() {
 	// Change default number of devices from 100 to runtime.NumCPU()
 	numDevices := flag.Int("devices", runtime.NumCPU(), "number of devices to simulate")
 	tangoAddressPointer := flag.String("tango-address", "", "the external IP for the Tango server")
+	flag.StringVar(&registrationSecret, "registration-secret", "", "registration secret exchanged for device tokens; the shared test token is used when empty")
 	flag.Parse()
 
 	log.Printf("Number of devices: %d", *numDevices)
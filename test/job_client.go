@@ -20,9 +20,15 @@ import (
 )
 
 var tangoAddress string
+var targetShardMillis int
+var priority int
+var apiKey string
 
 func init() {
 	flag.StringVar(&tangoAddress, "tango-address", "localhost:50051", " address of the Tango service")
+	flag.IntVar(&targetShardMillis, "target-shard-ms", 0, "target shard duration in milliseconds; enables adaptive sharding when set")
+	flag.IntVar(&priority, "priority", 0, "job priority, bounded by the max_priority claim of the token")
+	flag.StringVar(&apiKey, "api-key", "", "API key exchanged for an access token; the shared test token is used when empty")
 }
 
 // matrixToString converts a 2D float32 matrix into a formatted string.
@@ -119,15 +125,31 @@ func initClient() (pb.TangoServiceClient, context.Context, context.CancelFunc, *
 	client := pb.NewTangoServiceClient(conn)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	token, err := tango.GetTestToken()
+	token, err := fetchToken(ctx, client)
 	if err != nil {
-		log.Fatalf("failed to get test token: %v", err)
+		log.Fatalf("failed to get token: %v", err)
 	}
 	md := metadata.New(map[string]string{"tango-token": token})
 	ctx = metadata.NewOutgoingContext(ctx, md)
 	return client, ctx, cancel, conn
 }
 
+// fetchToken returns the access token to call Tango with: one issued in exchange for the API key,
+// or the shared test token when no API key is given.
+func fetchToken(ctx context.Context, client pb.TangoServiceClient) (string, error) {
+	if apiKey == "" {
+		return tango.GetTestToken()
+	}
+	reply, err := client.IssueToken(ctx, &pb.TokenRequest{ApiKey: apiKey})
+	if err != nil {
+		return "", err
+	}
+	if !reply.Accepted {
+		return "", fmt.Errorf("token refused: %s", reply.Message)
+	}
+	return reply.AccessToken, nil
+}
+
 // submitJob creates and submits a matrix multiplication job to the Tango service.
 // It generates a random job ID, creates two matrices A and B, marshals them into JSON,
 // and constructs a TaskRequest. If the task is accepted, it returns the job ID and the matrices.
@@ -173,6 +195,11 @@ func submitJob(client pb.TangoServiceClient, ctx context.Context) (string, [][]f
 		N:           int32(N),
 		D:           int32(D),
 		ScaleScalar: newFloat32(1.0),
+		Priority:    int32(priority),
+	}
+	if targetShardMillis > 0 {
+		target := int32(targetShardMillis)
+		jobReq.TargetShardMillis = &target
 	}
 	res, err := client.SubmitTask(ctx, jobReq)
 	if err != nil {